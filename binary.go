@@ -0,0 +1,417 @@
+package subvert
+
+import (
+	"bytes"
+	"debug/buildinfo"
+	"debug/elf"
+	"debug/gosym"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// BinaryFormat is the object file format of an executable.
+type BinaryFormat string
+
+const (
+	BinaryFormatELF   BinaryFormat = "ELF"
+	BinaryFormatMachO BinaryFormat = "Mach-O"
+	BinaryFormatPE    BinaryFormat = "PE"
+)
+
+// Binary is a go executable opened by OpenBinary().
+type Binary struct {
+	Path      string
+	Format    BinaryFormat
+	GoVersion string
+	BuildInfo *buildinfo.BuildInfo
+	// The go function symbols
+	Symbols *gosym.Table
+	// Symbols of everything that isn't code (variables, read-only data and so
+	// on), sorted by address.
+	DataSymbols []BinarySymbol
+}
+
+// BinarySymbol is a symbol in an executable opened by OpenBinary(). Sizes that
+// the object format doesn't record are inferred from the next symbol.
+type BinarySymbol struct {
+	Name    string
+	Address uint64
+	Size    uint64
+}
+
+// OpenBinary reads the symbols and build information of the go executable at
+// path. The executable can be in any of the supported formats (ELF, Mach-O or
+// PE), regardless of the platform this is running on.
+//
+// Mach-O universal binaries are not supported.
+func OpenBinary(path string) (binary *Binary, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	format, err := detectBinaryFormat(file)
+	if err != nil {
+		err = fmt.Errorf("%v: %w", path, err)
+		return
+	}
+
+	binary = &Binary{Path: path, Format: format}
+	switch format {
+	case BinaryFormatELF:
+		binary.Symbols, binary.DataSymbols, err = readELFBinary(file)
+	case BinaryFormatMachO:
+		binary.Symbols, binary.DataSymbols, err = readMachOBinary(file)
+	case BinaryFormatPE:
+		binary.Symbols, binary.DataSymbols, err = readPEBinary(file)
+	}
+	if err != nil {
+		err = fmt.Errorf("Could not read %v symbols from %v: %w", format, path, err)
+		return nil, err
+	}
+
+	if binary.BuildInfo, err = buildinfo.Read(file); err != nil {
+		err = fmt.Errorf("Could not read build info from %v: %w", path, err)
+		return nil, err
+	}
+	binary.GoVersion = binary.BuildInfo.GoVersion
+	return
+}
+
+func detectBinaryFormat(reader io.ReaderAt) (format BinaryFormat, err error) {
+	magic := make([]byte, 4)
+	if _, err = reader.ReadAt(magic, 0); err != nil {
+		return
+	}
+	switch {
+	case bytes.Equal(magic, []byte("\x7fELF")):
+		format = BinaryFormatELF
+	case bytes.Equal(magic[:3], []byte{0xfe, 0xed, 0xfa}) && magic[3]&0xfe == 0xce,
+		bytes.Equal(magic[1:], []byte{0xfa, 0xed, 0xfe}) && magic[0]&0xfe == 0xce:
+		format = BinaryFormatMachO
+	case bytes.Equal(magic, []byte{0xca, 0xfe, 0xba, 0xbe}):
+		err = fmt.Errorf("Mach-O universal binaries are not supported")
+	case bytes.Equal(magic[:2], []byte("MZ")):
+		format = BinaryFormatPE
+	default:
+		err = fmt.Errorf("Unrecognized executable format (magic % x)", magic)
+	}
+	return
+}
+
+func readELFLineTable(reader io.ReaderAt) (lineTableData []byte, textStart uint64, err error) {
+	exe, err := elf.NewFile(reader)
+	if err != nil {
+		return
+	}
+	defer exe.Close()
+	return readELFGoLineTable(exe)
+}
+
+func readELFGoLineTable(exe *elf.File) (lineTableData []byte, textStart uint64, err error) {
+	sect := exe.Section(".text")
+	if sect == nil {
+		err = fmt.Errorf("Unable to find ELF .text section")
+		return
+	}
+	textStart = sect.Addr
+
+	sect = exe.Section(".gopclntab")
+	if sect == nil {
+		err = fmt.Errorf("Unable to find ELF .gopclntab section")
+		return
+	}
+	lineTableData, err = sect.Data()
+	return
+}
+
+func readELFBinary(reader io.ReaderAt) (symTable *gosym.Table, data []BinarySymbol, err error) {
+	exe, err := elf.NewFile(reader)
+	if err != nil {
+		return
+	}
+	defer exe.Close()
+
+	lineTableData, textStart, err := readELFGoLineTable(exe)
+	if err != nil {
+		return
+	}
+	if symTable, err = gosym.NewTable([]byte{}, gosym.NewLineTable(lineTableData, textStart)); err != nil {
+		return
+	}
+
+	symbols, err := exe.Symbols()
+	if err != nil {
+		// Stripped binaries still have their go symbols.
+		err = nil
+		return
+	}
+	for _, s := range symbols {
+		if elf.ST_TYPE(s.Info) == elf.STT_OBJECT && s.Section != elf.SHN_UNDEF && s.Name != "" {
+			data = append(data, BinarySymbol{Name: s.Name, Address: s.Value, Size: s.Size})
+		}
+	}
+	sortBinarySymbols(data)
+	return
+}
+
+func readMachOLineTable(reader io.ReaderAt) (lineTableData []byte, textStart uint64, err error) {
+	exe, err := macho.NewFile(reader)
+	if err != nil {
+		return
+	}
+	defer exe.Close()
+	return readMachOGoLineTable(exe)
+}
+
+func readMachOGoLineTable(exe *macho.File) (lineTableData []byte, textStart uint64, err error) {
+	var sect *macho.Section
+	if sect = exe.Section("__text"); sect == nil {
+		err = fmt.Errorf("Unable to find Mach-O __text section")
+		return
+	}
+	textStart = sect.Addr
+
+	if sect = exe.Section("__gopclntab"); sect == nil {
+		err = fmt.Errorf("Unable to find Mach-O __gopclntab section")
+		return
+	}
+	lineTableData, err = sect.Data()
+	return
+}
+
+func readMachOBinary(reader io.ReaderAt) (symTable *gosym.Table, data []BinarySymbol, err error) {
+	exe, err := macho.NewFile(reader)
+	if err != nil {
+		return
+	}
+	defer exe.Close()
+
+	lineTableData, textStart, err := readMachOGoLineTable(exe)
+	if err != nil {
+		return
+	}
+	if symTable, err = gosym.NewTable([]byte{}, gosym.NewLineTable(lineTableData, textStart)); err != nil {
+		return
+	}
+	if exe.Symtab == nil {
+		return
+	}
+
+	const sectionInstructions = 0x80000000 | 0x00000400
+	var unsized []unsizedBinarySymbol
+	for _, s := range exe.Symtab.Syms {
+		// Only non-debug symbols defined in a section (N_SECT)
+		if s.Sect == 0 || int(s.Sect) > len(exe.Sections) ||
+			s.Type&0xe0 != 0 || s.Type&0x0e != 0x0e || s.Name == "" {
+			continue
+		}
+		sect := exe.Sections[s.Sect-1]
+		if sect.Flags&sectionInstructions != 0 {
+			continue
+		}
+		unsized = append(unsized, unsizedBinarySymbol{
+			BinarySymbol: BinarySymbol{Name: s.Name, Address: s.Value},
+			sectionEnd:   sect.Addr + sect.Size,
+		})
+	}
+	data = sizeBinarySymbols(unsized)
+	return
+}
+
+func readPELineTable(reader io.ReaderAt) (lineTableData []byte, textStart uint64, err error) {
+	exe, err := pe.NewFile(reader)
+	if err != nil {
+		return
+	}
+	defer exe.Close()
+	return readPEGoLineTable(exe)
+}
+
+func getPEImageBase(exe *pe.File) (imageBase uint64, err error) {
+	switch oh := exe.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		imageBase = uint64(oh.ImageBase)
+	case *pe.OptionalHeader64:
+		imageBase = oh.ImageBase
+	default:
+		err = fmt.Errorf("Unrecognized PE format")
+	}
+	return
+}
+
+func readPEGoLineTable(exe *pe.File) (lineTableData []byte, textStart uint64, err error) {
+	imageBase, err := getPEImageBase(exe)
+	if err != nil {
+		return
+	}
+
+	sect := exe.Section(".text")
+	if sect == nil {
+		err = fmt.Errorf("Unable to find PE .text section")
+		return
+	}
+	textStart = imageBase + uint64(sect.VirtualAddress)
+
+	findSymbol := func(symbols []*pe.Symbol, name string) *pe.Symbol {
+		for _, s := range symbols {
+			if s.Name == name {
+				return s
+			}
+		}
+		return nil
+	}
+
+	lineTableStart := findSymbol(exe.Symbols, "runtime.pclntab")
+	lineTableEnd := findSymbol(exe.Symbols, "runtime.epclntab")
+	if lineTableStart == nil || lineTableEnd == nil {
+		// Stripped binaries (-ldflags=-s) have no symbols.
+		lineTableData, err = findPEPclntab(exe, textStart)
+		return
+	}
+	sectionIndex := lineTableStart.SectionNumber - 1
+	if sectionIndex < 0 || int(sectionIndex) >= len(exe.Sections) {
+		err = fmt.Errorf("Invalid PE format: invalid section number %v", lineTableStart.SectionNumber)
+		return
+	}
+	lineTableData, err = exe.Sections[sectionIndex].Data()
+	if err != nil {
+		return
+	}
+	if int(lineTableStart.Value) > len(lineTableData) ||
+		int(lineTableEnd.Value) > len(lineTableData) ||
+		lineTableStart.Value > lineTableEnd.Value {
+		err = fmt.Errorf("Invalid PE pcln start/end indices: %v, %v", lineTableStart.Value, lineTableEnd.Value)
+		return
+	}
+	lineTableData = lineTableData[lineTableStart.Value:lineTableEnd.Value]
+	return
+}
+
+// Find the pclntab in a PE file's data sections by its header, and check that
+// it's usable by looking up a function that every go program has.
+func findPEPclntab(exe *pe.File, textStart uint64) (lineTableData []byte, err error) {
+	ptrSize := byte(8)
+	if _, ok := exe.OptionalHeader.(*pe.OptionalHeader32); ok {
+		ptrSize = 4
+	}
+	const scnCode = 0x00000020
+	for _, sect := range exe.Sections {
+		if sect.Characteristics&scnCode != 0 {
+			continue
+		}
+		var data []byte
+		if data, err = sect.Data(); err != nil {
+			return
+		}
+		for offset := 0; offset+8 <= len(data); offset += 4 {
+			candidate := data[offset:]
+			magic := binary.LittleEndian.Uint32(candidate)
+			if (magic != pclntabMagics[0] && magic != pclntabMagics[1]) ||
+				candidate[4] != 0 || candidate[5] != 0 || candidate[7] != ptrSize {
+				continue
+			}
+			if isGoLineTable(candidate, textStart) {
+				return candidate, nil
+			}
+		}
+	}
+	err = fmt.Errorf("Could not find PE runtime.pclntab")
+	return
+}
+
+// Something that only looks like a pclntab can have offsets that are out of
+// range, which makes gosym panic.
+func isGoLineTable(data []byte, textStart uint64) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	table, err := gosym.NewTable([]byte{}, gosym.NewLineTable(data, textStart))
+	return err == nil && table.LookupFunc("runtime.main") != nil
+}
+
+func readPEBinary(reader io.ReaderAt) (symTable *gosym.Table, data []BinarySymbol, err error) {
+	exe, err := pe.NewFile(reader)
+	if err != nil {
+		return
+	}
+	defer exe.Close()
+
+	lineTableData, textStart, err := readPEGoLineTable(exe)
+	if err != nil {
+		return
+	}
+	if symTable, err = gosym.NewTable([]byte{}, gosym.NewLineTable(lineTableData, textStart)); err != nil {
+		return
+	}
+	imageBase, err := getPEImageBase(exe)
+	if err != nil {
+		return
+	}
+
+	const scnCode = 0x00000020
+	var unsized []unsizedBinarySymbol
+	for _, s := range exe.Symbols {
+		sectionIndex := int(s.SectionNumber) - 1
+		if sectionIndex < 0 || sectionIndex >= len(exe.Sections) || s.Name == "" {
+			continue
+		}
+		sect := exe.Sections[sectionIndex]
+		if sect.Characteristics&scnCode != 0 {
+			continue
+		}
+		sectStart := imageBase + uint64(sect.VirtualAddress)
+		unsized = append(unsized, unsizedBinarySymbol{
+			BinarySymbol: BinarySymbol{Name: s.Name, Address: sectStart + uint64(s.Value)},
+			sectionEnd:   sectStart + uint64(sect.VirtualSize),
+		})
+	}
+	data = sizeBinarySymbols(unsized)
+	return
+}
+
+func sortBinarySymbols(symbols []BinarySymbol) {
+	sort.SliceStable(symbols, func(i, j int) bool {
+		return symbols[i].Address < symbols[j].Address
+	})
+}
+
+// A symbol whose size isn't recorded, and the end of the section containing it.
+type unsizedBinarySymbol struct {
+	BinarySymbol
+	sectionEnd uint64
+}
+
+// Some object formats don't record symbol sizes, so sort symbols, sizing each
+// one to extend to the next symbol at a higher address or the end of its
+// section.
+func sizeBinarySymbols(unsized []unsizedBinarySymbol) (symbols []BinarySymbol) {
+	sort.SliceStable(unsized, func(i, j int) bool {
+		return unsized[i].Address < unsized[j].Address
+	})
+	symbols = make([]BinarySymbol, len(unsized))
+	next := ^uint64(0)
+	for i := len(unsized) - 1; i >= 0; i-- {
+		s := unsized[i]
+		if i+1 < len(unsized) && unsized[i+1].Address > s.Address {
+			next = unsized[i+1].Address
+		}
+		end := s.sectionEnd
+		if next < end {
+			end = next
+		}
+		if end > s.Address {
+			s.Size = end - s.Address
+		}
+		symbols[i] = s.BinarySymbol
+	}
+	return
+}
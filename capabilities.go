@@ -0,0 +1,264 @@
+package subvert
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// Feature is a part of this package whose support depends on the platform,
+// the go version, or how the executable was built.
+type Feature string
+
+const (
+	// MakeWritable(), MakeAddressable() and everything built on them
+	FeatureReflectFlags Feature = "reflect-flags"
+	// Symbol lookups such as ExposeFunction() and Symbolize()
+	FeatureSymbolTable Feature = "symbol-table"
+	// Reading symbols from the loaded image rather than the executable file
+	FeatureInMemorySymbols Feature = "in-memory-symbols"
+	// ReplaceFunction(), RedirectCalls() and everything built on them
+	FeatureCallRedirection Feature = "call-redirection"
+	// Protect(), PatchMemory() and Seal()
+	FeatureMemoryProtection Feature = "memory-protection"
+	// Reading runtime internals, such as Goroutines() and Classify()
+	FeatureRuntimeLayouts Feature = "runtime-layouts"
+)
+
+// Capability reports whether a feature works in this process.
+type Capability struct {
+	Feature Feature
+	Works   bool
+	// How the feature works (for example where symbols were loaded from), or
+	// why it doesn't.
+	Detail string
+}
+
+func (c Capability) String() string {
+	if c.Works {
+		return fmt.Sprintf("%v: works (%v)", c.Feature, c.Detail)
+	}
+	return fmt.Sprintf("%v: doesn't work: %v", c.Feature, c.Detail)
+}
+
+// Capabilities reports which features should work on this GOOS, GOARCH and go
+// version, and why the others don't. Use SelfTest() to actually exercise them.
+//
+// This loads the symbol table if it hasn't been loaded yet.
+func Capabilities() []Capability {
+	return []Capability{
+		reflectFlagsCapability(),
+		symbolTableCapability(),
+		inMemorySymbolsCapability(),
+		callRedirectionCapability(),
+		memoryProtectionCapability(),
+		runtimeLayoutsCapability(),
+	}
+}
+
+// SelfTest exercises each feature that Capabilities() reports as working, and
+// reports the ones that fail as not working. Features that work by patching
+// code are only exercised on functions belonging to the self test.
+func SelfTest() []Capability {
+	tests := map[Feature]func() error{
+		FeatureReflectFlags:     selfTestReflectFlags,
+		FeatureSymbolTable:      selfTestSymbolTable,
+		FeatureCallRedirection:  selfTestCallRedirection,
+		FeatureMemoryProtection: selfTestMemoryProtection,
+		FeatureRuntimeLayouts:   selfTestRuntimeLayouts,
+	}
+
+	capabilities := Capabilities()
+	for i, capability := range capabilities {
+		if test := tests[capability.Feature]; capability.Works && test != nil {
+			if err := runSelfTest(test); err != nil {
+				capabilities[i].Works = false
+				capabilities[i].Detail = fmt.Sprintf("Self test failed: %v", err)
+			}
+		}
+	}
+	return capabilities
+}
+
+func reflectFlagsCapability() Capability {
+	initReflectValue()
+	if !rvFlagsFound {
+		return Capability{FeatureReflectFlags, false, rvFlagsError.Error()}
+	}
+	return Capability{FeatureReflectFlags, true, fmt.Sprintf("flag field at offset %v", rvFlagOffset)}
+}
+
+func symbolTableCapability() Capability {
+	if _, err := GetSymbolTable(); err != nil {
+		return Capability{FeatureSymbolTable, false, err.Error()}
+	}
+	return Capability{FeatureSymbolTable, true, "loaded from " + symTableSource}
+}
+
+func inMemorySymbolsCapability() Capability {
+	_, err := GetSymbolTable()
+	if symbolSource != nil {
+		if _, ok := symbolSource.(memorySymbolSource); ok {
+			if err != nil {
+				return Capability{FeatureInMemorySymbols, false, err.Error()}
+			}
+			return Capability{FeatureInMemorySymbols, true, fmt.Sprintf("image at %#x", processBaseAddress)}
+		}
+		return Capability{FeatureInMemorySymbols, false, "Not used, because symbols are loaded from " + symbolSource.String()}
+	}
+	if err == nil && symTableMemoryError == nil {
+		return Capability{FeatureInMemorySymbols, true, fmt.Sprintf("image at %#x", processBaseAddress)}
+	}
+	if symTableMemoryError != nil {
+		return Capability{FeatureInMemorySymbols, false, symTableMemoryError.Error()}
+	}
+	return Capability{FeatureInMemorySymbols, false, "The in-memory image could not be read"}
+}
+
+func callRedirectionCapability() Capability {
+	if !osSupportsCallRedirection {
+		return Capability{FeatureCallRedirection, false, fmt.Sprintf("Not implemented on %v", runtime.GOARCH)}
+	}
+	if _, err := GetSymbolTable(); err != nil {
+		return Capability{FeatureCallRedirection, false, fmt.Sprintf("Requires the symbol table: %v", err)}
+	}
+	return Capability{FeatureCallRedirection, true, "direct calls only; inlined calls are not redirected"}
+}
+
+func memoryProtectionCapability() Capability {
+	if err := initProcess(); err != nil {
+		return Capability{FeatureMemoryProtection, false, err.Error()}
+	}
+	detail := "mprotect"
+	if runtime.GOOS == "windows" {
+		detail = "VirtualProtect"
+	} else if _, err := GetMemoryMap(); err != nil {
+		// Old protections are read from the memory map.
+		detail += "; old protections can't be read, and are assumed to be r-x"
+	}
+	return Capability{FeatureMemoryProtection, true, detail}
+}
+
+func runtimeLayoutsCapability() Capability {
+	if _, err := getDWARFLayouts(); err == nil {
+		return Capability{FeatureRuntimeLayouts, true, "read from DWARF debug info"}
+	}
+	if _, err := getRuntimeLayout(); err != nil {
+		return Capability{FeatureRuntimeLayouts, false, fmt.Sprintf("No DWARF debug info, and %v", err)}
+	}
+	return Capability{FeatureRuntimeLayouts, true, "built-in table for " + runtime.Version()}
+}
+
+func runSelfTest(test func() error) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("panic: %v", e)
+		}
+	}()
+	return test()
+}
+
+func selfTestReflectFlags() (err error) {
+	v := reflect.ValueOf(struct{ a int }{42}).Field(0)
+	if err = MakeWritable(&v); err != nil {
+		return
+	}
+	if v.Interface().(int) != 42 {
+		return fmt.Errorf("Read %v from an unexported field instead of 42", v.Interface())
+	}
+	if err = MakeAddressable(&v); err != nil {
+		return
+	}
+	if v.UnsafeAddr() == 0 {
+		return fmt.Errorf("Addressable value has no address")
+	}
+	return
+}
+
+func selfTestSymbolTable() (err error) {
+	symbol, err := GetFunctionSymbol(selfTestTarget)
+	if err != nil {
+		return
+	}
+	if !strings.HasSuffix(symbol.Name, ".selfTestTarget") {
+		return fmt.Errorf("Expected symbol selfTestTarget but got %v", symbol.Name)
+	}
+	return
+}
+
+//go:noinline
+func selfTestTarget() int {
+	return 1
+}
+
+func selfTestReplacement() int {
+	return 2
+}
+
+//go:noinline
+func selfTestCaller() int {
+	return selfTestTarget()
+}
+
+func selfTestCallRedirection() (err error) {
+	patches, err := RedirectCalls(selfTestTarget, selfTestReplacement)
+	if err != nil {
+		return
+	}
+	result := selfTestCaller()
+	for i := len(patches) - 1; i >= 0; i-- {
+		if e := patches[i].Revert(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return
+	}
+	if result != 2 {
+		return fmt.Errorf("Redirected call returned %v instead of 2", result)
+	}
+	if result = selfTestCaller(); result != 1 {
+		return fmt.Errorf("Reverted call returned %v instead of 1", result)
+	}
+	return
+}
+
+func selfTestMemoryProtection() (err error) {
+	address, err := osAllocatePages(uintptr(pageSize))
+	if err != nil {
+		return
+	}
+	defer func() {
+		if freeErr := osFreePages(address, uintptr(pageSize)); err == nil {
+			err = freeErr
+		}
+	}()
+	memory := SliceAtAddress(address, pageSize)
+	if _, err = Protect(address, uintptr(pageSize), ProtectionR); err != nil {
+		return
+	}
+	if runtime.GOOS == "linux" || runtime.GOOS == "windows" {
+		if protection := osGetMemoryProtection(address) & ProtectionRWX; protection != ProtectionR {
+			return fmt.Errorf("Page protection is %v instead of r--", protection)
+		}
+	}
+	if _, err = Protect(address, uintptr(pageSize), ProtectionRW); err != nil {
+		return
+	}
+	memory[0] = 1
+	return
+}
+
+func selfTestRuntimeLayouts() (err error) {
+	offset, err := getRuntimeFieldOffset("g.goid")
+	if err != nil {
+		return
+	}
+	if g := getg(); g != 0 {
+		if goid := readUint64At(g + offset); goid != stackGoroutineID() {
+			return fmt.Errorf("Read goroutine ID %v instead of %v", goid, stackGoroutineID())
+		}
+	}
+	return
+}
@@ -0,0 +1,247 @@
+package subvert
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// PointerClass describes what kind of memory a pointer points to.
+type PointerClass int
+
+const (
+	PointerClassUnknown PointerClass = iota
+	PointerClassStack
+	PointerClassHeap
+	PointerClassData
+	PointerClassBSS
+	PointerClassRodata
+	PointerClassText
+	PointerClassForeign
+)
+
+var pointerClassNames = []string{
+	PointerClassUnknown: "unknown",
+	PointerClassStack:   "stack",
+	PointerClassHeap:    "heap",
+	PointerClassData:    "data",
+	PointerClassBSS:     "bss",
+	PointerClassRodata:  "rodata",
+	PointerClassText:    "text",
+	PointerClassForeign: "foreign",
+}
+
+func (c PointerClass) String() string {
+	if c < 0 || int(c) >= len(pointerClassNames) {
+		return fmt.Sprintf("PointerClass(%d)", int(c))
+	}
+	return pointerClassNames[c]
+}
+
+// PointerInfo describes the memory that a pointer points to. Which fields are
+// filled out depends on the class.
+type PointerInfo struct {
+	Address uintptr
+	Class   PointerClass
+
+	// PointerClassStack: The ID of the goroutine whose stack this is.
+	GoroutineID uint64
+
+	// PointerClassHeap: The object containing the address, and the size class
+	// of its span (0 for large objects).
+	ObjectBase uintptr
+	ObjectSize uintptr
+	SizeClass  int
+
+	// PointerClassData, PointerClassBSS, PointerClassRodata, PointerClassText:
+	// The containing symbol, if known.
+	Symbol AddressSymbol
+
+	// PointerClassForeign: The mapping containing the address.
+	Region MemoryRegion
+
+	// Why stack and heap pointers couldn't be recognized, if they couldn't
+	// (see FeatureRuntimeLayouts). Pointers outside the executable image are
+	// then PointerClassUnknown rather than PointerClassForeign, with Region set
+	// if they're mapped.
+	RuntimeError error
+}
+
+// Classify reports what kind of memory a pointer points to: a goroutine's
+// stack, a heap object, one of the executable's sections, or some other
+// mapping (such as memory allocated by C code).
+//
+// Use this to make sure that a pointer obtained via MakeAddressable() won't
+// become invalid once the stack frame it came from is gone.
+//
+// Stack and heap classification need knowledge of the runtime's internal
+// structures. On go versions where these aren't known, only pointers into the
+// executable image are classified, and info.RuntimeError says why.
+func Classify(pointer uintptr) (info PointerInfo, err error) {
+	info.Address = pointer
+
+	goid, runtimeErr := findGoroutineStackContaining(pointer)
+	if runtimeErr == nil && goid != 0 {
+		info.Class = PointerClassStack
+		info.GoroutineID = goid
+		return
+	}
+	if runtimeErr == nil {
+		var found bool
+		if found, runtimeErr = classifyHeapPointer(pointer, &info); runtimeErr == nil && found {
+			return
+		}
+	}
+	info.RuntimeError = runtimeErr
+
+	if section, ok := getImageSectionContaining(pointer); ok {
+		info.Class = section.class
+		info.Symbol, _ = symbolize(pointer, false)
+		return
+	}
+
+	var regions []MemoryRegion
+	if regions, err = GetMemoryMap(); err != nil {
+		return
+	}
+	for _, region := range regions {
+		if region.Contains(pointer) {
+			if info.RuntimeError == nil {
+				info.Class = PointerClassForeign
+			}
+			info.Region = region
+			return
+		}
+	}
+	return
+}
+
+// Returns the goroutine ID of the stack containing address, or 0 if no
+// goroutine stack contains it.
+func findGoroutineStackContaining(address uintptr) (goid uint64, err error) {
+	offsets, err := getRuntimeFieldOffsets("g.stack.lo", "g.stack.hi", "g.atomicstatus", "g.goid")
+	if err != nil {
+		return
+	}
+	forEachG, err := getRuntimeForEachG()
+	if err != nil {
+		return
+	}
+
+	forEachG(func(g unsafe.Pointer) {
+		if goid != 0 {
+			return
+		}
+		gAddr := uintptr(g)
+		if isGStatusDead(readUint32At(gAddr + offsets[2])) {
+			return
+		}
+		if address >= readUintptrAt(gAddr+offsets[0]) && address < readUintptrAt(gAddr+offsets[1]) {
+			goid = readUint64At(gAddr + offsets[3])
+		}
+	})
+	return
+}
+
+func classifyHeapPointer(address uintptr, info *PointerInfo) (found bool, err error) {
+	offsets, err := getRuntimeFieldOffsets("mspan.startAddr", "mspan.npages", "mspan.spanclass", "mspan.elemsize")
+	if err != nil {
+		return
+	}
+	spanOfHeap, err := getRuntimeSpanOfHeap()
+	if err != nil {
+		return
+	}
+
+	span := uintptr(spanOfHeap(address))
+	if span == 0 {
+		return
+	}
+
+	initProcess()
+	start := readUintptrAt(span + offsets[0])
+	elemSize := readUintptrAt(span + offsets[3])
+	if elemSize == 0 {
+		elemSize = readUintptrAt(span+offsets[1]) * uintptr(pageSize)
+	}
+
+	info.Class = PointerClassHeap
+	info.SizeClass = int(readUint8At(span+offsets[2]) >> 1)
+	info.ObjectSize = elemSize
+	info.ObjectBase = start + (address-start)/elemSize*elemSize
+	found = true
+	return
+}
+
+var (
+	runtimeForEachG   func(func(g unsafe.Pointer))
+	runtimeSpanOfHeap func(p uintptr) unsafe.Pointer
+)
+
+func getRuntimeForEachG() (forEachG func(func(g unsafe.Pointer)), err error) {
+	if runtimeForEachG == nil {
+		var exposed interface{}
+		// forEachGRace doesn't take allglock, so the callback is free to allocate.
+		if exposed, err = ExposeFunction("runtime.forEachGRace", (func(func(unsafe.Pointer)))(nil)); err != nil {
+			return
+		}
+		runtimeForEachG = exposed.(func(func(unsafe.Pointer)))
+	}
+	return runtimeForEachG, nil
+}
+
+func getRuntimeSpanOfHeap() (spanOfHeap func(p uintptr) unsafe.Pointer, err error) {
+	if runtimeSpanOfHeap == nil {
+		var exposed interface{}
+		if exposed, err = ExposeFunction("runtime.spanOfHeap", (func(uintptr) unsafe.Pointer)(nil)); err != nil {
+			return
+		}
+		runtimeSpanOfHeap = exposed.(func(uintptr) unsafe.Pointer)
+	}
+	return runtimeSpanOfHeap, nil
+}
+
+// A section of the executable image, such as .text or .bss
+type imageSection struct {
+	name  string
+	start uintptr
+	end   uintptr
+	class PointerClass
+}
+
+var (
+	imageSections          []imageSection
+	imageSectionsLoadError error
+)
+
+// Read the executable file's sections, at the addresses they're loaded at.
+func readImageSections() (sections []imageSection, err error) {
+	exe, close, err := openExecutable()
+	if err != nil {
+		return
+	}
+	defer close()
+	if sections, err = osReadImageSections(exe); err != nil {
+		return
+	}
+	bias, err := getLoadBias()
+	if err != nil {
+		return nil, err
+	}
+	for i := range sections {
+		sections[i].start += bias
+		sections[i].end += bias
+	}
+	return
+}
+
+func getImageSectionContaining(address uintptr) (section imageSection, ok bool) {
+	if imageSections == nil && imageSectionsLoadError == nil {
+		imageSections, imageSectionsLoadError = readImageSections()
+	}
+	for _, section = range imageSections {
+		if address >= section.start && address < section.end {
+			return section, true
+		}
+	}
+	return
+}
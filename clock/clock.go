@@ -0,0 +1,274 @@
+// Package clock replaces the time package's clock with a fake one that only
+// moves when told to, making code that calls time.Now() directly testable
+// without refactoring.
+//
+// Install() patches time.Now(), time.Since(), time.Until() and time.Sleep() to
+// use the fake clock. Sleeping goroutines block until Advance() moves the clock
+// past their deadline.
+//
+// Where call redirection is supported (see subvert.FeatureCallRedirection),
+// the runtime clock that the time package uses for monotonic time and timer
+// deadlines is replaced too, and timers created through the time package
+// (time.NewTimer(), time.After(), time.AfterFunc(), time.NewTicker(),
+// time.Tick(), context deadlines and so on) follow the fake clock, firing from
+// Advance(). Elsewhere they keep using the real clock; use Clock.After() and
+// Clock.AfterFunc() instead.
+//
+// Since the patches are process-wide, only one fake clock can be installed at
+// a time, and it affects every goroutine (including the testing framework's
+// own timing).
+package clock
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kstenerud/go-subvert"
+)
+
+// A fake clock. The zero value is not usable; use Install().
+type Clock struct {
+	mutex    sync.Mutex
+	changed  *sync.Cond
+	start    time.Time
+	now      time.Time
+	timers   []*Timer
+	sequence uint64
+	patches  *subvert.PatchSet
+
+	// The runtime clock (time.runtimeNano) when the clock was installed
+	monoStart int64
+	// The fake timers standing in for time package timers
+	hooks         *runtimeTimerHooks
+	runtimeTimers map[*time.Timer]*Timer
+}
+
+// A timer on a fake clock, created by Clock.After() or Clock.AfterFunc().
+type Timer struct {
+	clock    *Clock
+	deadline time.Time
+	period   time.Duration
+	sequence uint64
+	fire     func(now time.Time)
+	// The time package timer this stands in for, if any
+	runtime *time.Timer
+	// The real timer this was handed to when the clock was uninstalled
+	real *time.Timer
+}
+
+var (
+	installedLock sync.Mutex
+	installed     *Clock
+)
+
+// Install patches the time package to use a fake clock starting at start, and
+// returns the clock. Call Uninstall() to restore the real clock.
+func Install(start time.Time) (clock *Clock, err error) {
+	installedLock.Lock()
+	defer installedLock.Unlock()
+	if installed != nil {
+		return nil, fmt.Errorf("A fake clock is already installed")
+	}
+
+	hooks := getRuntimeTimerHooks()
+	clock = &Clock{
+		start:         start,
+		now:           start,
+		runtimeTimers: make(map[*time.Timer]*Timer),
+	}
+	clock.changed = sync.NewCond(&clock.mutex)
+	clock.patches = subvert.NewPatchSet().
+		ReplaceFunction(time.Now, clock.Now).
+		ReplaceFunction(time.Since, clock.Since).
+		ReplaceFunction(time.Until, clock.Until).
+		ReplaceFunction(time.Sleep, clock.Sleep)
+	if hooks.canRedirect {
+		clock.hooks = hooks
+		clock.addRuntimeTimerHooks()
+	}
+	if err = clock.patches.Apply(); err != nil {
+		return nil, err
+	}
+	installed = clock
+	return
+}
+
+// Uninstall restores the real clock. Timers and sleeping goroutines that are
+// still waiting on the fake clock carry on waiting on the real clock, for the
+// time they had left.
+func (c *Clock) Uninstall() (err error) {
+	installedLock.Lock()
+	defer installedLock.Unlock()
+	if installed != c {
+		return fmt.Errorf("This clock is not installed")
+	}
+	if err = c.patches.Revert(); err != nil {
+		return
+	}
+	installed = nil
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	timers := c.timers
+	c.timers = nil
+	c.runtimeTimers = nil
+	for _, timer := range timers {
+		remaining := timer.deadline.Sub(c.now)
+		if timer.runtime != nil {
+			when := c.hooks.runtimeNano() + int64(remaining)
+			if when < 0 {
+				when = math.MaxInt64
+			}
+			c.hooks.resetTimer(timer.runtime, when, int64(timer.period))
+			continue
+		}
+		fire := timer.fire
+		timer.real = time.AfterFunc(remaining, func() {
+			fire(time.Now())
+		})
+	}
+	c.changed.Broadcast()
+	return
+}
+
+// Now returns the fake clock's current time.
+func (c *Clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Since returns the fake time elapsed since t.
+func (c *Clock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Until returns the fake duration until t.
+func (c *Clock) Until(t time.Time) time.Duration {
+	return t.Sub(c.Now())
+}
+
+// Sleep blocks until the fake clock has advanced by at least d.
+func (c *Clock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	<-c.After(d)
+}
+
+// After returns a channel that receives the fake time once the clock has
+// advanced by at least d.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	channel := make(chan time.Time, 1)
+	c.addTimer(d, func(now time.Time) {
+		channel <- now
+	})
+	return channel
+}
+
+// AfterFunc calls f once the clock has advanced by at least d. f is called
+// from the goroutine that calls Advance().
+func (c *Clock) AfterFunc(d time.Duration, f func()) *Timer {
+	return c.addTimer(d, func(now time.Time) {
+		f()
+	})
+}
+
+// Advance moves the clock forward by d, firing every timer whose deadline is
+// reached, in deadline order. While each timer fires, Now() returns its
+// deadline.
+func (c *Clock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	target := c.now.Add(d)
+	for len(c.timers) > 0 && !c.timers[0].deadline.After(target) {
+		timer := c.timers[0]
+		c.timers = c.timers[1:]
+		deadline := timer.deadline
+		if deadline.After(c.now) {
+			c.now = deadline
+		}
+		if timer.period > 0 {
+			timer.deadline = deadline.Add(timer.period)
+			c.insertTimerLocked(timer)
+		}
+		c.mutex.Unlock()
+		timer.fire(deadline)
+		c.mutex.Lock()
+	}
+	if target.After(c.now) {
+		c.now = target
+	}
+	c.changed.Broadcast()
+	c.mutex.Unlock()
+}
+
+// Pending returns the number of timers (including sleeping goroutines)
+// waiting on the clock.
+func (c *Clock) Pending() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil blocks until at least count timers (including sleeping
+// goroutines) are waiting on the clock. Use it to make sure a goroutine has
+// started sleeping before calling Advance().
+func (c *Clock) BlockUntil(count int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for len(c.timers) < count {
+		c.changed.Wait()
+	}
+}
+
+// Stop prevents the timer from firing. It returns false if the timer has
+// already fired or been stopped.
+func (t *Timer) Stop() bool {
+	clock := t.clock
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	if t.real != nil {
+		return t.real.Stop()
+	}
+	return clock.removeTimerLocked(t)
+}
+
+func (c *Clock) removeTimerLocked(t *Timer) bool {
+	for i, timer := range c.timers {
+		if timer == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			c.changed.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Clock) addTimer(d time.Duration, fire func(now time.Time)) *Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	timer := &Timer{
+		clock:    c,
+		deadline: c.now.Add(d),
+		fire:     fire,
+	}
+	c.insertTimerLocked(timer)
+	return timer
+}
+
+func (c *Clock) insertTimerLocked(timer *Timer) {
+	c.sequence++
+	timer.sequence = c.sequence
+	c.timers = append(c.timers, timer)
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		a, b := c.timers[i], c.timers[j]
+		if a.deadline.Equal(b.deadline) {
+			return a.sequence < b.sequence
+		}
+		return a.deadline.Before(b.deadline)
+	})
+	c.changed.Broadcast()
+}
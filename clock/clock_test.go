@@ -0,0 +1,210 @@
+package clock
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func installClock(t *testing.T) *Clock {
+	clock, err := Install(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := clock.Uninstall(); err != nil {
+			t.Error(err)
+		}
+	})
+	return clock
+}
+
+func TestNow(t *testing.T) {
+	clock := installClock(t)
+
+	if now := time.Now(); !now.Equal(start) {
+		t.Errorf("Expected %v but got %v", start, now)
+	}
+	clock.Advance(time.Hour)
+	if elapsed := time.Since(start); elapsed != time.Hour {
+		t.Errorf("Expected 1h elapsed but got %v", elapsed)
+	}
+	if remaining := time.Until(start.Add(2 * time.Hour)); remaining != time.Hour {
+		t.Errorf("Expected 1h remaining but got %v", remaining)
+	}
+}
+
+func TestSleep(t *testing.T) {
+	clock := installClock(t)
+
+	woke := make(chan time.Time)
+	go func() {
+		time.Sleep(time.Minute)
+		woke <- time.Now()
+	}()
+	clock.BlockUntil(1)
+
+	clock.Advance(59 * time.Second)
+	if clock.Pending() != 1 {
+		t.Fatalf("Sleep returned before its deadline")
+	}
+
+	clock.Advance(time.Second)
+	if now := <-woke; !now.Equal(start.Add(time.Minute)) {
+		t.Errorf("Expected to wake at %v but woke at %v", start.Add(time.Minute), now)
+	}
+}
+
+func TestTimerOrder(t *testing.T) {
+	clock := installClock(t)
+
+	var fired []time.Duration
+	record := func(d time.Duration) {
+		clock.AfterFunc(d, func() {
+			fired = append(fired, time.Since(start))
+		})
+	}
+	record(3 * time.Second)
+	record(1 * time.Second)
+	record(2 * time.Second)
+	stopped := clock.AfterFunc(time.Second, func() {
+		t.Errorf("Stopped timer fired")
+	})
+	if !stopped.Stop() {
+		t.Errorf("Expected Stop() to succeed")
+	}
+	after := clock.After(10 * time.Second)
+
+	clock.Advance(5 * time.Second)
+	expected := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	if len(fired) != len(expected) {
+		t.Fatalf("Expected %v but got %v", expected, fired)
+	}
+	for i := range expected {
+		if fired[i] != expected[i] {
+			t.Errorf("Expected %v but got %v", expected, fired)
+		}
+	}
+	if clock.Pending() != 1 {
+		t.Errorf("Expected 1 pending timer but got %v", clock.Pending())
+	}
+
+	clock.Advance(5 * time.Second)
+	if now := <-after; !now.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("Expected %v but got %v", start.Add(10*time.Second), now)
+	}
+}
+
+func TestUninstall(t *testing.T) {
+	clock, err := Install(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Install(start); err == nil {
+		t.Errorf("Expected second Install() to fail")
+	}
+	if err = clock.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < time.Hour {
+		t.Errorf("Expected real clock to be restored")
+	}
+}
+
+func expectTime(t *testing.T, channel <-chan time.Time, expected time.Time) {
+	t.Helper()
+	select {
+	case now := <-channel:
+		if !now.Equal(expected) {
+			t.Errorf("Expected %v but got %v", expected, now)
+		}
+	default:
+		t.Errorf("Expected %v but nothing was sent", expected)
+	}
+}
+
+func expectNothing(t *testing.T, channel <-chan time.Time) {
+	t.Helper()
+	select {
+	case now := <-channel:
+		t.Errorf("Expected nothing but got %v", now)
+	default:
+	}
+}
+
+func TestTimePackageTimers(t *testing.T) {
+	if !getRuntimeTimerHooks().canRedirect {
+		fmt.Printf("Skipping TestTimePackageTimers because time package timers can't be redirected on this platform.\n")
+		return
+	}
+	clock := installClock(t)
+
+	timer := time.NewTimer(time.Minute)
+	after := time.After(2 * time.Minute)
+	ticker := time.NewTicker(time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	stopped := time.AfterFunc(time.Second, func() {
+		t.Errorf("Stopped timer fired")
+	})
+	if !stopped.Stop() {
+		t.Errorf("Expected Stop() to succeed")
+	}
+
+	clock.Advance(59 * time.Second)
+	expectNothing(t, timer.C)
+	// Ticks are dropped while nobody is receiving.
+	expectTime(t, ticker.C, start.Add(time.Second))
+	ticker.Stop()
+
+	clock.Advance(time.Second)
+	expectTime(t, timer.C, start.Add(time.Minute))
+	expectNothing(t, ticker.C)
+	if timer.Reset(time.Second) {
+		t.Errorf("Expected Reset() of a fired timer to return false")
+	}
+	clock.Advance(time.Second)
+	expectTime(t, timer.C, start.Add(61*time.Second))
+
+	clock.Advance(time.Minute)
+	expectTime(t, after, start.Add(2*time.Minute))
+	if ctx.Err() != nil {
+		t.Errorf("Context expired early")
+	}
+	clock.Advance(time.Hour)
+	<-ctx.Done()
+}
+
+func TestUninstallPendingTimers(t *testing.T) {
+	clock, err := Install(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	late := clock.AfterFunc(time.Hour, func() {
+		t.Errorf("Timer fired early when the clock was uninstalled")
+	})
+	soon := clock.After(time.Millisecond)
+	var lateRuntime, soonRuntime *time.Timer
+	if getRuntimeTimerHooks().canRedirect {
+		lateRuntime = time.NewTimer(time.Hour)
+		soonRuntime = time.NewTimer(time.Millisecond)
+	}
+	if err = clock.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pending timers carry on with the real clock.
+	<-soon
+	if !late.Stop() {
+		t.Errorf("Expected the hour long timer to still be pending")
+	}
+	if lateRuntime != nil {
+		<-soonRuntime.C
+		if !lateRuntime.Stop() {
+			t.Errorf("Expected the hour long time package timer to still be pending")
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package clock
+
+import (
+	"math"
+	"reflect"
+	"time"
+	"unsafe"
+
+	"github.com/kstenerud/go-subvert"
+)
+
+// The runtime implements the time package's timers with these functions
+// (linked into the time package as time.newTimer and so on).
+type (
+	runtimeTimerFunc = func(arg interface{}, seq uintptr, delta int64)
+	newTimerFunc     = func(when, period int64, f runtimeTimerFunc, arg interface{}, c unsafe.Pointer) *time.Timer
+	stopTimerFunc    = func(t *time.Timer) bool
+	resetTimerFunc   = func(t *time.Timer, when, period int64) bool
+	runtimeNanoFunc  = func() int64
+)
+
+// The original runtime functions behind the time package's timers and clock.
+// Calls to them are redirected while a clock is installed, but these still
+// call the originals.
+type runtimeTimerHooks struct {
+	// Whether time package timers can be moved to the fake clock
+	canRedirect bool
+	newTimer    newTimerFunc
+	stopTimer   stopTimerFunc
+	resetTimer  resetTimerFunc
+	// The runtime clock that the time package reads (time.runtimeNano)
+	runtimeNano runtimeNanoFunc
+}
+
+func getRuntimeTimerHooks() (hooks *runtimeTimerHooks) {
+	hooks = &runtimeTimerHooks{}
+	// These signatures are only valid since go 1.23, which is also when
+	// time.Timer got its initTimer field.
+	if _, ok := reflect.TypeOf(time.Timer{}).FieldByName("initTimer"); !ok {
+		return
+	}
+	for _, capability := range subvert.Capabilities() {
+		if capability.Feature == subvert.FeatureCallRedirection && !capability.Works {
+			return
+		}
+	}
+
+	var newTimer, stopTimer, resetTimer, runtimeNano interface{}
+	for _, symbol := range []struct {
+		name     string
+		template interface{}
+		function *interface{}
+	}{
+		{"time.newTimer", (newTimerFunc)(nil), &newTimer},
+		{"time.stopTimer", (stopTimerFunc)(nil), &stopTimer},
+		{"time.resetTimer", (resetTimerFunc)(nil), &resetTimer},
+		{"time.runtimeNano", (runtimeNanoFunc)(nil), &runtimeNano},
+	} {
+		// The linker leaves out timer functions that nothing calls.
+		*symbol.function, _ = subvert.ExposeFunction(symbol.name, symbol.template)
+	}
+	if newTimer == nil || stopTimer == nil || runtimeNano == nil {
+		return
+	}
+	hooks.newTimer = newTimer.(newTimerFunc)
+	hooks.stopTimer = stopTimer.(stopTimerFunc)
+	if resetTimer != nil {
+		hooks.resetTimer = resetTimer.(resetTimerFunc)
+	}
+	hooks.runtimeNano = runtimeNano.(runtimeNanoFunc)
+	hooks.canRedirect = true
+	return
+}
+
+func (c *Clock) addRuntimeTimerHooks() {
+	c.monoStart = c.hooks.runtimeNano()
+	c.patches.
+		RedirectCalls(c.hooks.runtimeNano, c.runtimeNano).
+		RedirectCalls(c.hooks.newTimer, c.newRuntimeTimer).
+		RedirectCalls(c.hooks.stopTimer, c.stopRuntimeTimer)
+	if c.hooks.resetTimer != nil {
+		c.patches.RedirectCalls(c.hooks.resetTimer, c.resetRuntimeTimer)
+	}
+}
+
+// The fake clock's equivalent of the runtime clock.
+func (c *Clock) runtimeNano() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.runtimeNanoLocked()
+}
+
+func (c *Clock) runtimeNanoLocked() int64 {
+	return c.monoStart + int64(c.now.Sub(c.start))
+}
+
+// Converts a runtime clock deadline (as calculated by the time package) to a
+// fake time.
+func (c *Clock) deadlineLocked(when int64) time.Time {
+	return c.now.Add(time.Duration(when - c.runtimeNanoLocked()))
+}
+
+// Creates a runtime timer that never fires by itself, so that the time
+// package's own checks on it pass, and fires it from the fake clock instead.
+func (c *Clock) newRuntimeTimer(when, period int64, f runtimeTimerFunc, arg interface{}, channel unsafe.Pointer) *time.Timer {
+	t := c.hooks.newTimer(math.MaxInt64, 0, f, arg, channel)
+	c.mutex.Lock()
+	timer := &Timer{
+		clock:    c,
+		deadline: c.deadlineLocked(when),
+		period:   time.Duration(period),
+		fire: func(now time.Time) {
+			f(arg, 0, 0)
+		},
+		runtime: t,
+	}
+	c.runtimeTimers[t] = timer
+	c.insertTimerLocked(timer)
+	due := !timer.deadline.After(c.now)
+	c.mutex.Unlock()
+	if due {
+		c.Advance(0)
+	}
+	return t
+}
+
+func (c *Clock) stopRuntimeTimer(t *time.Timer) bool {
+	c.mutex.Lock()
+	timer, ok := c.runtimeTimers[t]
+	c.mutex.Unlock()
+	if !ok {
+		return c.hooks.stopTimer(t)
+	}
+	// Discards anything sent but not yet received, as a real stop would.
+	c.hooks.stopTimer(t)
+	return timer.Stop()
+}
+
+func (c *Clock) resetRuntimeTimer(t *time.Timer, when, period int64) bool {
+	c.mutex.Lock()
+	timer, ok := c.runtimeTimers[t]
+	if !ok {
+		// A timer created before the clock was installed stays on the real
+		// clock, but its deadline was worked out from the fake one.
+		when += c.hooks.runtimeNano() - c.runtimeNanoLocked()
+		c.mutex.Unlock()
+		return c.hooks.resetTimer(t, when, period)
+	}
+	c.mutex.Unlock()
+
+	c.hooks.resetTimer(t, math.MaxInt64, 0)
+	c.mutex.Lock()
+	wasPending := c.removeTimerLocked(timer)
+	timer.deadline = c.deadlineLocked(when)
+	timer.period = time.Duration(period)
+	c.insertTimerLocked(timer)
+	due := !timer.deadline.After(c.now)
+	c.mutex.Unlock()
+	if due {
+		c.Advance(0)
+	}
+	return wasPending
+}
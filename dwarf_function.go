@@ -0,0 +1,225 @@
+package subvert
+
+import (
+	"debug/dwarf"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+	"unsafe"
+)
+
+// Get a function type that can be used to call the named function, built from
+// its parameter list in the DWARF debug info.
+//
+// Only the layout of each parameter has to match for a call to work, so types
+// that can't be recreated through reflection are replaced by ones with the
+// same layout: pointers, maps, channels and functions become unsafe.Pointer,
+// non-empty interfaces other than error become a struct of two pointers, and
+// named structs become unnamed ones.
+func (l *dwarfLayouts) getFunctionType(name string) (typ reflect.Type, err error) {
+	dwarfLayoutsLock.Lock()
+	defer dwarfLayoutsLock.Unlock()
+
+	if cached, ok := l.functionTypes[name]; ok {
+		return cached, nil
+	}
+	entryOffset, ok := l.functions[name]
+	if !ok {
+		err = fmt.Errorf("Function %v not found in DWARF debug info", name)
+		return
+	}
+
+	reader := l.data.Reader()
+	reader.Seek(entryOffset)
+	entry, err := reader.Next()
+	if err != nil {
+		return
+	}
+
+	var in, out []reflect.Type
+	for entry.Children {
+		var child *dwarf.Entry
+		if child, err = reader.Next(); err != nil {
+			return
+		}
+		if child == nil || child.Tag == 0 {
+			break
+		}
+		if child.Children {
+			reader.SkipChildren()
+		}
+		if child.Tag != dwarf.TagFormalParameter {
+			continue
+		}
+
+		typeOffset, ok := child.Val(dwarf.AttrType).(dwarf.Offset)
+		if !ok {
+			err = fmt.Errorf("%v: parameter %v has no type", name, child.Val(dwarf.AttrName))
+			return
+		}
+		var paramType dwarf.Type
+		if paramType, err = l.data.Type(typeOffset); err != nil {
+			return
+		}
+		var rType reflect.Type
+		if rType, err = dwarfTypeToReflect(paramType); err != nil {
+			err = fmt.Errorf("%v: parameter %v: %w", name, child.Val(dwarf.AttrName), err)
+			return
+		}
+		if isResult, _ := child.Val(dwarf.AttrVarParam).(bool); isResult {
+			out = append(out, rType)
+		} else {
+			in = append(in, rType)
+		}
+	}
+
+	typ = reflect.FuncOf(in, out, false)
+	l.functionTypes[name] = typ
+	return
+}
+
+var (
+	emptyInterfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+	errorType          = reflect.TypeOf((*error)(nil)).Elem()
+	unsafePointerType  = reflect.TypeOf(unsafe.Pointer(nil))
+	ifaceType          = reflect.TypeOf(struct{ Tab, Data unsafe.Pointer }{})
+)
+
+var basicReflectTypes = map[string]reflect.Type{
+	"bool":           reflect.TypeOf(false),
+	"int":            reflect.TypeOf(int(0)),
+	"int8":           reflect.TypeOf(int8(0)),
+	"int16":          reflect.TypeOf(int16(0)),
+	"int32":          reflect.TypeOf(int32(0)),
+	"int64":          reflect.TypeOf(int64(0)),
+	"uint":           reflect.TypeOf(uint(0)),
+	"uint8":          reflect.TypeOf(uint8(0)),
+	"uint16":         reflect.TypeOf(uint16(0)),
+	"uint32":         reflect.TypeOf(uint32(0)),
+	"uint64":         reflect.TypeOf(uint64(0)),
+	"uintptr":        reflect.TypeOf(uintptr(0)),
+	"float32":        reflect.TypeOf(float32(0)),
+	"float64":        reflect.TypeOf(float64(0)),
+	"complex64":      reflect.TypeOf(complex64(0)),
+	"complex128":     reflect.TypeOf(complex128(0)),
+	"string":         reflect.TypeOf(""),
+	"unsafe.Pointer": unsafePointerType,
+}
+
+// Sized stand-ins for basic types that are only known by their DWARF encoding
+var (
+	signedReflectTypes   = map[int64]reflect.Type{1: basicReflectTypes["int8"], 2: basicReflectTypes["int16"], 4: basicReflectTypes["int32"], 8: basicReflectTypes["int64"]}
+	unsignedReflectTypes = map[int64]reflect.Type{1: basicReflectTypes["uint8"], 2: basicReflectTypes["uint16"], 4: basicReflectTypes["uint32"], 8: basicReflectTypes["uint64"]}
+	floatReflectTypes    = map[int64]reflect.Type{4: basicReflectTypes["float32"], 8: basicReflectTypes["float64"]}
+	complexReflectTypes  = map[int64]reflect.Type{8: basicReflectTypes["complex64"], 16: basicReflectTypes["complex128"]}
+)
+
+func dwarfTypeToReflect(typ dwarf.Type) (rType reflect.Type, err error) {
+	if basic, ok := basicReflectTypes[typ.Common().Name]; ok {
+		return basic, nil
+	}
+
+	var sizedTypes map[int64]reflect.Type
+	switch t := typ.(type) {
+	case *dwarf.TypedefType:
+		switch t.Name {
+		case "interface {}", "any":
+			return emptyInterfaceType, nil
+		case "error":
+			return errorType, nil
+		}
+		return dwarfTypeToReflect(t.Type)
+	case *dwarf.PtrType, *dwarf.FuncType:
+		return unsafePointerType, nil
+	case *dwarf.BoolType:
+		return basicReflectTypes["bool"], nil
+	case *dwarf.IntType, *dwarf.CharType:
+		sizedTypes = signedReflectTypes
+	case *dwarf.UintType, *dwarf.UcharType:
+		sizedTypes = unsignedReflectTypes
+	case *dwarf.FloatType:
+		sizedTypes = floatReflectTypes
+	case *dwarf.ComplexType:
+		sizedTypes = complexReflectTypes
+	case *dwarf.ArrayType:
+		if t.Count < 0 {
+			return nil, fmt.Errorf("Array %v has unknown length", typ)
+		}
+		var elem reflect.Type
+		if elem, err = dwarfTypeToReflect(t.Type); err != nil {
+			return
+		}
+		rType = reflect.ArrayOf(int(t.Count), elem)
+	case *dwarf.StructType:
+		rType, err = dwarfStructToReflect(t)
+	default:
+		err = fmt.Errorf("Unsupported DWARF type %v (%T)", typ, typ)
+	}
+	if sizedTypes != nil {
+		if rType = sizedTypes[typ.Size()]; rType == nil {
+			err = fmt.Errorf("Unsupported size %v of DWARF type %v", typ.Size(), typ)
+		}
+	}
+	if err == nil && rType != nil && int64(rType.Size()) != typ.Size() {
+		err = fmt.Errorf("%v is %v bytes but %v is %v", typ, typ.Size(), rType, rType.Size())
+	}
+	return
+}
+
+func dwarfStructToReflect(typ *dwarf.StructType) (rType reflect.Type, err error) {
+	switch {
+	case typ.StructName == "string":
+		return basicReflectTypes["string"], nil
+	case typ.StructName == "runtime.eface":
+		return emptyInterfaceType, nil
+	case typ.StructName == "runtime.iface":
+		return ifaceType, nil
+	case strings.HasPrefix(typ.StructName, "[]") && len(typ.Field) > 0:
+		elemPtr, ok := typ.Field[0].Type.(*dwarf.PtrType)
+		if !ok {
+			return nil, fmt.Errorf("Slice %v has no array pointer", typ)
+		}
+		var elem reflect.Type
+		if elem, err = dwarfTypeToReflect(elemPtr.Type); err != nil {
+			return
+		}
+		return reflect.SliceOf(elem), nil
+	}
+
+	// reflect.StructOf() only accepts exported field names.
+	fields := make([]reflect.StructField, len(typ.Field))
+	used := make(map[string]bool)
+	for i, member := range typ.Field {
+		if fields[i].Type, err = dwarfTypeToReflect(member.Type); err != nil {
+			return
+		}
+		fields[i].Name = exportedFieldName(member.Name, i, used)
+	}
+	rType = reflect.StructOf(fields)
+	for i, member := range typ.Field {
+		if int64(rType.Field(i).Offset) != member.ByteOffset {
+			return nil, fmt.Errorf("Could not reproduce the layout of %v", typ)
+		}
+	}
+	return
+}
+
+func exportedFieldName(name string, index int, used map[string]bool) string {
+	runes := []rune(name)
+	if len(runes) == 0 || !unicode.IsLetter(runes[0]) {
+		runes = []rune(fmt.Sprintf("F%v", index))
+	}
+	runes[0] = unicode.ToUpper(runes[0])
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			runes[i] = '_'
+		}
+	}
+	exported := string(runes)
+	if used[exported] {
+		exported = fmt.Sprintf("%v_%v", exported, index)
+	}
+	used[exported] = true
+	return exported
+}
@@ -0,0 +1,170 @@
+package subvert
+
+import (
+	"debug/dwarf"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Struct layouts and function signatures read from the executable's DWARF
+// debug info.
+type dwarfLayouts struct {
+	data *dwarf.Data
+	// Offset of each named struct's type entry
+	structs map[string]dwarf.Offset
+	fields  map[string]StructField
+	// Offset of each named function's subprogram entry
+	functions     map[string]dwarf.Offset
+	functionTypes map[string]reflect.Type
+}
+
+var (
+	dwarfLayoutsLock   sync.Mutex
+	dwarfLayoutsCache  *dwarfLayouts
+	dwarfLayoutsError  error
+	dwarfLayoutsLoaded bool
+)
+
+func getDWARFLayouts() (layouts *dwarfLayouts, err error) {
+	dwarfLayoutsLock.Lock()
+	defer dwarfLayoutsLock.Unlock()
+	if !dwarfLayoutsLoaded {
+		dwarfLayoutsCache, dwarfLayoutsError = loadDWARFLayouts()
+		dwarfLayoutsLoaded = true
+	}
+	return dwarfLayoutsCache, dwarfLayoutsError
+}
+
+func resetDWARFLayouts() {
+	dwarfLayoutsLock.Lock()
+	defer dwarfLayoutsLock.Unlock()
+	dwarfLayoutsCache = nil
+	dwarfLayoutsError = nil
+	dwarfLayoutsLoaded = false
+}
+
+func loadDWARFLayouts() (layouts *dwarfLayouts, err error) {
+	exe, close, err := openExecutable()
+	if err != nil {
+		return
+	}
+	defer close()
+	data, err := osReadDWARF(exe)
+	if err != nil {
+		return
+	}
+	return newDWARFLayouts(data)
+}
+
+func newDWARFLayouts(data *dwarf.Data) (layouts *dwarfLayouts, err error) {
+	layouts = &dwarfLayouts{
+		data:          data,
+		structs:       make(map[string]dwarf.Offset),
+		fields:        make(map[string]StructField),
+		functions:     make(map[string]dwarf.Offset),
+		functionTypes: make(map[string]reflect.Type),
+	}
+
+	// Index the struct types and functions only. Their members and parameters
+	// are decoded on demand.
+	reader := data.Reader()
+	for {
+		var entry *dwarf.Entry
+		if entry, err = reader.Next(); err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		if name, ok := entry.Val(dwarf.AttrName).(string); ok {
+			switch entry.Tag {
+			case dwarf.TagStructType:
+				layouts.structs[name] = entry.Offset
+			case dwarf.TagSubprogram:
+				layouts.functions[name] = entry.Offset
+			}
+		}
+		if entry.Children && entry.Tag != dwarf.TagCompileUnit {
+			reader.SkipChildren()
+		}
+	}
+	if len(layouts.structs) == 0 {
+		return nil, fmt.Errorf("DWARF debug info contains no struct types")
+	}
+	return
+}
+
+func (l *dwarfLayouts) getField(structName, fieldPath string) (field StructField, err error) {
+	dwarfLayoutsLock.Lock()
+	defer dwarfLayoutsLock.Unlock()
+
+	key := structName + "." + fieldPath
+	if cached, ok := l.fields[key]; ok {
+		return cached, nil
+	}
+
+	entryOffset, ok := l.structs[structName]
+	if !ok {
+		err = fmt.Errorf("Struct %v not found in DWARF debug info", structName)
+		return
+	}
+	typ, err := l.data.Type(entryOffset)
+	if err != nil {
+		return
+	}
+
+	var offset int64
+	for _, name := range strings.Split(fieldPath, ".") {
+		structType, ok := stripTypedefs(typ).(*dwarf.StructType)
+		if !ok {
+			err = fmt.Errorf("%v.%v: %v is not a struct", structName, fieldPath, typ)
+			return
+		}
+		var member *dwarf.StructField
+		for _, candidate := range structType.Field {
+			if candidate.Name == name {
+				member = candidate
+				break
+			}
+		}
+		if member == nil {
+			err = fmt.Errorf("%v has no field %v", structType.StructName, name)
+			return
+		}
+		offset += member.ByteOffset
+		typ = member.Type
+	}
+
+	field = StructField{
+		Name:   fieldPath,
+		Offset: uintptr(offset),
+		Size:   uintptr(typ.Size()),
+		Type:   typ.String(),
+	}
+	l.fields[key] = field
+	return
+}
+
+func (l *dwarfLayouts) getStructType(structName string) (typ dwarf.Type, err error) {
+	dwarfLayoutsLock.Lock()
+	defer dwarfLayoutsLock.Unlock()
+
+	entryOffset, ok := l.structs[structName]
+	if !ok {
+		err = fmt.Errorf("Struct %v not found in DWARF debug info", structName)
+		return
+	}
+	return l.data.Type(entryOffset)
+}
+
+func stripTypedefs(typ dwarf.Type) dwarf.Type {
+	for {
+		typedef, ok := typ.(*dwarf.TypedefType)
+		if !ok {
+			return typ
+		}
+		typ = typedef.Type
+	}
+}
@@ -0,0 +1,85 @@
+package subvert
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// CatchExit runs fn, catching any call it makes to os.Exit() (including via
+// log.Fatal() and friends). If fn calls os.Exit(), fn is unwound with a panic,
+// and CatchExit returns the exit code with exited = true.
+//
+// Only calls from the goroutine running CatchExit are caught. If another
+// goroutine calls os.Exit() in the meantime, the process exits as usual
+// (without running os.Exit()'s exit hooks).
+//
+// CatchExit panics if os.Exit() can't be patched on this platform.
+func CatchExit(fn func()) (code int, exited bool) {
+	goroutine := GoID()
+	if err := beginCatchExit(goroutine); err != nil {
+		panic(fmt.Errorf("CatchExit: Could not patch os.Exit: %w", err))
+	}
+	defer endCatchExit(goroutine)
+
+	defer func() {
+		if e := recover(); e != nil {
+			if exit, ok := e.(exitPanic); ok {
+				code = int(exit)
+				exited = true
+				return
+			}
+			panic(e)
+		}
+	}()
+
+	fn()
+	return
+}
+
+// Panic value used to unwind from a caught os.Exit().
+type exitPanic int
+
+var (
+	exitCatchLock sync.Mutex
+	exitPatch     *Patch
+	// Number of active CatchExit() calls per goroutine ID
+	exitCatchers = make(map[uint64]int)
+)
+
+func beginCatchExit(goroutine uint64) (err error) {
+	exitCatchLock.Lock()
+	defer exitCatchLock.Unlock()
+	if exitPatch == nil {
+		if exitPatch, err = ReplaceFunction(os.Exit, caughtExit); err != nil {
+			return
+		}
+	}
+	exitCatchers[goroutine]++
+	return
+}
+
+func endCatchExit(goroutine uint64) {
+	exitCatchLock.Lock()
+	defer exitCatchLock.Unlock()
+	if exitCatchers[goroutine]--; exitCatchers[goroutine] == 0 {
+		delete(exitCatchers, goroutine)
+	}
+	if len(exitCatchers) == 0 {
+		if err := exitPatch.Revert(); err != nil {
+			panic(fmt.Errorf("CatchExit: Could not restore os.Exit: %w", err))
+		}
+		exitPatch = nil
+	}
+}
+
+func caughtExit(code int) {
+	exitCatchLock.Lock()
+	catching := exitCatchers[GoID()] > 0
+	exitCatchLock.Unlock()
+	if catching {
+		panic(exitPanic(code))
+	}
+	syscall.Exit(code)
+}
@@ -0,0 +1,301 @@
+// Package faults injects failures into functions that code under test calls
+// directly, such as os.(*File).Write or net.Dial, without refactoring that
+// code.
+//
+// Tests declare rules saying which function should fail, when, and how:
+//
+//   injector := faults.New(1)
+//   injector.Add(faults.Rule{
+//       Name:     "disk full",
+//       Function: (*os.File).Write,
+//       When:     faults.OnCall(3),
+//       Return:   []interface{}{0, syscall.ENOSPC},
+//   })
+//   injector.Add(faults.Rule{
+//       Function: net.Dial,
+//       When:     faults.WithProbability(0.1),
+//       Return:   []interface{}{nil, syscall.ECONNRESET},
+//   })
+//   if err := injector.Install(); err != nil { ... }
+//   defer injector.Uninstall()
+//
+// Rules are applied by redirecting calls to each function (see
+// subvert.RedirectCalls()), so the original function remains callable via
+// Original(). Only direct calls are intercepted. Calls through an interface
+// (for example via io.Writer) or a function value, and calls that the compiler
+// inlined, reach the original function.
+package faults
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+
+	"github.com/kstenerud/go-subvert"
+)
+
+// A Condition decides whether a rule fires on a call. call is the 1-based
+// count of calls made to the function since Install(), and random is the
+// injector's seeded random source.
+type Condition func(call int, random *rand.Rand) bool
+
+// A Rule describes a fault to inject into a function.
+type Rule struct {
+	// Name identifies the rule in Fired(). Defaults to the function's name.
+	Name string
+
+	// The function to inject into. Use a method expression for methods,
+	// for example (*os.File).Write.
+	Function interface{}
+
+	// When the rule fires. Defaults to Always().
+	When Condition
+
+	// The values to return when the rule fires, in order. nil entries
+	// return the zero value.
+	Return []interface{}
+
+	// Instead of Return, a function of the same type as Function to call
+	// when the rule fires. It may call Original() to simulate partial
+	// failures, such as short writes.
+	Do interface{}
+}
+
+// A Firing records a rule that fired.
+type Firing struct {
+	Rule     string
+	Function string
+	Call     int
+}
+
+// An Injector applies a set of rules. Rules are checked in the order they
+// were added, and the first one that fires wins.
+type Injector struct {
+	mutex     sync.Mutex
+	random    *rand.Rand
+	functions []*hookedFunction
+	fired     []Firing
+	patches   *subvert.PatchSet
+}
+
+type hookedFunction struct {
+	name     string
+	function interface{}
+	original reflect.Value
+	rules    []*compiledRule
+	calls    int
+}
+
+type compiledRule struct {
+	name  string
+	when  Condition
+	fault func(args []reflect.Value) []reflect.Value
+}
+
+// Always fires on every call.
+func Always() Condition {
+	return func(call int, random *rand.Rand) bool {
+		return true
+	}
+}
+
+// OnCall fires on the listed calls (1-based).
+func OnCall(calls ...int) Condition {
+	return func(call int, random *rand.Rand) bool {
+		for _, c := range calls {
+			if c == call {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// AfterCall fires on every call after the first n.
+func AfterCall(n int) Condition {
+	return func(call int, random *rand.Rand) bool {
+		return call > n
+	}
+}
+
+// WithProbability fires with probability p, using the injector's seeded
+// random source.
+func WithProbability(p float64) Condition {
+	return func(call int, random *rand.Rand) bool {
+		return random.Float64() < p
+	}
+}
+
+// New creates an injector whose random conditions are seeded with seed.
+func New(seed int64) *Injector {
+	return &Injector{
+		random: rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Add adds a rule. Rules must be added before Install().
+func (i *Injector) Add(rule Rule) (err error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.patches != nil {
+		return fmt.Errorf("Rules must be added before Install()")
+	}
+
+	rFunction := reflect.ValueOf(rule.Function)
+	if rFunction.Kind() != reflect.Func || rFunction.IsNil() {
+		return fmt.Errorf("Rule function must be a non-nil function, not %v", rFunction.Kind())
+	}
+	compiled := &compiledRule{
+		name: rule.Name,
+		when: rule.When,
+	}
+	if compiled.name == "" {
+		compiled.name = subvert.FunctionName(rule.Function)
+	}
+	if compiled.when == nil {
+		compiled.when = Always()
+	}
+	if compiled.fault, err = makeFault(rFunction.Type(), rule); err != nil {
+		return fmt.Errorf("Rule %v: %w", compiled.name, err)
+	}
+
+	hooked, err := i.getHookedFunction(rule.Function)
+	if err != nil {
+		return
+	}
+	hooked.rules = append(hooked.rules, compiled)
+	return
+}
+
+// Install hooks every function that has rules. Either all hooks are
+// installed, or none are.
+func (i *Injector) Install() (err error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.patches != nil {
+		return fmt.Errorf("Injector is already installed")
+	}
+
+	patches := subvert.NewPatchSet()
+	for _, hooked := range i.functions {
+		patches.RedirectCalls(hooked.function, i.makeHook(hooked).Interface())
+	}
+	if err = patches.Apply(); err != nil {
+		return
+	}
+	i.patches = patches
+	return
+}
+
+// Uninstall removes all hooks.
+func (i *Injector) Uninstall() (err error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.patches == nil {
+		return fmt.Errorf("Injector is not installed")
+	}
+	if err = i.patches.Revert(); err != nil {
+		return
+	}
+	i.patches = nil
+	return
+}
+
+// Fired returns every rule firing so far, in order.
+func (i *Injector) Fired() []Firing {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return append([]Firing{}, i.fired...)
+}
+
+// Original returns a function that calls the original implementation of
+// function, bypassing any hooks. Use it from Rule.Do.
+func Original(function interface{}) (original interface{}, err error) {
+	return subvert.AliasFunction(function)
+}
+
+func (i *Injector) getHookedFunction(function interface{}) (hooked *hookedFunction, err error) {
+	pointer := reflect.ValueOf(function).Pointer()
+	for _, hooked = range i.functions {
+		if reflect.ValueOf(hooked.function).Pointer() == pointer {
+			return
+		}
+	}
+
+	original, err := subvert.AliasFunction(function)
+	if err != nil {
+		return
+	}
+	hooked = &hookedFunction{
+		name:     subvert.FunctionName(function),
+		function: function,
+		original: reflect.ValueOf(original),
+	}
+	i.functions = append(i.functions, hooked)
+	return
+}
+
+func (i *Injector) makeHook(hooked *hookedFunction) reflect.Value {
+	return reflect.MakeFunc(hooked.original.Type(), func(args []reflect.Value) []reflect.Value {
+		if rule := i.findFiringRule(hooked); rule != nil {
+			return rule.fault(args)
+		}
+		return subvert.CallOriginal(hooked.original, args)
+	})
+}
+
+// Counts the call, and returns the first rule that fires (recording it), if
+// any.
+func (i *Injector) findFiringRule(hooked *hookedFunction) *compiledRule {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	hooked.calls++
+	for _, rule := range hooked.rules {
+		if rule.when(hooked.calls, i.random) {
+			i.fired = append(i.fired, Firing{Rule: rule.name, Function: hooked.name, Call: hooked.calls})
+			return rule
+		}
+	}
+	return nil
+}
+
+func makeFault(functionType reflect.Type, rule Rule) (fault func(args []reflect.Value) []reflect.Value, err error) {
+	if rule.Do != nil {
+		if rule.Return != nil {
+			return nil, fmt.Errorf("Only one of Return and Do may be set")
+		}
+		rDo := reflect.ValueOf(rule.Do)
+		if rDo.Type() != functionType {
+			return nil, fmt.Errorf("Do has type %v, but should be %v", rDo.Type(), functionType)
+		}
+		return func(args []reflect.Value) []reflect.Value {
+			return subvert.CallOriginal(rDo, args)
+		}, nil
+	}
+
+	if len(rule.Return) != functionType.NumOut() {
+		return nil, fmt.Errorf("Return has %v values, but the function returns %v", len(rule.Return), functionType.NumOut())
+	}
+	results := make([]reflect.Value, len(rule.Return))
+	for index, value := range rule.Return {
+		outType := functionType.Out(index)
+		if value == nil {
+			results[index] = reflect.Zero(outType)
+			continue
+		}
+		rValue := reflect.ValueOf(value)
+		if rValue.Type().AssignableTo(outType) {
+			result := reflect.New(outType).Elem()
+			result.Set(rValue)
+			results[index] = result
+		} else if rValue.Type().ConvertibleTo(outType) && rValue.Kind() != reflect.String {
+			results[index] = rValue.Convert(outType)
+		} else {
+			return nil, fmt.Errorf("Return value %v has type %v, which can't be used as %v", index, rValue.Type(), outType)
+		}
+	}
+	return func(args []reflect.Value) []reflect.Value {
+		return results
+	}, nil
+}
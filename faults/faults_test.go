@@ -0,0 +1,167 @@
+package faults
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+//go:noinline
+func writeAll(file *os.File, chunks ...string) (errors []error) {
+	for _, chunk := range chunks {
+		_, err := file.Write([]byte(chunk))
+		errors = append(errors, err)
+	}
+	return
+}
+
+//go:noinline
+func divide(a, b int) (int, error) {
+	if b == 0 {
+		return 0, fmt.Errorf("Division by zero")
+	}
+	return a / b, nil
+}
+
+func install(t *testing.T, injector *Injector) {
+	if err := injector.Install(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := injector.Uninstall(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestNthCall(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestNthCall because it doesn't work in test binaries on this platform.\n")
+		return
+	}
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	injector := New(1)
+	err = injector.Add(Rule{
+		Name:     "disk full",
+		Function: (*os.File).Write,
+		When:     OnCall(3),
+		Return:   []interface{}{0, syscall.ENOSPC},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	install(t, injector)
+
+	errors := writeAll(file, "a", "b", "c", "d")
+	for i, err := range errors {
+		if i == 2 {
+			if err != syscall.ENOSPC {
+				t.Errorf("Expected ENOSPC on write 3 but got %v", err)
+			}
+		} else if err != nil {
+			t.Errorf("Expected write %v to succeed but got %v", i+1, err)
+		}
+	}
+
+	fired := injector.Fired()
+	if len(fired) != 1 || fired[0].Rule != "disk full" || fired[0].Call != 3 || fired[0].Function != "os.(*File).Write" {
+		t.Errorf("Unexpected firings: %v", fired)
+	}
+}
+
+func TestPartialFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestPartialFailure because it doesn't work in test binaries on this platform.\n")
+		return
+	}
+
+	originalIntf, err := Original(divide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := originalIntf.(func(int, int) (int, error))
+
+	injector := New(1)
+	err = injector.Add(Rule{
+		Function: divide,
+		Do: func(a, b int) (int, error) {
+			result, _ := original(a, b)
+			return result, io.ErrShortWrite
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	install(t, injector)
+
+	if result, err := divide(10, 2); result != 5 || err != io.ErrShortWrite {
+		t.Errorf("Expected 5, ErrShortWrite but got %v, %v", result, err)
+	}
+}
+
+func countFirings(seed int64) (count int, err error) {
+	injector := New(seed)
+	if err = injector.Add(Rule{Function: divide, When: WithProbability(0.5), Return: []interface{}{-1, nil}}); err != nil {
+		return
+	}
+	if err = injector.Install(); err != nil {
+		return
+	}
+	for i := 0; i < 100; i++ {
+		if result, _ := divide(4, 2); result == -1 {
+			count++
+		}
+	}
+	if err = injector.Uninstall(); err != nil {
+		return
+	}
+	if count != len(injector.Fired()) {
+		err = fmt.Errorf("Counted %v firings, but %v were recorded", count, len(injector.Fired()))
+	}
+	return
+}
+
+func TestProbability(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestProbability because it doesn't work in test binaries on this platform.\n")
+		return
+	}
+
+	first, err := countFirings(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := countFirings(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Errorf("Expected the same seed to fire the same number of times, but got %v and %v", first, second)
+	}
+	if first == 0 || first == 100 {
+		t.Errorf("Expected some but not all calls to fail, but %v did", first)
+	}
+}
+
+func TestInvalidRule(t *testing.T) {
+	injector := New(1)
+	if err := injector.Add(Rule{Function: divide, Return: []interface{}{0}}); err == nil {
+		t.Errorf("Expected error for wrong number of return values")
+	}
+	if err := injector.Add(Rule{Function: divide, Return: []interface{}{"x", nil}}); err == nil {
+		t.Errorf("Expected error for wrong return type")
+	}
+	if err := injector.Add(Rule{Function: divide, Do: func() {}}); err == nil {
+		t.Errorf("Expected error for wrong Do type")
+	}
+}
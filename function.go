@@ -25,3 +25,9 @@ func newFunctionWithImplementation(template interface{}, implementationPtr uintp
 	function = rFunc.Interface()
 	return
 }
+
+// Get the address of the function value (funcval) held in an interface. Unlike
+// the code address, this includes the closure context.
+func getFuncvalAddress(function interface{}) uintptr {
+	return (*[2]uintptr)(unsafe.Pointer(&function))[1]
+}
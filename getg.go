@@ -0,0 +1,6 @@
+// +build 386 amd64 arm64
+
+package subvert
+
+// Implemented in assembly
+func getg() uintptr
@@ -0,0 +1,7 @@
+// +build !386,!amd64,!arm64
+
+package subvert
+
+func getg() uintptr {
+	return 0
+}
@@ -1,5 +1,5 @@
 module github.com/kstenerud/go-subvert
 
-go 1.7
+go 1.18
 
 require golang.org/x/arch v0.0.0-20200312215426-ff8b605520f4
@@ -0,0 +1,84 @@
+package subvert
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Offsets into runtime.g, or 0 if not known for this go version.
+var (
+	gGoidOffset   uintptr
+	gStatusOffset uintptr
+)
+
+const (
+	goroutineIDsUninitialized = iota
+	goroutineIDsInitializing
+	goroutineIDsInitialized
+)
+
+var goroutineIDsState int32
+
+// GoID() is called from lock hooks (see package lockcheck), and looking up the
+// offsets takes locks, so this can't use sync.Once. It returns false while
+// another call is still initializing.
+func initGoroutineIDs() bool {
+	if atomic.LoadInt32(&goroutineIDsState) == goroutineIDsInitialized {
+		return true
+	}
+	if !atomic.CompareAndSwapInt32(&goroutineIDsState, goroutineIDsUninitialized, goroutineIDsInitializing) {
+		return false
+	}
+	if offsets, err := getRuntimeFieldOffsets("g.goid", "g.atomicstatus"); err == nil {
+		gGoidOffset = offsets[0]
+		gStatusOffset = offsets[1]
+	}
+	atomic.StoreInt32(&goroutineIDsState, goroutineIDsInitialized)
+	return true
+}
+
+// Like initGoroutineIDs(), but waits for another call that's still
+// initializing instead of returning. Don't call this from lock hooks.
+func waitForGoroutineIDs() {
+	for !initGoroutineIDs() {
+		runtime.Gosched()
+	}
+}
+
+// CurrentG returns a pointer to the current goroutine's runtime.g structure,
+// or nil if this isn't supported on this architecture.
+//
+// The pointer is only meaningful while the goroutine is alive. When a
+// goroutine exits, its g structure is reused for new goroutines.
+func CurrentG() unsafe.Pointer {
+	return unsafe.Pointer(getg())
+}
+
+// GoID returns the current goroutine's ID.
+//
+// This reads the ID from the runtime's g structure if its layout is known for
+// this go version, and otherwise falls back to the much slower method of
+// parsing it from runtime.Stack().
+func GoID() uint64 {
+	if g := getg(); g != 0 && initGoroutineIDs() && gGoidOffset != 0 {
+		return readUint64At(g + gGoidOffset)
+	}
+	return stackGoroutineID()
+}
+
+var goroutinePrefix = []byte("goroutine ")
+
+// Parses the current goroutine's ID from its stack trace header.
+func stackGoroutineID() uint64 {
+	buffer := make([]byte, 64)
+	buffer = buffer[:runtime.Stack(buffer, false)]
+	buffer = bytes.TrimPrefix(buffer, goroutinePrefix)
+	if end := bytes.IndexByte(buffer, ' '); end >= 0 {
+		buffer = buffer[:end]
+	}
+	id, _ := strconv.ParseUint(string(buffer), 10, 64)
+	return id
+}
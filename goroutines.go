@@ -0,0 +1,209 @@
+package subvert
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+	"unsafe"
+)
+
+// GoroutineStatus is the scheduling state of a goroutine.
+type GoroutineStatus uint32
+
+// These match the runtime's own values.
+const (
+	GoroutineIdle      GoroutineStatus = 0
+	GoroutineRunnable  GoroutineStatus = 1
+	GoroutineRunning   GoroutineStatus = 2
+	GoroutineSyscall   GoroutineStatus = 3
+	GoroutineWaiting   GoroutineStatus = 4
+	GoroutineCopyStack GoroutineStatus = 8
+	GoroutinePreempted GoroutineStatus = 9
+	GoroutineLeaked    GoroutineStatus = 10 // Since go 1.26
+)
+
+var goroutineStatusNames = map[GoroutineStatus]string{
+	GoroutineIdle:      "idle",
+	GoroutineRunnable:  "runnable",
+	GoroutineRunning:   "running",
+	GoroutineSyscall:   "syscall",
+	GoroutineWaiting:   "waiting",
+	GoroutineCopyStack: "copystack",
+	GoroutinePreempted: "preempted",
+	GoroutineLeaked:    "leaked",
+}
+
+func (s GoroutineStatus) String() string {
+	if name, ok := goroutineStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("status %d", uint32(s))
+}
+
+// GoroutineInfo describes a live goroutine.
+type GoroutineInfo struct {
+	ID       uint64
+	ParentID uint64
+	Status   GoroutineStatus
+	// Why the goroutine is waiting, if Status is GoroutineWaiting.
+	WaitReason string
+	// How long the goroutine has been blocked. The runtime only records this
+	// occasionally (during garbage collection), so it's 0 if unknown.
+	WaitDuration time.Duration
+	// The goroutine's start function.
+	StartPC uintptr
+	Start   AddressSymbol
+	// The go statement that created the goroutine.
+	CreatorPC uintptr
+	Creator   AddressSymbol
+	// pprof labels (see runtime/pprof.Do()). nil if the runtime stores them in
+	// a form that isn't known.
+	Labels map[string]string
+	// Whether this goroutine belongs to the runtime rather than the program.
+	System bool
+}
+
+// Goroutines returns information about every live goroutine, sorted by ID.
+//
+// The information is read directly from the runtime's goroutine structures
+// without stopping the world, so a goroutine that changes state during the
+// call may be reported in either state.
+func Goroutines() (goroutines []GoroutineInfo, err error) {
+	offsets, err := getRuntimeFieldOffsets("g.atomicstatus", "g.goid", "g.waitsince",
+		"g.waitreason", "g.parentGoid", "g.gopc", "g.startpc", "g.labels")
+	if err != nil {
+		return
+	}
+	forEachG, err := getRuntimeForEachG()
+	if err != nil {
+		return
+	}
+	helpers, err := getRuntimeGoroutineHelpers()
+	if err != nil {
+		return
+	}
+
+	labelsAreSlice := runtimeLabelsAreSlice()
+
+	var gs []uintptr
+	forEachG(func(g unsafe.Pointer) {
+		gs = append(gs, uintptr(g))
+	})
+
+	now := helpers.nanotime()
+	for _, g := range gs {
+		status := readUint32At(g+offsets[0]) &^ gStatusScan
+		if isGStatusDead(status) {
+			continue
+		}
+		info := GoroutineInfo{
+			ID:        readUint64At(g + offsets[1]),
+			ParentID:  readUint64At(g + offsets[4]),
+			Status:    GoroutineStatus(status),
+			CreatorPC: readUintptrAt(g + offsets[5]),
+			StartPC:   readUintptrAt(g + offsets[6]),
+			System:    helpers.isSystemGoroutine(unsafe.Pointer(g), false),
+		}
+		if labelsAreSlice {
+			info.Labels = readRuntimeLabels(readUintptrAt(g + offsets[7]))
+		}
+		if info.Status == GoroutineWaiting {
+			info.WaitReason = helpers.waitReasonString(readUint8At(g + offsets[3]))
+			if since := int64(readUint64At(g + offsets[2])); since > 0 && since < now {
+				info.WaitDuration = time.Duration(now - since)
+			}
+		}
+		info.Start, _ = Symbolize(info.StartPC)
+		if info.CreatorPC != 0 {
+			// The creator PC is the return address of the call to newproc.
+			info.Creator, _ = Symbolize(info.CreatorPC - 1)
+		}
+		goroutines = append(goroutines, info)
+	}
+
+	sort.Slice(goroutines, func(i, j int) bool {
+		return goroutines[i].ID < goroutines[j].ID
+	})
+	return
+}
+
+// Check that runtime/pprof's labelMap wraps a slice of key/value pairs, which
+// is all readRuntimeLabels() can read (it used to be a map). It's checked in
+// the DWARF debug info if there is any. Otherwise the go version must be one
+// with a known runtime layout, all of which use the slice.
+func runtimeLabelsAreSlice() bool {
+	layouts, err := getDWARFLayouts()
+	if err != nil {
+		_, err = getRuntimeLayout()
+		return err == nil
+	}
+	typ, err := layouts.getStructType("runtime/pprof.labelMap")
+	if err != nil {
+		return false
+	}
+	rType, err := dwarfTypeToReflect(typ)
+	if err != nil {
+		return false
+	}
+	// Unwrap labelMap{label.Set{list}}
+	for rType.Kind() == reflect.Struct && rType.NumField() == 1 {
+		rType = rType.Field(0).Type
+	}
+	if rType.Kind() != reflect.Slice {
+		return false
+	}
+	pair := rType.Elem()
+	return pair.Kind() == reflect.Struct && pair.NumField() == 2 &&
+		pair.Field(0).Type.Kind() == reflect.String && pair.Field(1).Type.Kind() == reflect.String
+}
+
+// The labels pointer points to a runtime/pprof labelMap, which wraps a sorted
+// slice of key/value pairs.
+func readRuntimeLabels(labels uintptr) map[string]string {
+	if labels == 0 {
+		return nil
+	}
+	type label struct {
+		key   string
+		value string
+	}
+	list := *(*[]label)(unsafe.Pointer(labels))
+	result := make(map[string]string, len(list))
+	for _, l := range list {
+		result[l.key] = l.value
+	}
+	return result
+}
+
+type runtimeGoroutineHelpers struct {
+	nanotime          func() int64
+	waitReasonString  func(uint8) string
+	isSystemGoroutine func(g unsafe.Pointer, fixed bool) bool
+}
+
+var runtimeGoroutineHelpersCache *runtimeGoroutineHelpers
+
+func getRuntimeGoroutineHelpers() (helpers *runtimeGoroutineHelpers, err error) {
+	if runtimeGoroutineHelpersCache != nil {
+		return runtimeGoroutineHelpersCache, nil
+	}
+
+	var nanotime, waitReasonString, isSystemGoroutine interface{}
+	// runtime.nanotime is usually inlined, but the time package links to it.
+	if nanotime, err = ExposeFunction("time.runtimeNano", (func() int64)(nil)); err != nil {
+		return
+	}
+	if waitReasonString, err = ExposeFunction("runtime.waitReason.String", (func(uint8) string)(nil)); err != nil {
+		return
+	}
+	if isSystemGoroutine, err = ExposeFunction("runtime.isSystemGoroutine", (func(unsafe.Pointer, bool) bool)(nil)); err != nil {
+		return
+	}
+	runtimeGoroutineHelpersCache = &runtimeGoroutineHelpers{
+		nanotime:          nanotime.(func() int64),
+		waitReasonString:  waitReasonString.(func(uint8) string),
+		isSystemGoroutine: isSystemGoroutine.(func(unsafe.Pointer, bool) bool),
+	}
+	return runtimeGoroutineHelpersCache, nil
+}
@@ -0,0 +1,376 @@
+package subvert
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/gosym"
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+)
+
+// A piece of the executable file that's mapped into memory.
+type imageSegment struct {
+	fileOffset uint64
+	address    uintptr
+	size       uintptr
+	protection Protection
+}
+
+func (s imageSegment) end() uintptr {
+	return s.address + s.size
+}
+
+// The executable image as it's loaded in memory. Segments may be mapped far
+// apart from each other, so they're never read as one block.
+type memoryImage struct {
+	segments []imageSegment
+}
+
+// Read the loaded image of an ELF executable whose first segment is mapped at
+// base, using the program headers (section headers aren't loaded).
+func readELFImage(base uintptr) (image *memoryImage, err error) {
+	if err = requireReadable(base, 64); err != nil {
+		return
+	}
+	ident := SliceAtAddress(base, elf.EI_NIDENT)
+	if !bytes.Equal(ident[:4], []byte(elf.ELFMAG)) {
+		err = fmt.Errorf("No ELF header at %#x", base)
+		return
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if elf.Data(ident[elf.EI_DATA]) == elf.ELFDATA2MSB {
+		order = binary.BigEndian
+	}
+
+	type programHeader struct {
+		ptype, flags                uint32
+		offset, vaddr, filesz, size uint64
+	}
+	var headers []programHeader
+	switch elf.Class(ident[elf.EI_CLASS]) {
+	case elf.ELFCLASS64:
+		var header elf.Header64
+		if err = readStructAt(base, order, &header); err != nil {
+			return
+		}
+		for i := 0; i < int(header.Phnum); i++ {
+			var prog elf.Prog64
+			if err = readStructAt(base+uintptr(header.Phoff)+uintptr(i)*uintptr(header.Phentsize), order, &prog); err != nil {
+				return
+			}
+			headers = append(headers, programHeader{prog.Type, prog.Flags, prog.Off, prog.Vaddr, prog.Filesz, prog.Memsz})
+		}
+	case elf.ELFCLASS32:
+		var header elf.Header32
+		if err = readStructAt(base, order, &header); err != nil {
+			return
+		}
+		for i := 0; i < int(header.Phnum); i++ {
+			var prog elf.Prog32
+			if err = readStructAt(base+uintptr(header.Phoff)+uintptr(i)*uintptr(header.Phentsize), order, &prog); err != nil {
+				return
+			}
+			headers = append(headers, programHeader{prog.Type, prog.Flags, uint64(prog.Off),
+				uint64(prog.Vaddr), uint64(prog.Filesz), uint64(prog.Memsz)})
+		}
+	default:
+		err = fmt.Errorf("Unknown ELF class %v", ident[elf.EI_CLASS])
+		return
+	}
+
+	// The first loaded segment is the one mapped at base.
+	image = &memoryImage{}
+	var bias uintptr
+	for _, h := range headers {
+		if elf.ProgType(h.ptype) != elf.PT_LOAD || h.filesz == 0 {
+			continue
+		}
+		if len(image.segments) == 0 {
+			bias = base - uintptr(h.vaddr)&pageBeginMask
+		}
+		size := h.filesz
+		if h.size < size {
+			size = h.size
+		}
+		image.segments = append(image.segments, imageSegment{
+			fileOffset: h.offset,
+			address:    uintptr(h.vaddr) + bias,
+			size:       uintptr(size),
+			protection: elfFlagsToProtection(elf.ProgFlag(h.flags)),
+		})
+	}
+	if len(image.segments) == 0 {
+		err = fmt.Errorf("ELF image at %#x has no loadable segments", base)
+		return
+	}
+	image.clampToMemoryMap()
+	return
+}
+
+func elfFlagsToProtection(flags elf.ProgFlag) (protection Protection) {
+	if flags&elf.PF_R != 0 {
+		protection |= ProtectionR
+	}
+	if flags&elf.PF_W != 0 {
+		protection |= ProtectionW
+	}
+	if flags&elf.PF_X != 0 {
+		protection |= ProtectionX
+	}
+	return
+}
+
+// Read the loaded image of a Mach-O executable whose header is at base, using
+// its segment load commands.
+func readMachOImage(base uintptr) (image *memoryImage, err error) {
+	if err = requireReadable(base, int(unsafe.Sizeof(macho.FileHeader{}))); err != nil {
+		return
+	}
+	var header macho.FileHeader
+	if err = readStructAt(base, binary.LittleEndian, &header); err != nil {
+		return
+	}
+	commandsStart := base + unsafe.Sizeof(header)
+	switch header.Magic {
+	case macho.Magic64:
+		commandsStart += 4 // reserved field
+	case macho.Magic32:
+	default:
+		err = fmt.Errorf("No Mach-O header at %#x", base)
+		return
+	}
+	if err = requireReadable(commandsStart, int(header.Cmdsz)); err != nil {
+		return
+	}
+
+	type segmentCommand struct {
+		vaddr, vsize, offset, filesz uint64
+		protection                   uint32
+	}
+	var segments []segmentCommand
+	commands := SliceAtAddress(commandsStart, int(header.Cmdsz))
+	for i := 0; i < int(header.Ncmd) && len(commands) >= 8; i++ {
+		command := macho.LoadCmd(binary.LittleEndian.Uint32(commands))
+		length := int(binary.LittleEndian.Uint32(commands[4:]))
+		if length < 8 || length > len(commands) {
+			err = fmt.Errorf("Invalid Mach-O load command length %v", length)
+			return
+		}
+		reader := bytes.NewReader(commands[:length])
+		switch command {
+		case macho.LoadCmdSegment64:
+			var segment macho.Segment64
+			if err = binary.Read(reader, binary.LittleEndian, &segment); err != nil {
+				return
+			}
+			segments = append(segments, segmentCommand{segment.Addr, segment.Memsz, segment.Offset, segment.Filesz, segment.Prot})
+		case macho.LoadCmdSegment:
+			var segment macho.Segment32
+			if err = binary.Read(reader, binary.LittleEndian, &segment); err != nil {
+				return
+			}
+			segments = append(segments, segmentCommand{uint64(segment.Addr), uint64(segment.Memsz),
+				uint64(segment.Offset), uint64(segment.Filesz), segment.Prot})
+		}
+		commands = commands[length:]
+	}
+
+	// __TEXT starts at file offset 0, and contains the header.
+	image = &memoryImage{}
+	var slide uintptr
+	foundText := false
+	for _, s := range segments {
+		if s.offset == 0 && s.filesz != 0 {
+			slide = base - uintptr(s.vaddr)
+			foundText = true
+		}
+	}
+	if !foundText {
+		err = fmt.Errorf("Mach-O image at %#x has no segment containing its header", base)
+		return
+	}
+	for _, s := range segments {
+		if s.filesz == 0 {
+			continue
+		}
+		size := s.filesz
+		if s.vsize < size {
+			size = s.vsize
+		}
+		image.segments = append(image.segments, imageSegment{
+			fileOffset: s.offset,
+			address:    uintptr(s.vaddr) + slide,
+			size:       uintptr(size),
+			// VM_PROT_READ, WRITE and EXECUTE have the same values as ours.
+			protection: Protection(s.protection) & ProtectionRWX,
+		})
+	}
+	image.clampToMemoryMap()
+	return
+}
+
+// Trim the segments to the memory that is actually mapped and readable,
+// splitting them around any holes.
+func (m *memoryImage) clampToMemoryMap() {
+	regions, err := GetMemoryMap()
+	if err != nil {
+		return
+	}
+	var clamped []imageSegment
+	for _, s := range m.segments {
+		for _, r := range regions {
+			if !r.Readable {
+				continue
+			}
+			start, end := s.address, s.end()
+			if r.Start > start {
+				start = r.Start
+			}
+			if r.End < end {
+				end = r.End
+			}
+			if start >= end {
+				continue
+			}
+			// Regions with different protections (for example from patching)
+			// are still one segment if they're contiguous.
+			if last := len(clamped) - 1; last >= 0 && clamped[last].end() == start &&
+				clamped[last].fileOffset+uint64(clamped[last].size) == s.fileOffset+uint64(start-s.address) {
+				clamped[last].size += end - start
+				continue
+			}
+			clamped = append(clamped, imageSegment{
+				fileOffset: s.fileOffset + uint64(start-s.address),
+				address:    start,
+				size:       end - start,
+				protection: s.protection,
+			})
+		}
+	}
+	m.segments = clamped
+}
+
+// Magic numbers of the go 1.18 and 1.20+ pclntab header (runtime.pcHeader).
+var pclntabMagics = []uint32{0xfffffff0, 0xfffffff1}
+
+// Find the go symbol table (pclntab) in the image, and load it.
+func (m *memoryImage) readSymbols() (symTable *gosym.Table, err error) {
+	for _, candidate := range m.findPclntabCandidates() {
+		if symTable, err = m.loadPclntab(candidate); err == nil {
+			return
+		}
+	}
+	return nil, fmt.Errorf("Could not find the go symbol table in memory")
+}
+
+// Returns everything that looks like the start of a pclntab in the image's
+// non-writable segments. The pclntab is in a read-only segment in ELF, but in
+// __TEXT (which is executable) in Mach-O, so read-only segments are searched
+// first, then executable ones.
+func (m *memoryImage) findPclntabCandidates() (candidates [][]byte) {
+	ptrSize := uintptr(unsafe.Sizeof(uintptr(0)))
+	for _, executable := range []bool{false, true} {
+		for _, s := range m.segments {
+			if s.protection&ProtectionW != 0 || (s.protection&ProtectionX != 0) != executable {
+				continue
+			}
+			data := SliceAtAddress(s.address, int(s.size))
+			for offset := uintptr(0); offset+8 <= s.size; offset += ptrSize {
+				if isPclntabHeader(data[offset:], ptrSize) {
+					candidates = append(candidates, data[offset:])
+				}
+			}
+		}
+	}
+	return
+}
+
+// Check whether data starts with a pclntab header (runtime.pcHeader) for this
+// architecture, whose offsets and function table fit in data. gosym trusts the
+// header's function count, so anything larger would exhaust memory rather than
+// fail.
+func isPclntabHeader(data []byte, ptrSize uintptr) bool {
+	// magic, 4 bytes, then nfunc, nfiles, textStart, and the funcname, cu,
+	// filetab, pctab and pcln offsets.
+	headerSize := 8 + 8*ptrSize
+	if uintptr(len(data)) < headerSize {
+		return false
+	}
+	magic := *(*uint32)(unsafe.Pointer(&data[0]))
+	if magic != pclntabMagics[0] && magic != pclntabMagics[1] {
+		return false
+	}
+	minLC := data[6]
+	if data[4] != 0 || data[5] != 0 || uintptr(data[7]) != ptrSize ||
+		(minLC != 1 && minLC != 2 && minLC != 4) {
+		return false
+	}
+
+	field := func(index uintptr) uint64 {
+		return uint64(*(*uintptr)(unsafe.Pointer(&data[8+index*ptrSize])))
+	}
+	length := uint64(len(data))
+	for index := uintptr(3); index < 8; index++ {
+		if field(index) < uint64(headerSize) || field(index) >= length {
+			return false
+		}
+	}
+	// The function table has nfunc+1 entries of two uint32s.
+	nfunc := field(0)
+	return nfunc < length && field(7)+(nfunc+1)*8 <= length
+}
+
+// The pclntab records function addresses relative to the start of the text
+// segment, which newer go versions no longer store in the table. Work it out
+// from a function whose address is known, which also accounts for the image
+// being loaded at a different address than the file specifies.
+func (m *memoryImage) loadPclntab(data []byte) (symTable *gosym.Table, err error) {
+	textStart, err := getLineTableLoadBias(data, 0)
+	if err != nil {
+		return
+	}
+	isText := false
+	for _, s := range m.segments {
+		isText = isText || (s.protection&ProtectionX != 0 && textStart >= s.address && textStart < s.end())
+	}
+	if !isText {
+		err = fmt.Errorf("Text start %#x is not in an executable segment", textStart)
+		return
+	}
+	return gosym.NewTable([]byte{}, gosym.NewLineTable(data, uint64(textStart)))
+}
+
+func readStructAt(address uintptr, order binary.ByteOrder, value interface{}) error {
+	size := binary.Size(value)
+	if err := requireReadable(address, size); err != nil {
+		return err
+	}
+	return binary.Read(bytes.NewReader(SliceAtAddress(address, size)), order, value)
+}
+
+// Fail if any part of [address, address+length) isn't mapped readable. If the
+// memory map isn't available, assume that it is.
+func requireReadable(address uintptr, length int) error {
+	regions, err := GetMemoryMap()
+	if err != nil {
+		return nil
+	}
+	end := address + uintptr(length)
+	for _, r := range regions {
+		if address >= end {
+			return nil
+		}
+		if r.Contains(address) {
+			if !r.Readable {
+				break
+			}
+			address = r.End
+		}
+	}
+	if address >= end {
+		return nil
+	}
+	return fmt.Errorf("Memory at %#x is not readable", address)
+}
@@ -0,0 +1,232 @@
+// Package leakcheck detects goroutine leaks by hooking goroutine creation, so
+// that every leaked goroutine is reported along with the stack that created
+// it.
+//
+//   if err := leakcheck.Start(); err != nil { ... }
+//   defer leakcheck.Stop()
+//   mark := leakcheck.Snapshot()
+//   codeUnderTest()
+//   for _, g := range leakcheck.Leaked(mark) {
+//       t.Errorf("Leaked %v", g)
+//   }
+//
+// Goroutine creation is hooked by redirecting the calls that go statements
+// make to runtime.newproc(). The started function is wrapped so that the new
+// goroutine can be identified, which means that while the detector is running,
+// tracebacks of new goroutines show leakcheck as their creator. Goroutines
+// started by the runtime itself are not tracked.
+package leakcheck
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/kstenerud/go-subvert"
+)
+
+// A goroutine created while the detector was running.
+type Goroutine struct {
+	// The goroutine's ID, or 0 if it hasn't started running yet.
+	ID uint64
+	// The name of the function the goroutine was started with.
+	Function string
+	// The stack of the goroutine that created it, as program counters.
+	CreatorStack []uintptr
+
+	sequence uint64
+}
+
+// Creator returns the creating stack in a human readable form.
+func (g *Goroutine) Creator() string {
+	var buff strings.Builder
+	frames := runtime.CallersFrames(g.CreatorStack)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&buff, "%v\n\t%v:%v\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return buff.String()
+}
+
+func (g *Goroutine) String() string {
+	state := "not started"
+	if g.ID != 0 {
+		state = "goroutine " + strconv.FormatUint(g.ID, 10)
+	}
+	return fmt.Sprintf("%v (%v), created by:\n%v", g.Function, state, g.Creator())
+}
+
+// A point in time to check for leaks from. See Snapshot().
+type Mark struct {
+	sequence uint64
+}
+
+var (
+	lock        sync.Mutex
+	sequence    uint64
+	running     map[*Goroutine]bool
+	patches     []*subvert.Patch
+	newprocFunc func(fn unsafe.Pointer)
+)
+
+// Start hooks goroutine creation. Only goroutines created while the detector
+// is running are tracked.
+func Start() (err error) {
+	lock.Lock()
+	defer lock.Unlock()
+	if patches != nil {
+		return fmt.Errorf("The leak detector is already running")
+	}
+
+	if newprocFunc == nil {
+		var exposed interface{}
+		if exposed, err = subvert.ExposeFunction("runtime.newproc", (func(unsafe.Pointer))(nil)); err != nil {
+			return
+		}
+		newprocFunc = exposed.(func(unsafe.Pointer))
+	}
+	if patches, err = subvert.RedirectCalls(newprocFunc, hookedNewproc); err != nil {
+		return
+	}
+	running = make(map[*Goroutine]bool)
+	return
+}
+
+// Stop removes the hook, and forgets all tracked goroutines.
+func Stop() (err error) {
+	lock.Lock()
+	defer lock.Unlock()
+	if patches == nil {
+		return fmt.Errorf("The leak detector is not running")
+	}
+
+	for i := len(patches) - 1; i >= 0; i-- {
+		if e := patches[i].Revert(); e != nil && err == nil {
+			err = e
+		}
+	}
+	patches = nil
+	running = nil
+	return
+}
+
+// Snapshot marks the current point in time, for use with Leaked().
+func Snapshot() Mark {
+	lock.Lock()
+	defer lock.Unlock()
+	return Mark{sequence: sequence}
+}
+
+// Leaked returns the tracked goroutines that were created after since and are
+// still alive, in creation order.
+//
+// Goroutines take time to finish, so code that shuts goroutines down
+// asynchronously may need to be given a moment before checking.
+func Leaked(since Mark) (leaked []*Goroutine) {
+	live := liveGoroutineIDs()
+
+	lock.Lock()
+	defer lock.Unlock()
+	for g := range running {
+		if g.sequence > since.sequence && (g.ID == 0 || live[g.ID]) {
+			leaked = append(leaked, g)
+		}
+	}
+	sort.Slice(leaked, func(i, j int) bool {
+		return leaked[i].sequence < leaked[j].sequence
+	})
+	return
+}
+
+// Replaces calls to runtime.newproc(). fn is the *funcval to start.
+func hookedNewproc(fn unsafe.Pointer) {
+	pcs := make([]uintptr, 32)
+	pcs = pcs[:runtime.Callers(2, pcs)]
+	if isRuntimeCaller(pcs) {
+		newprocFunc(fn)
+		return
+	}
+
+	g := &Goroutine{
+		Function:     functionName(*(*uintptr)(fn)),
+		CreatorStack: pcs,
+	}
+	lock.Lock()
+	if running == nil {
+		lock.Unlock()
+		newprocFunc(fn)
+		return
+	}
+	sequence++
+	g.sequence = sequence
+	running[g] = true
+	lock.Unlock()
+
+	start := *(*func())(unsafe.Pointer(&fn))
+	wrapper := func() {
+		lock.Lock()
+		g.ID = subvert.GoID()
+		lock.Unlock()
+		defer func() {
+			lock.Lock()
+			delete(running, g)
+			lock.Unlock()
+		}()
+		start()
+	}
+	newprocFunc(*(*unsafe.Pointer)(unsafe.Pointer(&wrapper)))
+}
+
+func isRuntimeCaller(pcs []uintptr) bool {
+	if len(pcs) == 0 {
+		return true
+	}
+	function := runtime.FuncForPC(pcs[0] - 1)
+	return function == nil || strings.HasPrefix(function.Name(), "runtime.")
+}
+
+func functionName(pc uintptr) string {
+	if function := runtime.FuncForPC(pc); function != nil {
+		return function.Name()
+	}
+	return fmt.Sprintf("0x%x", pc)
+}
+
+var goroutinePrefix = []byte("goroutine ")
+
+func parseGoroutineID(header []byte) uint64 {
+	header = bytes.TrimPrefix(header, goroutinePrefix)
+	if end := bytes.IndexByte(header, ' '); end >= 0 {
+		header = header[:end]
+	}
+	id, _ := strconv.ParseUint(string(header), 10, 64)
+	return id
+}
+
+func liveGoroutineIDs() map[uint64]bool {
+	buffer := make([]byte, 1<<16)
+	for {
+		length := runtime.Stack(buffer, true)
+		if length < len(buffer) {
+			buffer = buffer[:length]
+			break
+		}
+		buffer = make([]byte, len(buffer)*2)
+	}
+
+	live := make(map[uint64]bool)
+	for _, line := range bytes.Split(buffer, []byte("\n")) {
+		if bytes.HasPrefix(line, goroutinePrefix) {
+			live[parseGoroutineID(line)] = true
+		}
+	}
+	return live
+}
@@ -0,0 +1,74 @@
+package leakcheck
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+//go:noinline
+func leakyWorker(block chan struct{}) {
+	<-block
+}
+
+//go:noinline
+func startWorkers(block chan struct{}, done chan struct{}) {
+	go leakyWorker(block)
+	go func() {
+		close(done)
+	}()
+}
+
+func waitForLeaks(mark Mark, count int) (leaked []*Goroutine) {
+	for i := 0; i < 100; i++ {
+		if leaked = Leaked(mark); len(leaked) == count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return
+}
+
+func TestLeaked(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestLeaked because it doesn't work in test binaries on this platform.\n")
+		return
+	}
+
+	if err := Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Stop(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	mark := Snapshot()
+	block := make(chan struct{})
+	done := make(chan struct{})
+	startWorkers(block, done)
+	<-done
+
+	leaked := waitForLeaks(mark, 1)
+	if len(leaked) != 1 {
+		t.Fatalf("Expected 1 leaked goroutine but got %v", leaked)
+	}
+	g := leaked[0]
+	if !strings.Contains(g.Function, "startWorkers") {
+		t.Errorf("Expected the leaked goroutine to have been started in startWorkers, but got %v", g.Function)
+	}
+	if !strings.Contains(g.Creator(), "leakcheck.startWorkers") || !strings.Contains(g.Creator(), "leakcheck.TestLeaked") {
+		t.Errorf("Expected creator stack to include startWorkers and TestLeaked, but got:\n%v", g.Creator())
+	}
+
+	close(block)
+	if leaked = waitForLeaks(mark, 0); len(leaked) != 0 {
+		t.Errorf("Expected no leaked goroutines but got %v", leaked)
+	}
+	if leaked = Leaked(Snapshot()); len(leaked) != 0 {
+		t.Errorf("Expected no leaked goroutines since the latest snapshot but got %v", leaked)
+	}
+}
@@ -0,0 +1,110 @@
+package subvert
+
+import (
+	"fmt"
+	"sync"
+)
+
+// SetLocal stores a value for key in the current goroutine's local storage.
+// Other goroutines (including ones started by this goroutine) have their own
+// separate storage.
+//
+// Storage is released once the goroutine exits. The runtime doesn't announce
+// goroutine exits, so exited goroutines are swept out periodically as storage
+// grows.
+func SetLocal(key, value interface{}) (err error) {
+	g, goid, err := getLocalsOwner()
+	if err != nil {
+		return
+	}
+
+	localsLock.Lock()
+	defer localsLock.Unlock()
+	entry := locals[g]
+	if entry == nil || entry.goid != goid {
+		if len(locals) >= localsSweepThreshold {
+			sweepLocals()
+		}
+		entry = &goroutineLocals{goid: goid, values: make(map[interface{}]interface{})}
+		locals[g] = entry
+	}
+	entry.values[key] = value
+	return
+}
+
+// GetLocal gets the value stored for key in the current goroutine's local
+// storage.
+func GetLocal(key interface{}) (value interface{}, ok bool) {
+	g, goid, err := getLocalsOwner()
+	if err != nil {
+		return
+	}
+
+	localsLock.Lock()
+	defer localsLock.Unlock()
+	if entry := locals[g]; entry != nil && entry.goid == goid {
+		value, ok = entry.values[key]
+	}
+	return
+}
+
+// DeleteLocal removes key from the current goroutine's local storage.
+func DeleteLocal(key interface{}) {
+	g, goid, err := getLocalsOwner()
+	if err != nil {
+		return
+	}
+
+	localsLock.Lock()
+	defer localsLock.Unlock()
+	if entry := locals[g]; entry != nil && entry.goid == goid {
+		delete(entry.values, key)
+		if len(entry.values) == 0 {
+			delete(locals, g)
+		}
+	}
+}
+
+type goroutineLocals struct {
+	goid   uint64
+	values map[interface{}]interface{}
+}
+
+const minLocalsSweepThreshold = 64
+
+var (
+	localsLock           sync.Mutex
+	locals               = make(map[uintptr]*goroutineLocals)
+	localsSweepThreshold = minLocalsSweepThreshold
+)
+
+// Storage is keyed by g, but g structures are reused after a goroutine exits,
+// so the goroutine ID is also needed to tell whether storage is still valid.
+func getLocalsOwner() (g uintptr, goid uint64, err error) {
+	if g = getg(); g == 0 {
+		err = fmt.Errorf("Goroutine-local storage is not supported on this architecture")
+		return
+	}
+	// Storage keyed by a made up ID would be lost, so wait until it's known.
+	waitForGoroutineIDs()
+	if gGoidOffset == 0 {
+		_, err = getRuntimeFieldOffset("g.goid")
+		return
+	}
+	goid = readUint64At(g + gGoidOffset)
+	return
+}
+
+// Remove the storage of goroutines that have exited. g structures are never
+// freed, so it's always safe to read them.
+func sweepLocals() {
+	for g, entry := range locals {
+		if isGStatusDead(readUint32At(g+gStatusOffset)) || readUint64At(g+gGoidOffset) != entry.goid {
+			delete(locals, g)
+		}
+	}
+	localsSweepThreshold = len(locals) * 2
+	if localsSweepThreshold < minLocalsSweepThreshold {
+		localsSweepThreshold = minLocalsSweepThreshold
+	}
+}
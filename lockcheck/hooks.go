@@ -0,0 +1,130 @@
+package lockcheck
+
+import (
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"github.com/kstenerud/go-subvert"
+)
+
+// The original lock methods, which the hooks call through to.
+var (
+	mutexLock       func(*sync.Mutex)
+	mutexTryLock    func(*sync.Mutex) bool
+	mutexUnlock     func(*sync.Mutex)
+	rwMutexLock     func(*sync.RWMutex)
+	rwMutexTryLock  func(*sync.RWMutex) bool
+	rwMutexUnlock   func(*sync.RWMutex)
+	rwMutexRLock    func(*sync.RWMutex)
+	rwMutexTryRLock func(*sync.RWMutex) bool
+	rwMutexRUnlock  func(*sync.RWMutex)
+)
+
+// The runtime's stack helper behind runtime.Callers(). Unlike
+// runtime.Callers(), skip 0 is the function calling it.
+var callers func(skip int, pcbuf []uintptr) int
+
+func initOriginals() (err error) {
+	if mutexLock != nil {
+		return
+	}
+	if exposed, exposeErr := subvert.ExposeFunction("runtime.callers", (func(int, []uintptr) int)(nil)); exposeErr == nil {
+		callers = exposed.(func(int, []uintptr) int)
+	} else {
+		callers = func(skip int, pcbuf []uintptr) int {
+			return runtime.Callers(skip+2, pcbuf)
+		}
+	}
+	originals := []struct {
+		function    interface{}
+		destination interface{}
+	}{
+		{(*sync.Mutex).Lock, &mutexLock},
+		{(*sync.Mutex).TryLock, &mutexTryLock},
+		{(*sync.Mutex).Unlock, &mutexUnlock},
+		{(*sync.RWMutex).Lock, &rwMutexLock},
+		{(*sync.RWMutex).TryLock, &rwMutexTryLock},
+		{(*sync.RWMutex).Unlock, &rwMutexUnlock},
+		{(*sync.RWMutex).RLock, &rwMutexRLock},
+		{(*sync.RWMutex).TryRLock, &rwMutexTryRLock},
+		{(*sync.RWMutex).RUnlock, &rwMutexRUnlock},
+	}
+	for _, original := range originals {
+		var alias interface{}
+		if alias, err = subvert.AliasFunction(original.function); err != nil {
+			return
+		}
+		switch destination := original.destination.(type) {
+		case *func(*sync.Mutex):
+			*destination = alias.(func(*sync.Mutex))
+		case *func(*sync.Mutex) bool:
+			*destination = alias.(func(*sync.Mutex) bool)
+		case *func(*sync.RWMutex):
+			*destination = alias.(func(*sync.RWMutex))
+		case *func(*sync.RWMutex) bool:
+			*destination = alias.(func(*sync.RWMutex) bool)
+		}
+	}
+	return
+}
+
+func hookedMutexLock(m *sync.Mutex) {
+	acquisition := beginAcquire(uintptr(unsafe.Pointer(m)))
+	mutexLock(m)
+	endAcquire(acquisition)
+}
+
+func hookedMutexTryLock(m *sync.Mutex) bool {
+	acquisition := beginAcquire(uintptr(unsafe.Pointer(m)))
+	if !mutexTryLock(m) {
+		return false
+	}
+	endAcquire(acquisition)
+	return true
+}
+
+func hookedMutexUnlock(m *sync.Mutex) {
+	release(uintptr(unsafe.Pointer(m)))
+	mutexUnlock(m)
+}
+
+func hookedRWMutexLock(m *sync.RWMutex) {
+	acquisition := beginAcquire(uintptr(unsafe.Pointer(m)))
+	rwMutexLock(m)
+	endAcquire(acquisition)
+}
+
+func hookedRWMutexTryLock(m *sync.RWMutex) bool {
+	acquisition := beginAcquire(uintptr(unsafe.Pointer(m)))
+	if !rwMutexTryLock(m) {
+		return false
+	}
+	endAcquire(acquisition)
+	return true
+}
+
+func hookedRWMutexUnlock(m *sync.RWMutex) {
+	release(uintptr(unsafe.Pointer(m)))
+	rwMutexUnlock(m)
+}
+
+func hookedRWMutexRLock(m *sync.RWMutex) {
+	acquisition := beginAcquire(uintptr(unsafe.Pointer(m)))
+	rwMutexRLock(m)
+	endAcquire(acquisition)
+}
+
+func hookedRWMutexTryRLock(m *sync.RWMutex) bool {
+	acquisition := beginAcquire(uintptr(unsafe.Pointer(m)))
+	if !rwMutexTryRLock(m) {
+		return false
+	}
+	endAcquire(acquisition)
+	return true
+}
+
+func hookedRWMutexRUnlock(m *sync.RWMutex) {
+	release(uintptr(unsafe.Pointer(m)))
+	rwMutexRUnlock(m)
+}
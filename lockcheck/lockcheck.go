@@ -0,0 +1,365 @@
+// Package lockcheck detects potential deadlocks and long lock hold times by
+// hooking sync.Mutex and sync.RWMutex.
+//
+// While running, every lock acquisition is recorded against the locks that the
+// acquiring goroutine already holds, building a lock order graph. If two locks
+// are ever acquired in opposite orders (or more generally, the graph contains
+// a cycle), that's a potential deadlock, even if it never actually happened.
+//
+//   if err := lockcheck.Start(lockcheck.Options{LongHold: time.Second}); err != nil { ... }
+//   runTests()
+//   lockcheck.Stop()
+//   for _, cycle := range lockcheck.Cycles() {
+//       fmt.Println(cycle)
+//   }
+//
+// Locks are hooked by redirecting direct calls to their methods (see
+// subvert.RedirectCalls()). The compiler inlines most calls to Mutex.Lock(),
+// Mutex.Unlock(), RWMutex.RLock() and RWMutex.RUnlock(), so build with
+// -gcflags=all=-l for full coverage.
+//
+// Locks are identified by address, so a lock that is freed and whose memory is
+// reused for another lock will be treated as the same lock. Goroutines are
+// identified by their runtime g structure, which the runtime reuses once a
+// goroutine exits.
+package lockcheck
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kstenerud/go-subvert"
+)
+
+// Options controls what is checked.
+type Options struct {
+	// Report locks held for at least this long. 0 disables reporting.
+	LongHold time.Duration
+}
+
+// An Acquisition is a lock being acquired, and the stack that acquired it.
+type Acquisition struct {
+	Lock  uintptr
+	Stack []uintptr
+}
+
+// An Edge records that To was acquired while From was held.
+type Edge struct {
+	From Acquisition
+	To   Acquisition
+}
+
+// A Cycle is a set of lock orderings that could deadlock if run concurrently.
+type Cycle struct {
+	Edges []Edge
+}
+
+// A LongHold is a lock that was held for longer than Options.LongHold.
+type LongHold struct {
+	Acquisition
+	Duration time.Duration
+}
+
+func (c Cycle) String() string {
+	var buff strings.Builder
+	fmt.Fprintf(&buff, "Potential deadlock between %v locks:\n", len(c.Edges))
+	for _, edge := range c.Edges {
+		fmt.Fprintf(&buff, "\nLock %#x acquired:\n%v", edge.From.Lock, formatStack(edge.From.Stack))
+		fmt.Fprintf(&buff, "then lock %#x acquired:\n%v", edge.To.Lock, formatStack(edge.To.Stack))
+	}
+	return buff.String()
+}
+
+func (h LongHold) String() string {
+	return fmt.Sprintf("Lock %#x held for %v, acquired:\n%v", h.Lock, h.Duration, formatStack(h.Stack))
+}
+
+// Start hooks the lock methods and begins checking. Methods that the program
+// never calls directly are skipped.
+func Start(options Options) (err error) {
+	lockControl()
+	defer unlockControl()
+	if patches != nil {
+		return fmt.Errorf("lockcheck is already running")
+	}
+	if err = initOriginals(); err != nil {
+		return
+	}
+
+	Reset()
+	lockState()
+	config = options
+	held = make(map[uintptr][]*heldLock)
+	unlockState()
+
+	// Hook the unlock methods first, so that no lock is recorded without
+	// also recording its unlock.
+	hooks := []struct{ function, hook interface{} }{
+		{(*sync.Mutex).Unlock, hookedMutexUnlock},
+		{(*sync.RWMutex).Unlock, hookedRWMutexUnlock},
+		{(*sync.RWMutex).RUnlock, hookedRWMutexRUnlock},
+		{(*sync.Mutex).Lock, hookedMutexLock},
+		{(*sync.Mutex).TryLock, hookedMutexTryLock},
+		{(*sync.RWMutex).Lock, hookedRWMutexLock},
+		{(*sync.RWMutex).TryLock, hookedRWMutexTryLock},
+		{(*sync.RWMutex).RLock, hookedRWMutexRLock},
+		{(*sync.RWMutex).TryRLock, hookedRWMutexTryRLock},
+	}
+	var firstErr error
+	for _, h := range hooks {
+		added, err := subvert.RedirectCalls(h.function, h.hook)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		patches = append(patches, added...)
+	}
+	if patches == nil {
+		return fmt.Errorf("Could not hook any lock methods: %w", firstErr)
+	}
+	return
+}
+
+// Stop removes the hooks. Results remain available until Reset() or the next
+// Start().
+func Stop() (err error) {
+	lockControl()
+	defer unlockControl()
+	if patches == nil {
+		return fmt.Errorf("lockcheck is not running")
+	}
+	for i := len(patches) - 1; i >= 0; i-- {
+		if e := patches[i].Revert(); e != nil && err == nil {
+			err = e
+		}
+	}
+	patches = nil
+	return
+}
+
+// Cycles returns every potential deadlock found so far.
+func Cycles() []Cycle {
+	lockState()
+	defer unlockState()
+	return append([]Cycle{}, cycles...)
+}
+
+// LongHolds returns every lock held for longer than Options.LongHold so far.
+func LongHolds() []LongHold {
+	lockState()
+	defer unlockState()
+	return append([]LongHold{}, longHolds...)
+}
+
+// Reset forgets everything recorded so far.
+func Reset() {
+	lockState()
+	defer unlockState()
+	edges = make(map[[2]uintptr]*Edge)
+	successors = make(map[uintptr][]uintptr)
+	cycleKeys = make(map[string]bool)
+	cycles = nil
+	longHolds = nil
+}
+
+type heldLock struct {
+	Acquisition
+	acquired time.Time
+}
+
+// Start() and Stop() are serialized by controlLock, and everything that the
+// hooks use by stateLock. Neither can be a sync.Mutex, since sync.Mutex is
+// what's being hooked, and the hooks never take controlLock.
+var (
+	controlLock = make(chan struct{}, 1)
+	patches     []*subvert.Patch
+
+	stateLock  int32
+	config     Options
+	held       map[uintptr][]*heldLock
+	edges      = make(map[[2]uintptr]*Edge)
+	successors = make(map[uintptr][]uintptr)
+	cycleKeys  = make(map[string]bool)
+	cycles     []Cycle
+	longHolds  []LongHold
+)
+
+func lockControl() {
+	controlLock <- struct{}{}
+}
+
+func unlockControl() {
+	<-controlLock
+}
+
+func lockState() {
+	for !atomic.CompareAndSwapInt32(&stateLock, 0, 1) {
+		runtime.Gosched()
+	}
+}
+
+func unlockState() {
+	atomic.StoreInt32(&stateLock, 0)
+}
+
+// Record that the current goroutine is about to acquire lock, and return the
+// acquisition. This is done before the lock is acquired, so that the ordering
+// is recorded even if acquiring it deadlocks.
+func beginAcquire(lock uintptr) *heldLock {
+	pcs := make([]uintptr, 32)
+	pcs = pcs[:callers(2, pcs)]
+	if isInternalCall(pcs) {
+		return nil
+	}
+	acquisition := &heldLock{Acquisition: Acquisition{Lock: lock, Stack: pcs}}
+	goroutine := currentGoroutine()
+
+	lockState()
+	defer unlockState()
+	for _, h := range held[goroutine] {
+		if h.Lock != lock {
+			addEdge(h.Acquisition, acquisition.Acquisition)
+		}
+	}
+	return acquisition
+}
+
+// Record that the current goroutine now holds the lock.
+func endAcquire(acquisition *heldLock) {
+	if acquisition == nil {
+		return
+	}
+	goroutine := currentGoroutine()
+	acquisition.acquired = time.Now()
+
+	lockState()
+	defer unlockState()
+	held[goroutine] = append(held[goroutine], acquisition)
+}
+
+// Record that lock is being released. Locks are normally released by the
+// goroutine that acquired them, but not necessarily.
+func release(lock uintptr) {
+	pcs := make([]uintptr, 1)
+	if isInternalCall(pcs[:callers(2, pcs)]) {
+		return
+	}
+	goroutine := currentGoroutine()
+	now := time.Now()
+
+	lockState()
+	defer unlockState()
+	if h := removeHeld(goroutine, lock); h != nil {
+		checkHoldTime(h, now)
+		return
+	}
+	for other := range held {
+		if h := removeHeld(other, lock); h != nil {
+			checkHoldTime(h, now)
+			return
+		}
+	}
+}
+
+// RWMutex is built on Mutex, so when inlining is disabled, its lock methods
+// also call the Mutex hooks (with the same address). Only the outer call is
+// recorded.
+func isInternalCall(pcs []uintptr) bool {
+	if len(pcs) == 0 {
+		return true
+	}
+	function := runtime.FuncForPC(pcs[0] - 1)
+	return function != nil && strings.HasPrefix(function.Name(), "sync.")
+}
+
+// Identify the current goroutine by its g structure, which is much faster than
+// getting its ID when the runtime's layout isn't known.
+func currentGoroutine() uintptr {
+	if g := subvert.CurrentG(); g != nil {
+		return uintptr(g)
+	}
+	return uintptr(subvert.GoID())
+}
+
+func removeHeld(goroutine uintptr, lock uintptr) *heldLock {
+	locks := held[goroutine]
+	for i := len(locks) - 1; i >= 0; i-- {
+		if locks[i].Lock == lock {
+			h := locks[i]
+			if locks = append(locks[:i], locks[i+1:]...); len(locks) == 0 {
+				delete(held, goroutine)
+			} else {
+				held[goroutine] = locks
+			}
+			return h
+		}
+	}
+	return nil
+}
+
+func checkHoldTime(h *heldLock, now time.Time) {
+	if duration := now.Sub(h.acquired); config.LongHold > 0 && duration >= config.LongHold {
+		longHolds = append(longHolds, LongHold{Acquisition: h.Acquisition, Duration: duration})
+	}
+}
+
+func addEdge(from, to Acquisition) {
+	key := [2]uintptr{from.Lock, to.Lock}
+	if edges[key] != nil {
+		return
+	}
+	edge := &Edge{From: from, To: to}
+	edges[key] = edge
+	successors[from.Lock] = append(successors[from.Lock], to.Lock)
+
+	// A path back from "to" to "from" closes a cycle.
+	if path := findPath(to.Lock, from.Lock, map[uintptr]bool{}); path != nil {
+		cycle := Cycle{Edges: []Edge{*edge}}
+		locks := []string{fmt.Sprintf("%x", from.Lock)}
+		for i := 0; i < len(path)-1; i++ {
+			cycle.Edges = append(cycle.Edges, *edges[[2]uintptr{path[i], path[i+1]}])
+			locks = append(locks, fmt.Sprintf("%x", path[i]))
+		}
+		sort.Strings(locks)
+		if cycleKey := strings.Join(locks, ","); !cycleKeys[cycleKey] {
+			cycleKeys[cycleKey] = true
+			cycles = append(cycles, cycle)
+		}
+	}
+}
+
+// Depth-first search for a path of locks from "from" to "to".
+func findPath(from, to uintptr, visited map[uintptr]bool) []uintptr {
+	if from == to {
+		return []uintptr{to}
+	}
+	visited[from] = true
+	for _, next := range successors[from] {
+		if !visited[next] {
+			if path := findPath(next, to, visited); path != nil {
+				return append([]uintptr{from}, path...)
+			}
+		}
+	}
+	return nil
+}
+
+func formatStack(stack []uintptr) string {
+	var buff strings.Builder
+	frames := runtime.CallersFrames(stack)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&buff, "  %v\n    %v:%v\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return buff.String()
+}
@@ -0,0 +1,112 @@
+package lockcheck
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var lockA, lockB, lockC sync.RWMutex
+
+//go:noinline
+func lockAThenB() {
+	lockA.Lock()
+	lockB.Lock()
+	lockB.Unlock()
+	lockA.Unlock()
+}
+
+//go:noinline
+func lockBThenA() {
+	lockB.Lock()
+	lockA.Lock()
+	lockA.Unlock()
+	lockB.Unlock()
+}
+
+//go:noinline
+func holdC(d time.Duration) {
+	lockC.Lock()
+	time.Sleep(d)
+	lockC.Unlock()
+}
+
+func TestLockCheck(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestLockCheck because it doesn't work in test binaries on this platform.\n")
+		return
+	}
+
+	if err := Start(Options{LongHold: 20 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	lockAThenB()
+	holdC(time.Millisecond)
+	if len(Cycles()) != 0 {
+		t.Errorf("Expected no cycles yet, but got %v", Cycles())
+	}
+
+	// Never actually deadlocks, since it runs after lockAThenB()
+	lockBThenA()
+	holdC(30 * time.Millisecond)
+	if err := Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	cycles := Cycles()
+	if len(cycles) != 1 {
+		t.Fatalf("Expected 1 cycle but got %v", cycles)
+	}
+	report := cycles[0].String()
+	if !strings.Contains(report, "lockcheck.lockAThenB") || !strings.Contains(report, "lockcheck.lockBThenA") {
+		t.Errorf("Expected the report to contain both acquiring functions, but got:\n%v", report)
+	}
+
+	longHolds := LongHolds()
+	if len(longHolds) != 1 || longHolds[0].Duration < 30*time.Millisecond {
+		t.Fatalf("Expected 1 long hold of at least 30ms, but got %v", longHolds)
+	}
+	if !strings.Contains(longHolds[0].String(), "lockcheck.holdC") {
+		t.Errorf("Expected the long hold to be acquired in holdC, but got:\n%v", longHolds[0])
+	}
+
+	Reset()
+	if len(Cycles()) != 0 || len(LongHolds()) != 0 {
+		t.Errorf("Expected Reset() to clear everything")
+	}
+}
+
+func TestConcurrentStart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestConcurrentStart because it doesn't work in test binaries on this platform.\n")
+		return
+	}
+
+	const count = 4
+	results := make(chan error, count)
+	for i := 0; i < count; i++ {
+		go func() {
+			results <- Start(Options{})
+		}()
+	}
+	started := 0
+	for i := 0; i < count; i++ {
+		if err := <-results; err == nil {
+			started++
+		} else if !strings.Contains(err.Error(), "already running") {
+			t.Errorf("Expected an already running error but got %v", err)
+		}
+	}
+	if started != 1 {
+		t.Errorf("Expected exactly 1 Start() to succeed but got %v", started)
+	}
+	if err := Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Stop(); err == nil {
+		t.Errorf("Expected error stopping when not running")
+	}
+}
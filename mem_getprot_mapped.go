@@ -0,0 +1,16 @@
+// +build linux darwin
+
+package subvert
+
+func osGetMemoryProtection(address uintptr) Protection {
+	regions, err := osGetMemoryMap()
+	if err != nil {
+		return ProtectionRX
+	}
+	for _, region := range regions {
+		if region.Contains(address) {
+			return region.Protection
+		}
+	}
+	return ProtectionNone
+}
@@ -2,7 +2,7 @@
 
 package subvert
 
-func osGetMemoryProtection(address uintptr) memProtect {
+func osGetMemoryProtection(address uintptr) Protection {
 	// TODO
-	return memProtectRX
+	return ProtectionRX
 }
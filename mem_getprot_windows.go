@@ -1,6 +1,9 @@
 package subvert
 
-func osGetMemoryProtection(address uintptr) memProtect {
-	// TODO
-	return memProtectRX
+func osGetMemoryProtection(address uintptr) Protection {
+	_, _, _, protect, ok := queryMemory(address)
+	if !ok {
+		return ProtectionNone
+	}
+	return winToProtection(protect)
 }
@@ -1,32 +1,128 @@
 package subvert
 
-func setMemoryProtection(address uintptr, length uintptr, protection memProtect) (oldProtection memProtect, err error) {
-	return osSetMemoryProtection(address, length, protection)
+import (
+	"unsafe"
+)
+
+// Protection describes the access allowed to a page of memory.
+//
+// On Windows, OS-specific modifier flags such as PAGE_GUARD may be present
+// above the low byte.
+type Protection int
+
+const (
+	ProtectionNone Protection = 0
+	ProtectionR    Protection = 1
+	ProtectionW    Protection = 2
+	ProtectionX    Protection = 4
+	ProtectionRW              = ProtectionR | ProtectionW
+	ProtectionRX              = ProtectionR | ProtectionX
+	ProtectionWX              = ProtectionW | ProtectionX
+	ProtectionRWX             = ProtectionR | ProtectionW | ProtectionX
+
+	// Windows PAGE_GUARD. Other OSes never report it.
+	protectionGuard Protection = 0x100
+)
+
+func (p Protection) String() string {
+	result := []byte("---")
+	if p&ProtectionR != 0 {
+		result[0] = 'r'
+	}
+	if p&ProtectionW != 0 {
+		result[1] = 'w'
+	}
+	if p&ProtectionX != 0 {
+		result[2] = 'x'
+	}
+	return string(result)
 }
 
-// Unprotect a memory region, perform an operation, and then restore the old
-// protection.
-func applyToProtectedMemory(address uintptr, length uintptr, operation func()) (err error) {
-	oldProtection, err := setMemoryProtection(address, length, memProtectRWX)
+// Protect sets the protection of every page overlapping the memory range
+// [address, address+length), returning the old protection of each page.
+func Protect(address uintptr, length uintptr, protection Protection) (old []Protection, err error) {
+	if old, err = getPageProtections(address, length); err != nil {
+		return
+	}
+	err = osSetMemoryProtection(address, length, protection)
+	return
+}
+
+// WithProtection sets the protection of a memory range, performs an operation,
+// and then restores each page's old protection.
+func WithProtection(address uintptr, length uintptr, protection Protection, operation func()) (err error) {
+	old, err := Protect(address, length, protection)
 	if err != nil {
 		return
 	}
 
+	defer func() {
+		if restoreErr := restorePageProtections(address, old); err == nil {
+			err = restoreErr
+		}
+	}()
+
 	operation()
+	return
+}
 
-	_, err = setMemoryProtection(address, length, oldProtection)
+func getPageProtections(address uintptr, length uintptr) (protections []Protection, err error) {
+	if err = initProcess(); err != nil {
+		return
+	}
+	regions, mapErr := GetMemoryMap()
+	end := address + length
+	for pageStart := address & pageBeginMask; pageStart < end; pageStart += uintptr(pageSize) {
+		if mapErr != nil {
+			protections = append(protections, osGetMemoryProtection(pageStart))
+			continue
+		}
+		protection := ProtectionNone
+		for _, region := range regions {
+			if region.Contains(pageStart) {
+				protection = region.Protection
+				break
+			}
+		}
+		protections = append(protections, protection)
+	}
 	return
 }
 
-type memProtect int
+// Restore the per-page protections returned by Protect(), one run of equal
+// protections at a time.
+func restorePageProtections(address uintptr, protections []Protection) (err error) {
+	if err = initProcess(); err != nil {
+		return
+	}
+	runStart := address & pageBeginMask
+	for i := 0; i < len(protections); {
+		runLength := 1
+		for i+runLength < len(protections) && protections[i+runLength] == protections[i] {
+			runLength++
+		}
+		length := uintptr(runLength * pageSize)
+		if err = osSetMemoryProtection(runStart, length, protections[i]); err != nil {
+			return
+		}
+		runStart += length
+		i += runLength
+	}
+	return
+}
 
-const (
-	memProtectNone memProtect = 0
-	memProtectR               = 1
-	memProtectW               = 2
-	memProtectX               = 4
-	memProtectRW              = memProtectR | memProtectW
-	memProtectRX              = memProtectR | memProtectX
-	memProtectWX              = memProtectW | memProtectX
-	memProtectRWX             = memProtectR | memProtectW | memProtectX
-)
+func readUintptrAt(address uintptr) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&SliceAtAddress(address, int(unsafe.Sizeof(uintptr(0))))[0]))
+}
+
+func readUint64At(address uintptr) uint64 {
+	return *(*uint64)(unsafe.Pointer(&SliceAtAddress(address, 8)[0]))
+}
+
+func readUint32At(address uintptr) uint32 {
+	return *(*uint32)(unsafe.Pointer(&SliceAtAddress(address, 4)[0]))
+}
+
+func readUint8At(address uintptr) uint8 {
+	return SliceAtAddress(address, 1)[0]
+}
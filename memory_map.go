@@ -0,0 +1,53 @@
+package subvert
+
+// MemoryRegion describes a contiguous range of mapped memory in this process.
+//
+// Protection is what the OS reports, which Protect() can restore. Readable,
+// Writable and Executable are derived from it, and say whether the memory can
+// be accessed right now. They differ for Windows guard pages, which raise an
+// exception when touched: Protection has PAGE_GUARD and the page's underlying
+// access, but Readable, Writable and Executable are all false.
+type MemoryRegion struct {
+	Start      uintptr
+	End        uintptr
+	Protection Protection
+	Readable   bool
+	Writable   bool
+	Executable bool
+
+	// Path is the file backing this region, or a pseudo-name such as [heap]
+	// or [stack]. It will be empty if the OS doesn't report it.
+	Path string
+}
+
+// Length returns the number of bytes covered by the region.
+func (r MemoryRegion) Length() uintptr {
+	return r.End - r.Start
+}
+
+// Contains returns true if address falls within the region.
+func (r MemoryRegion) Contains(address uintptr) bool {
+	return address >= r.Start && address < r.End
+}
+
+// GetMemoryMap returns the regions of memory currently mapped into this
+// process, in ascending address order.
+func GetMemoryMap() (regions []MemoryRegion, err error) {
+	return osGetMemoryMap()
+}
+
+func newMemoryRegion(start, end uintptr, protection Protection, path string) MemoryRegion {
+	access := protection
+	if protection&protectionGuard != 0 {
+		access = ProtectionNone
+	}
+	return MemoryRegion{
+		Start:      start,
+		End:        end,
+		Protection: protection,
+		Readable:   access&ProtectionR != 0,
+		Writable:   access&ProtectionW != 0,
+		Executable: access&ProtectionX != 0,
+		Path:       path,
+	}
+}
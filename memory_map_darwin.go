@@ -0,0 +1,85 @@
+package subvert
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Calls into libSystem go through the runtime, the same way as package syscall
+// and golang.org/x/sys/unix do, so that no cgo is needed.
+
+//go:cgo_import_dynamic libc_task_self_trap task_self_trap "/usr/lib/libSystem.B.dylib"
+//go:cgo_import_dynamic libc_mach_vm_region mach_vm_region "/usr/lib/libSystem.B.dylib"
+//go:cgo_import_dynamic libc_proc_regionfilename proc_regionfilename "/usr/lib/libSystem.B.dylib"
+
+// Addresses of the trampolines in memory_map_darwin_*.s
+var (
+	libc_task_self_trap_trampoline_addr      uintptr
+	libc_mach_vm_region_trampoline_addr      uintptr
+	libc_proc_regionfilename_trampoline_addr uintptr
+)
+
+//go:linkname syscall_syscall9 syscall.syscall9
+func syscall_syscall9(fn, a1, a2, a3, a4, a5, a6, a7, a8, a9 uintptr) (r1, r2 uintptr, err syscall.Errno)
+
+const (
+	// https://opensource.apple.com/source/xnu/xnu-7195.81.3/osfmk/mach/vm_region.h
+	vmRegionBasicInfo64      = 9
+	vmRegionBasicInfoCount64 = 9
+	kernInvalidAddress       = 1
+	// VM_PROT_READ, VM_PROT_WRITE and VM_PROT_EXECUTE have the same values as
+	// ProtectionR, ProtectionW and ProtectionX.
+	vmProtRWX = 7
+)
+
+func osGetMemoryMap() (regions []MemoryRegion, err error) {
+	task, _, _ := syscall_syscall9(libc_task_self_trap_trampoline_addr, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	pid := os.Getpid()
+
+	var address, size uint64
+	for {
+		// vm_region_basic_info_data_64_t, which starts with the protection
+		var info [vmRegionBasicInfoCount64]int32
+		count := uint32(vmRegionBasicInfoCount64)
+		var objectName uint32
+		result, _, _ := syscall_syscall9(libc_mach_vm_region_trampoline_addr,
+			task,
+			uintptr(unsafe.Pointer(&address)),
+			uintptr(unsafe.Pointer(&size)),
+			vmRegionBasicInfo64,
+			uintptr(unsafe.Pointer(&info[0])),
+			uintptr(unsafe.Pointer(&count)),
+			uintptr(unsafe.Pointer(&objectName)),
+			0, 0)
+		switch int32(result) {
+		case 0:
+		case kernInvalidAddress:
+			// There are no more regions above address
+			return
+		default:
+			return nil, fmt.Errorf("mach_vm_region failed at %#x with kern_return_t %v", address, int32(result))
+		}
+
+		start := uintptr(address)
+		protection := Protection(info[0] & vmProtRWX)
+		regions = append(regions, newMemoryRegion(start, start+uintptr(size), protection, regionFilename(pid, address)))
+		address += size
+	}
+}
+
+// Get the path of the file mapped at address, or "" if there is none.
+func regionFilename(pid int, address uint64) string {
+	var path [1024]byte
+	length, _, _ := syscall_syscall9(libc_proc_regionfilename_trampoline_addr,
+		uintptr(pid),
+		uintptr(address),
+		uintptr(unsafe.Pointer(&path[0])),
+		uintptr(len(path)),
+		0, 0, 0, 0, 0)
+	if int32(length) <= 0 {
+		return ""
+	}
+	return string(path[:length])
+}
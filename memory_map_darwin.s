@@ -0,0 +1,18 @@
+#include "textflag.h"
+
+// Trampolines to the libSystem functions used by memory_map_darwin.go
+
+TEXT libc_task_self_trap_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	libc_task_self_trap(SB)
+GLOBL	·libc_task_self_trap_trampoline_addr(SB), RODATA, $8
+DATA	·libc_task_self_trap_trampoline_addr(SB)/8, $libc_task_self_trap_trampoline<>(SB)
+
+TEXT libc_mach_vm_region_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	libc_mach_vm_region(SB)
+GLOBL	·libc_mach_vm_region_trampoline_addr(SB), RODATA, $8
+DATA	·libc_mach_vm_region_trampoline_addr(SB)/8, $libc_mach_vm_region_trampoline<>(SB)
+
+TEXT libc_proc_regionfilename_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	libc_proc_regionfilename(SB)
+GLOBL	·libc_proc_regionfilename_trampoline_addr(SB), RODATA, $8
+DATA	·libc_proc_regionfilename_trampoline_addr(SB)/8, $libc_proc_regionfilename_trampoline<>(SB)
@@ -0,0 +1,76 @@
+package subvert
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func osGetMemoryMap() (regions []MemoryRegion, err error) {
+	file, err := os.Open("/proc/self/maps")
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var region MemoryRegion
+		if region, err = parseMapsLine(scanner.Text()); err != nil {
+			return
+		}
+		regions = append(regions, region)
+	}
+	err = scanner.Err()
+	return
+}
+
+// Parses a line from /proc/self/maps:
+// 559576822000-559576827000 r-xp 00002000 00:1a 4586   /usr/bin/cat
+func parseMapsLine(line string) (region MemoryRegion, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 5 {
+		err = fmt.Errorf("Malformed memory map line: [%v]", line)
+		return
+	}
+
+	addresses := strings.SplitN(fields[0], "-", 2)
+	if len(addresses) != 2 {
+		err = fmt.Errorf("Malformed memory map address range: [%v]", fields[0])
+		return
+	}
+	start, err := strconv.ParseUint(addresses[0], 16, 64)
+	if err != nil {
+		return
+	}
+	end, err := strconv.ParseUint(addresses[1], 16, 64)
+	if err != nil {
+		return
+	}
+
+	protection := ProtectionNone
+	perms := fields[1]
+	if len(perms) < 3 {
+		err = fmt.Errorf("Malformed memory map permissions: [%v]", perms)
+		return
+	}
+	if perms[0] == 'r' {
+		protection |= ProtectionR
+	}
+	if perms[1] == 'w' {
+		protection |= ProtectionW
+	}
+	if perms[2] == 'x' {
+		protection |= ProtectionX
+	}
+
+	path := ""
+	if len(fields) > 5 {
+		path = strings.Join(fields[5:], " ")
+	}
+
+	region = newMemoryRegion(uintptr(start), uintptr(end), protection, path)
+	return
+}
@@ -0,0 +1,11 @@
+// +build !linux,!windows,!darwin
+
+package subvert
+
+import (
+	"fmt"
+)
+
+func osGetMemoryMap() (regions []MemoryRegion, err error) {
+	return nil, fmt.Errorf("Memory map is not implemented on this OS")
+}
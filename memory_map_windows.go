@@ -0,0 +1,60 @@
+package subvert
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+const winMemCommit = 0x1000
+
+func osGetMemoryMap() (regions []MemoryRegion, err error) {
+	address := uintptr(0)
+	for {
+		base, size, state, protect, ok := queryMemory(address)
+		if !ok {
+			return
+		}
+
+		if state == winMemCommit {
+			regions = append(regions, newMemoryRegion(base, base+size, winToProtection(protect), ""))
+		}
+
+		if base+size <= address {
+			return
+		}
+		address = base + size
+	}
+}
+
+func queryMemory(address uintptr) (base, size uintptr, state, protect uint32, ok bool) {
+	// https://docs.microsoft.com/en-us/windows/win32/api/memoryapi/nf-memoryapi-virtualquery
+	// https://docs.microsoft.com/en-us/windows/win32/api/winnt/ns-winnt-memory_basic_information
+	if initProcess() != nil {
+		return
+	}
+	var info [48]byte
+	result, _, _ := virtualQuery.Call(address,
+		uintptr(unsafe.Pointer(&info[0])),
+		uintptr(len(info)))
+	if result == 0 {
+		return
+	}
+
+	if is64BitUintptr {
+		base = uintptr(binary.LittleEndian.Uint64(info[0:]))
+		size = uintptr(binary.LittleEndian.Uint64(info[24:]))
+		state = binary.LittleEndian.Uint32(info[32:])
+		protect = binary.LittleEndian.Uint32(info[36:])
+	} else {
+		base = uintptr(binary.LittleEndian.Uint32(info[0:]))
+		size = uintptr(binary.LittleEndian.Uint32(info[12:]))
+		state = binary.LittleEndian.Uint32(info[16:])
+		protect = binary.LittleEndian.Uint32(info[20:])
+	}
+	ok = true
+	return
+}
+
+func winToProtection(protect uint32) Protection {
+	return osToProt[int(protect&0xff)] | Protection(protect&^0xff)
+}
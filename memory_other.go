@@ -7,35 +7,46 @@ import (
 )
 
 var protToOS = []int{
-	memProtectNone: 0,
-	memProtectR:    syscall.PROT_READ,
-	memProtectW:    syscall.PROT_WRITE,
-	memProtectX:    syscall.PROT_EXEC,
-	memProtectRW:   syscall.PROT_READ | syscall.PROT_WRITE,
-	memProtectRX:   syscall.PROT_READ | syscall.PROT_EXEC,
-	memProtectWX:   syscall.PROT_WRITE | syscall.PROT_EXEC,
-	memProtectRWX:  syscall.PROT_READ | syscall.PROT_WRITE | syscall.PROT_EXEC,
+	ProtectionNone: 0,
+	ProtectionR:    syscall.PROT_READ,
+	ProtectionW:    syscall.PROT_WRITE,
+	ProtectionX:    syscall.PROT_EXEC,
+	ProtectionRW:   syscall.PROT_READ | syscall.PROT_WRITE,
+	ProtectionRX:   syscall.PROT_READ | syscall.PROT_EXEC,
+	ProtectionWX:   syscall.PROT_WRITE | syscall.PROT_EXEC,
+	ProtectionRWX:  syscall.PROT_READ | syscall.PROT_WRITE | syscall.PROT_EXEC,
 }
 
-var osToProt = []memProtect{
-	0:                                      memProtectNone,
-	syscall.PROT_READ:                      memProtectR,
-	syscall.PROT_WRITE:                     memProtectW,
-	syscall.PROT_EXEC:                      memProtectX,
-	syscall.PROT_READ | syscall.PROT_WRITE: memProtectRW,
-	syscall.PROT_READ | syscall.PROT_EXEC:  memProtectRX,
-	syscall.PROT_WRITE | syscall.PROT_EXEC: memProtectWX,
-	syscall.PROT_READ | syscall.PROT_WRITE | syscall.PROT_EXEC: memProtectRWX,
+var osToProt = []Protection{
+	0:                                      ProtectionNone,
+	syscall.PROT_READ:                      ProtectionR,
+	syscall.PROT_WRITE:                     ProtectionW,
+	syscall.PROT_EXEC:                      ProtectionX,
+	syscall.PROT_READ | syscall.PROT_WRITE: ProtectionRW,
+	syscall.PROT_READ | syscall.PROT_EXEC:  ProtectionRX,
+	syscall.PROT_WRITE | syscall.PROT_EXEC: ProtectionWX,
+	syscall.PROT_READ | syscall.PROT_WRITE | syscall.PROT_EXEC: ProtectionRWX,
 }
 
-func osSetMemoryProtection(address uintptr, length uintptr, protection memProtect) (old memProtect, err error) {
-	old = osGetMemoryProtection(address)
-	end := address + uintptr(length)
-	for pageStart := address & pageBeginMask; pageStart < end; pageStart += uintptr(pageSize) {
-		page := SliceAtAddress(address&pageBeginMask, pageSize)
-		if err = syscall.Mprotect(page, protToOS[protection]); err != nil {
-			return
-		}
+func osSetMemoryProtection(address uintptr, length uintptr, protection Protection) (err error) {
+	initProcess()
+	start := address & pageBeginMask
+	end := (address + length + uintptr(pageSize-1)) & pageBeginMask
+	pages := SliceAtAddress(start, int(end-start))
+	return syscall.Mprotect(pages, protToOS[protection&ProtectionRWX])
+}
+
+func osAllocatePages(length uintptr) (address uintptr, err error) {
+	memory, err := syscall.Mmap(-1, 0, int(length),
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return
 	}
+	address = GetSliceAddr(memory)
 	return
 }
+
+func osFreePages(address uintptr, length uintptr) error {
+	return syscall.Munmap(SliceAtAddress(address, int(length)))
+}
@@ -4,8 +4,11 @@ import (
 	"unsafe"
 )
 
-func osSetMemoryProtection(address uintptr, length uintptr, protection memProtect) (old memProtect, err error) {
-	newProtection := protToOS[protection&0xff] | uintptr(protection&^0xff)
+func osSetMemoryProtection(address uintptr, length uintptr, protection Protection) (err error) {
+	if err = initProcess(); err != nil {
+		return
+	}
+	newProtection := protToOS[protection&ProtectionRWX] | uintptr(protection&^0xff)
 
 	// https://docs.microsoft.com/en-us/windows/win32/api/memoryapi/nf-memoryapi-virtualprotect
 	// https://docs.microsoft.com/en-us/windows/win32/memory/memory-protection-constants
@@ -16,27 +19,54 @@ func osSetMemoryProtection(address uintptr, length uintptr, protection memProtec
 		uintptr(unsafe.Pointer(&oldProtection)))
 	if result != 0 {
 		err = nil
-		old = osToProt[int(oldProtection&0xff)] | memProtect(oldProtection&^0xff)
+	}
+	return
+}
+
+func osAllocatePages(length uintptr) (address uintptr, err error) {
+	if err = initProcess(); err != nil {
+		return
+	}
+	// https://docs.microsoft.com/en-us/windows/win32/api/memoryapi/nf-memoryapi-virtualalloc
+	const memCommitReserve = 0x3000
+	address, _, err = virtualAlloc.Call(0, length, memCommitReserve, protToOS[ProtectionRW])
+	if address != 0 {
+		err = nil
+	}
+	return
+}
+
+func osFreePages(address uintptr, length uintptr) (err error) {
+	if err = initProcess(); err != nil {
+		return
+	}
+	// https://docs.microsoft.com/en-us/windows/win32/api/memoryapi/nf-memoryapi-virtualfree
+	const memRelease = 0x8000
+	result, _, err := virtualFree.Call(address, 0, memRelease)
+	if result != 0 {
+		err = nil
 	}
 	return
 }
 
 var protToOS = []uintptr{
-	memProtectNone: 0,
-	memProtectR:    0x02,
-	memProtectW:    0,
-	memProtectX:    0x10,
-	memProtectRW:   0x04,
-	memProtectRX:   0x20,
-	memProtectWX:   0,
-	memProtectRWX:  0x40,
+	ProtectionNone: 0,
+	ProtectionR:    0x02,
+	ProtectionW:    0,
+	ProtectionX:    0x10,
+	ProtectionRW:   0x04,
+	ProtectionRX:   0x20,
+	ProtectionWX:   0,
+	ProtectionRWX:  0x40,
 }
 
-var osToProt = map[int]memProtect{
-	0:    memProtectNone,
-	0x02: memProtectR,
-	0x04: memProtectRW,
-	0x10: memProtectX,
-	0x20: memProtectRX,
-	0x40: memProtectRWX,
+var osToProt = map[int]Protection{
+	0:    ProtectionNone,
+	0x02: ProtectionR,
+	0x04: ProtectionRW,
+	0x08: ProtectionRW, // PAGE_WRITECOPY
+	0x10: ProtectionX,
+	0x20: ProtectionRX,
+	0x40: ProtectionRWX,
+	0x80: ProtectionRWX, // PAGE_EXECUTE_WRITECOPY
 }
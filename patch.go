@@ -0,0 +1,207 @@
+package subvert
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// PatchKind describes what sort of operation created a patch.
+type PatchKind int
+
+const (
+	PatchKindMemory PatchKind = iota
+	PatchKindFunctionReplacement
+	PatchKindCallRedirection
+	PatchKindVariable
+)
+
+var patchKindNames = []string{
+	PatchKindMemory:              "memory",
+	PatchKindFunctionReplacement: "function replacement",
+	PatchKindCallRedirection:     "call redirection",
+	PatchKindVariable:            "variable",
+}
+
+func (k PatchKind) String() string {
+	if k < 0 || int(k) >= len(patchKindNames) {
+		return fmt.Sprintf("PatchKind(%d)", int(k))
+	}
+	return patchKindNames[k]
+}
+
+// Patch records a change made to memory, so that it can be reverted.
+type Patch struct {
+	Kind     PatchKind
+	Address  uintptr
+	Original []byte
+	Patched  []byte
+
+	// Symbol is the symbol containing Address, if known.
+	Symbol string
+
+	// Time is when the patch was applied.
+	Time time.Time
+
+	// Stack holds the program counters of the code that applied the patch.
+	// Use StackTrace() to format it.
+	Stack []uintptr
+
+	reverted bool
+
+	// Restores the original contents. If nil, Original is written back.
+	restore func() error
+
+	// Called once the patch has been reverted
+	onRevert func()
+
+	// Anything that the patched memory refers to, which must be kept alive
+	// until the patch is reverted (such as a replacement function).
+	referenced interface{}
+}
+
+// Revert restores the memory to what it was before the patch was applied. It
+// fails if the memory no longer contains what the patch wrote. Reverting an
+// already reverted patch does nothing.
+func (p *Patch) Revert() (err error) {
+	patchRegistryLock.Lock()
+	err = p.revertLocked()
+	patchRegistryLock.Unlock()
+
+	if err == nil && p.onRevert != nil {
+		onRevert := p.onRevert
+		p.onRevert = nil
+		onRevert()
+	}
+	return
+}
+
+func (p *Patch) revertLocked() (err error) {
+	if p.reverted {
+		return
+	}
+	if p.restore != nil {
+		err = p.restore()
+	} else if err = verifyMemory(p.Address, p.Patched); err == nil {
+		_, err = writeMemory(p.Address, p.Original)
+	}
+	if err != nil {
+		return
+	}
+	p.reverted = true
+	unregisterPatch(p)
+	return
+}
+
+// IsReverted returns true if the patch has been reverted.
+func (p *Patch) IsReverted() bool {
+	patchRegistryLock.Lock()
+	defer patchRegistryLock.Unlock()
+	return p.reverted
+}
+
+// StackTrace formats the stack of the code that applied the patch.
+func (p *Patch) StackTrace() string {
+	var buff strings.Builder
+	frames := runtime.CallersFrames(p.Stack)
+	for {
+		frame, more := frames.Next()
+		if frame.Function != "" {
+			fmt.Fprintf(&buff, "%v\n\t%v:%v\n", frame.Function, frame.File, frame.Line)
+		}
+		if !more {
+			break
+		}
+	}
+	return buff.String()
+}
+
+func (p *Patch) String() string {
+	location := fmt.Sprintf("%#x", p.Address)
+	if p.Symbol != "" {
+		location = fmt.Sprintf("%v (%v)", location, p.Symbol)
+	}
+	appliedBy := "?"
+	frames := runtime.CallersFrames(p.Stack)
+	if frame, _ := frames.Next(); frame.Function != "" {
+		appliedBy = fmt.Sprintf("%v (%v:%v)", frame.Function, frame.File, frame.Line)
+	}
+	return fmt.Sprintf("%v patch at %v, %v bytes, applied %v by %v",
+		p.Kind, location, len(p.Patched), p.Time.Format(time.RFC3339Nano), appliedBy)
+}
+
+// PatchMemoryIfMatches applies a patch to the specified memory location, but
+// only if the memory currently contains the expected bytes. If it doesn't, a
+// *PatchMismatchError is returned and nothing is written.
+//
+// Use this instead of PatchMemory() whenever the contents of the memory could
+// differ between go versions or build flags.
+func PatchMemoryIfMatches(address uintptr, expected []byte, patch []byte) (oldMemory []byte, err error) {
+	if err = verifyMemory(address, expected); err != nil {
+		return
+	}
+	return PatchMemory(address, patch)
+}
+
+// PatchMismatchError is returned when memory doesn't contain what was expected.
+type PatchMismatchError struct {
+	Address  uintptr
+	Expected []byte
+	Found    []byte
+}
+
+func (e *PatchMismatchError) Error() string {
+	return fmt.Sprintf("Memory at %#x doesn't contain the expected contents\nExpected:\n%vFound:\n%v",
+		e.Address, osDisassemble(e.Address, e.Expected), osDisassemble(e.Address, e.Found))
+}
+
+func verifyMemory(address uintptr, expected []byte) error {
+	found := SliceAtAddress(address, len(expected))
+	if bytes.Equal(found, expected) {
+		return nil
+	}
+	return &PatchMismatchError{
+		Address:  address,
+		Expected: append([]byte{}, expected...),
+		Found:    append([]byte{}, found...),
+	}
+}
+
+// Write to memory without recording a patch.
+func writeMemory(address uintptr, patch []byte) (oldMemory []byte, err error) {
+	memory := SliceAtAddress(address, len(patch))
+	oldMemory = make([]byte, len(memory))
+	copy(oldMemory, memory)
+	err = WithProtection(address, uintptr(len(patch)), ProtectionRWX, func() {
+		copy(memory, patch)
+	})
+	return
+}
+
+func applyPatch(kind PatchKind, address uintptr, patch []byte, referenced interface{}) (p *Patch, err error) {
+	return registerPatch(kind, address, len(patch), func() (p *Patch, err error) {
+		oldMemory, err := writeMemory(address, patch)
+		if err != nil {
+			return
+		}
+		p = &Patch{
+			Address:    address,
+			Original:   oldMemory,
+			Patched:    append([]byte{}, patch...),
+			referenced: referenced,
+		}
+		return
+	})
+}
+
+// Revert patches in reverse order, stopping at the first failure.
+func revertPatches(patches []*Patch) (err error) {
+	for i := len(patches) - 1; i >= 0; i-- {
+		if err = patches[i].Revert(); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,196 @@
+package subvert
+
+import (
+	"fmt"
+)
+
+// PatchSet collects patches so that they can be applied and reverted as a
+// single unit. Nothing is patched until Apply() is called, at which point
+// every operation is validated before any are applied. If any operation
+// fails, the ones already applied are rolled back.
+//
+// Example:
+//   set := subvert.NewPatchSet().
+//       ReplaceFunction(time.Now, fakeNow).
+//       WriteVariable(&http.DefaultClient, fakeClient)
+//   if err := set.Apply(); err != nil {
+//       // Nothing was patched
+//   }
+//   defer set.Revert()
+type PatchSet struct {
+	operations []patchOperation
+	patches    []*Patch
+	applied    bool
+}
+
+// Validates an operation, returning a function that applies it.
+type patchOperation func() (apply func() ([]*Patch, error), err error)
+
+// NewPatchSet creates an empty patch set.
+func NewPatchSet() *PatchSet {
+	return &PatchSet{}
+}
+
+// PatchMemory adds a PatchMemory() operation to the set.
+func (s *PatchSet) PatchMemory(address uintptr, patch []byte) *PatchSet {
+	return s.PatchMemoryIfMatches(address, nil, patch)
+}
+
+// PatchMemoryIfMatches adds a PatchMemoryIfMatches() operation to the set.
+func (s *PatchSet) PatchMemoryIfMatches(address uintptr, expected []byte, patch []byte) *PatchSet {
+	patch = append([]byte{}, patch...)
+	return s.add(func() (apply func() ([]*Patch, error), err error) {
+		if expected != nil {
+			if err = verifyMemory(address, expected); err != nil {
+				return
+			}
+		}
+		apply = func() ([]*Patch, error) {
+			if expected != nil {
+				if err := verifyMemory(address, expected); err != nil {
+					return nil, err
+				}
+			}
+			p, err := applyPatch(PatchKindMemory, address, patch, nil)
+			return []*Patch{p}, err
+		}
+		return
+	})
+}
+
+// ReplaceFunction adds a ReplaceFunction() operation to the set.
+func (s *PatchSet) ReplaceFunction(function, replacement interface{}) *PatchSet {
+	return s.replaceFunction(function, nil, replacement)
+}
+
+// ReplaceFunctionIfMatches adds a ReplaceFunctionIfMatches() operation to the set.
+func (s *PatchSet) ReplaceFunctionIfMatches(function interface{}, expected []byte, replacement interface{}) *PatchSet {
+	if expected == nil {
+		expected = []byte{}
+	}
+	return s.replaceFunction(function, expected, replacement)
+}
+
+// RedirectCalls adds a RedirectCalls() operation to the set.
+func (s *PatchSet) RedirectCalls(function, replacement interface{}) *PatchSet {
+	return s.redirectCalls(function, nil, replacement)
+}
+
+// RedirectCallsIfMatches adds a RedirectCallsIfMatches() operation to the set.
+func (s *PatchSet) RedirectCallsIfMatches(function interface{}, expected []byte, replacement interface{}) *PatchSet {
+	if expected == nil {
+		expected = []byte{}
+	}
+	return s.redirectCalls(function, expected, replacement)
+}
+
+// WriteVariable adds a WriteVariable() operation to the set.
+func (s *PatchSet) WriteVariable(pointer interface{}, value interface{}) *PatchSet {
+	return s.add(func() (apply func() ([]*Patch, error), err error) {
+		w, err := prepareWriteVariable(pointer, value)
+		if err != nil {
+			return
+		}
+		apply = func() ([]*Patch, error) {
+			p, err := w.apply()
+			return []*Patch{p}, err
+		}
+		return
+	})
+}
+
+// WriteVariableByName adds a WriteVariableByName() operation to the set.
+func (s *PatchSet) WriteVariableByName(symbolName string, value interface{}) *PatchSet {
+	return s.add(func() (apply func() ([]*Patch, error), err error) {
+		w, err := prepareWriteVariableByName(symbolName, value)
+		if err != nil {
+			return
+		}
+		apply = func() ([]*Patch, error) {
+			p, err := w.apply()
+			return []*Patch{p}, err
+		}
+		return
+	})
+}
+
+// Apply validates every operation in the set, and then applies them in the
+// order they were added. If anything fails, all patches applied so far are
+// reverted and the error is returned. If they can't all be reverted, Patches()
+// still returns them, and Revert() can be called to try again.
+func (s *PatchSet) Apply() (err error) {
+	if s.applied {
+		return fmt.Errorf("Patch set has already been applied")
+	}
+
+	appliers := make([]func() ([]*Patch, error), 0, len(s.operations))
+	for i, operation := range s.operations {
+		apply, opErr := operation()
+		if opErr != nil {
+			return fmt.Errorf("Patch set operation %v failed validation: %w", i+1, opErr)
+		}
+		appliers = append(appliers, apply)
+	}
+
+	for i, apply := range appliers {
+		patches, opErr := apply()
+		if opErr != nil {
+			err = fmt.Errorf("Patch set operation %v failed: %w", i+1, opErr)
+			if rollbackErr := revertPatches(s.patches); rollbackErr != nil {
+				// Like Revert(), keep the patches so that it can be retried.
+				err = fmt.Errorf("%v (rollback also failed: %v)", err, rollbackErr)
+				return
+			}
+			s.patches = nil
+			return
+		}
+		s.patches = append(s.patches, patches...)
+	}
+	s.applied = true
+	return
+}
+
+// Revert reverts every patch in the set, in reverse order.
+func (s *PatchSet) Revert() (err error) {
+	if err = revertPatches(s.patches); err != nil {
+		return
+	}
+	s.patches = nil
+	s.applied = false
+	return
+}
+
+// Patches returns the patches that have been applied by this set.
+func (s *PatchSet) Patches() []*Patch {
+	return s.patches
+}
+
+func (s *PatchSet) replaceFunction(function interface{}, expected []byte, replacement interface{}) *PatchSet {
+	return s.add(func() (apply func() ([]*Patch, error), err error) {
+		r, err := prepareReplaceFunction(function, expected, replacement)
+		if err != nil {
+			return
+		}
+		apply = func() ([]*Patch, error) {
+			p, err := r.apply()
+			return []*Patch{p}, err
+		}
+		return
+	})
+}
+
+func (s *PatchSet) redirectCalls(function interface{}, expected []byte, replacement interface{}) *PatchSet {
+	return s.add(func() (apply func() ([]*Patch, error), err error) {
+		r, err := prepareRedirectCalls(function, expected, replacement)
+		if err != nil {
+			return
+		}
+		apply = r.apply
+		return
+	})
+}
+
+func (s *PatchSet) add(operation patchOperation) *PatchSet {
+	s.operations = append(s.operations, operation)
+	return s
+}
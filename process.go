@@ -1,15 +1,33 @@
 package subvert
 
+import (
+	"fmt"
+	"sync"
+)
+
 var (
 	pageSize           int
 	pageBeginMask      uintptr
 	processBaseAddress uintptr
 	processCopy        []byte
+
+	processInitOnce  sync.Once
+	processInitError error
 )
 
-func initProcess() {
-	osInitProcess()
-	pageSize = osGetPageSize()
-	pageBeginMask = ^uintptr(pageSize - 1)
-	processBaseAddress = osGetProcessBaseAddress()
+// Initialize process information on first use. If the OS-specific setup fails,
+// a default page size is still provided, and every OS call returns the error.
+func initProcess() error {
+	processInitOnce.Do(func() {
+		pageSize = 0x1000
+		if err := osInitProcess(); err != nil {
+			processInitError = fmt.Errorf("Could not initialize process access: %w", err)
+			logf("go-subvert: %v", processInitError)
+		} else {
+			pageSize = osGetPageSize()
+			processBaseAddress = osGetProcessBaseAddress()
+		}
+		pageBeginMask = ^uintptr(pageSize - 1)
+	})
+	return processInitError
 }
@@ -2,7 +2,6 @@ package subvert
 
 import (
 	"bytes"
-	"fmt"
 	"syscall"
 )
 
@@ -16,7 +15,7 @@ func osGetProcessBaseAddress() (address uintptr) {
 	// Do a guess assuming this function's address is close to the base.
 	addr, err := getFunctionAddress(osGetProcessBaseAddress)
 	if err != nil {
-		fmt.Println(err)
+		logf("go-subvert: Could not find the process base address: %v", err)
 		return
 	}
 	startAddress := addr & ^uintptr(0xffffff)
@@ -40,6 +39,7 @@ func osGetPageSize() int {
 	return syscall.Getpagesize()
 }
 
-func osInitProcess() {
+func osInitProcess() error {
 	// Nothing to do
+	return nil
 }
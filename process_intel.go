@@ -3,12 +3,15 @@
 package subvert
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 
 	"golang.org/x/arch/x86/x86asm"
 )
 
+const osSupportsCallRedirection = true
+
 const callOpFirstByte = byte(0xe8)
 const callOpLength = 5
 const callOpArgLength = 4
@@ -16,6 +19,10 @@ const callOpArgLength = 4
 // Maps function location to a list of places where it's called from
 var callLocations map[uintptr][]uintptr
 
+func resetCallCache() {
+	callLocations = nil
+}
+
 func initCallCache() (err error) {
 	if callLocations != nil {
 		return
@@ -40,16 +47,11 @@ func initCallCache() (err error) {
 
 	callLocations = make(map[uintptr][]uintptr)
 
-	registerSize := 32
-	if is64BitUintptr {
-		registerSize = 64
-	}
-
 	for _, f := range table.Funcs {
 		bytes := SliceAtAddress(uintptr(f.Entry), int(f.End-f.Entry))
 		pc := uintptr(f.Entry)
 		for len(bytes) >= callOpLength {
-			inst, _ := x86asm.Decode(bytes, registerSize)
+			inst, _ := x86asm.Decode(bytes, registerSize())
 			if bytes[0] == callOpFirstByte {
 				argDst := bytes[1:callOpLength]
 				callArg := uintptr(int32(binary.LittleEndian.Uint32(argDst)))
@@ -64,28 +66,117 @@ func initCallCache() (err error) {
 	return
 }
 
-func osRedirectCalls(src, dst uintptr) (err error) {
+func registerSize() int {
+	if is64BitUintptr {
+		return 64
+	}
+	return 32
+}
+
+// Get the locations of the call argument of every direct call to function.
+func osGetCallSites(function uintptr) (sites []uintptr, err error) {
 	if err = initCallCache(); err != nil {
 		return
 	}
 
-	callLocations, ok := callLocations[src]
+	sites, ok := callLocations[function]
 	if !ok {
 		err = fmt.Errorf("Function is not referenced in this program")
-		return
 	}
+	return
+}
 
-	for _, loc := range callLocations {
-		newCallArg := uint32(dst - loc - callOpArgLength)
-		bytes := SliceAtAddress(loc, callOpArgLength)
+// Make the call argument that sends the call at site to destination.
+func osMakeCallArg(site, destination uintptr) []byte {
+	arg := make([]byte, callOpArgLength)
+	binary.LittleEndian.PutUint32(arg, uint32(destination-site-callOpArgLength))
+	return arg
+}
 
-		err = applyToProtectedMemory(GetSliceAddr(bytes), callOpArgLength, func() {
-			binary.LittleEndian.PutUint32(bytes, newCallArg)
-		})
-		if err != nil {
-			return
-		}
+// Make code that jumps to a function value, passing the function value in the
+// closure context register like a normal go call would.
+func osMakeJumpToFuncval(funcval uintptr) (code []byte, err error) {
+	if is64BitUintptr {
+		// MOVQ $funcval, DX
+		// JMP (DX)
+		code = []byte{0x48, 0xba, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0x22}
+		binary.LittleEndian.PutUint64(code[2:], uint64(funcval))
+		return
 	}
+	// MOVL $funcval, DX
+	// JMP (DX)
+	code = []byte{0xba, 0, 0, 0, 0, 0xff, 0x22}
+	binary.LittleEndian.PutUint32(code[1:], uint32(funcval))
+	return
+}
 
+// Make code that counts a call and records its return address in counter
+// (a struct of two uintptrs), then jumps to function with all argument
+// registers intact.
+func osMakeCountingStub(counter, function uintptr) (code []byte, err error) {
+	if is64BitUintptr {
+		// R12 and R13 are scratch registers in the register ABI.
+		// MOVQ $counter, R12
+		// LOCK INCQ (R12)
+		// MOVQ (SP), R13
+		// MOVQ R13, 8(R12)
+		// MOVQ $function, R12
+		// JMP R12
+		code = []byte{
+			0x49, 0xbc, 0, 0, 0, 0, 0, 0, 0, 0,
+			0xf0, 0x49, 0xff, 0x04, 0x24,
+			0x4c, 0x8b, 0x2c, 0x24,
+			0x4d, 0x89, 0x6c, 0x24, 0x08,
+			0x49, 0xbc, 0, 0, 0, 0, 0, 0, 0, 0,
+			0x41, 0xff, 0xe4,
+		}
+		binary.LittleEndian.PutUint64(code[2:], uint64(counter))
+		binary.LittleEndian.PutUint64(code[26:], uint64(function))
+		return
+	}
+	// Arguments are passed on the stack, so AX and CX are free.
+	// MOVL $counter, AX
+	// LOCK INCL (AX)
+	// MOVL (SP), CX
+	// MOVL CX, 4(AX)
+	// MOVL $function, AX
+	// JMP AX
+	code = []byte{
+		0xb8, 0, 0, 0, 0,
+		0xf0, 0xff, 0x00,
+		0x8b, 0x0c, 0x24,
+		0x89, 0x48, 0x04,
+		0xb8, 0, 0, 0, 0,
+		0xff, 0xe0,
+	}
+	binary.LittleEndian.PutUint32(code[1:], uint32(counter))
+	binary.LittleEndian.PutUint32(code[15:], uint32(function))
 	return
 }
+
+func osAllocateStub(code []byte) (address uintptr, err error) {
+	return allocateStub(code)
+}
+
+func osFreeStub(address uintptr) {
+	freeStub(address)
+}
+
+func osDisassemble(address uintptr, code []byte) string {
+	var buff bytes.Buffer
+	for len(code) > 0 {
+		inst, err := x86asm.Decode(code, registerSize())
+		length := inst.Len
+		text := ""
+		if err != nil || length == 0 {
+			length = 1
+			text = "?"
+		} else {
+			text = x86asm.GoSyntax(inst, uint64(address), nil)
+		}
+		fmt.Fprintf(&buff, "  %#x: %-24x %v\n", address, code[:length], text)
+		address += uintptr(length)
+		code = code[length:]
+	}
+	return buff.String()
+}
@@ -1,38 +1,35 @@
 package subvert
 
 import (
-	"bufio"
 	"os"
-	"strconv"
+	"strings"
 	"syscall"
 )
 
 func osGetProcessBaseAddress() (address uintptr) {
-	path := "/proc/self/maps"
-
-	fileReader, err := os.Open(path)
-	if err != nil {
-		return
-	}
-	reader := bufio.NewReader(fileReader)
-	addrString, err := reader.ReadBytes('-')
-	if err != nil {
+	regions, err := osGetMemoryMap()
+	if err != nil || len(regions) == 0 {
 		return
 	}
 
-	addrString = addrString[:len(addrString)-1]
-	parsed, err := strconv.ParseUint(string(addrString), 16, 64)
-	if err != nil {
-		return
+	// Position independent executables are loaded at a random address, which
+	// can be above memory the runtime has already reserved, so look for the
+	// executable's own mapping.
+	if exePath, err := os.Executable(); err == nil {
+		for _, region := range regions {
+			if strings.TrimSuffix(region.Path, " (deleted)") == exePath {
+				return region.Start
+			}
+		}
 	}
-	address = uintptr(parsed)
-	return
+	return regions[0].Start
 }
 
 func osGetPageSize() int {
 	return syscall.Getpagesize()
 }
 
-func osInitProcess() {
+func osInitProcess() error {
 	// Nothing to do
+	return nil
 }
@@ -3,9 +3,48 @@
 package subvert
 
 import (
+	"bytes"
 	"fmt"
 )
 
-func osRedirectCalls(src, dst uintptr) (err error) {
-	return fmt.Errorf("Not implemented on this arch")
+const osSupportsCallRedirection = false
+
+func resetCallCache() {
+}
+
+func osGetCallSites(function uintptr) (sites []uintptr, err error) {
+	return nil, fmt.Errorf("Not implemented on this arch")
+}
+
+func osMakeCallArg(site, destination uintptr) []byte {
+	return nil
+}
+
+func osMakeJumpToFuncval(funcval uintptr) (code []byte, err error) {
+	return nil, fmt.Errorf("Not implemented on this arch")
+}
+
+func osMakeCountingStub(counter, function uintptr) (code []byte, err error) {
+	return nil, fmt.Errorf("Not implemented on this arch")
+}
+
+func osAllocateStub(code []byte) (address uintptr, err error) {
+	return 0, fmt.Errorf("Not implemented on this arch")
+}
+
+func osFreeStub(address uintptr) {
+}
+
+func osDisassemble(address uintptr, code []byte) string {
+	var buff bytes.Buffer
+	for len(code) > 0 {
+		length := 16
+		if length > len(code) {
+			length = len(code)
+		}
+		fmt.Fprintf(&buff, "  %#x: % x\n", address, code[:length])
+		address += uintptr(length)
+		code = code[length:]
+	}
+	return buff.String()
 }
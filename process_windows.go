@@ -1,7 +1,6 @@
 package subvert
 
 import (
-	"log"
 	"reflect"
 	"syscall"
 )
@@ -21,7 +20,7 @@ func osGetPageSize() int {
 	getSystemInfo.Call(ptr)
 	pageSize := int(memory[1]) // dwPageSize
 	if pageSize <= 0 {
-		log.Printf("go-subvert: Warning: GetSystemInfo returned page size of %v\n", pageSize)
+		logf("go-subvert: Warning: GetSystemInfo returned page size of %v", pageSize)
 		pageSize = 0x1000
 	}
 	return pageSize
@@ -31,13 +30,28 @@ var kernel32 *syscall.LazyDLL
 var virtualProtect *syscall.LazyProc
 var getModuleHandle *syscall.LazyProc
 var getSystemInfo *syscall.LazyProc
+var virtualQuery *syscall.LazyProc
+var virtualAlloc *syscall.LazyProc
+var virtualFree *syscall.LazyProc
 
-func osInitProcess() {
+func osInitProcess() (err error) {
 	kernel32 = syscall.NewLazyDLL("kernel32.dll")
-	virtualProtect = kernel32.NewProc("VirtualProtect")
-	virtualProtect.Addr() // Forces a panic if not found
-	getModuleHandle = kernel32.NewProc("GetModuleHandleA")
-	getModuleHandle.Addr()
-	getSystemInfo = kernel32.NewProc("GetSystemInfo")
-	getSystemInfo.Addr()
+	procs := []struct {
+		proc **syscall.LazyProc
+		name string
+	}{
+		{&virtualProtect, "VirtualProtect"},
+		{&getModuleHandle, "GetModuleHandleA"},
+		{&getSystemInfo, "GetSystemInfo"},
+		{&virtualQuery, "VirtualQuery"},
+		{&virtualAlloc, "VirtualAlloc"},
+		{&virtualFree, "VirtualFree"},
+	}
+	for _, p := range procs {
+		*p.proc = kernel32.NewProc(p.name)
+		if err = (*p.proc).Find(); err != nil {
+			return
+		}
+	}
+	return
 }
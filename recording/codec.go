@@ -0,0 +1,357 @@
+package recording
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/kstenerud/go-subvert"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Encodes a value into a tree of JSON-marshalable values. The encoding is
+// driven by the value's static type, so only interfaces record their concrete
+// type. pointers holds the pointers currently being encoded, to detect cycles.
+func encodeValue(v reflect.Value, pointers []uintptr) (encoded interface{}, err error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if err = subvert.MakeWritable(&v); err != nil {
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return encodeFloat(v.Float()), nil
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		return []interface{}{encodeFloat(real(c)), encodeFloat(imag(c))}, nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return encodeElements(v, pointers)
+	case reflect.Array:
+		return encodeElements(v, pointers)
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return encodeMap(v, pointers)
+	case reflect.Struct:
+		fields := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			name := v.Type().Field(i).Name
+			if fields[name], err = encodeValue(v.Field(i), pointers); err != nil {
+				return nil, fmt.Errorf("%v.%v: %w", v.Type(), name, err)
+			}
+		}
+		return fields, nil
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil, nil
+		}
+		for _, pointer := range pointers {
+			if pointer == v.Pointer() {
+				return nil, fmt.Errorf("Pointer cycle through %v", v.Type())
+			}
+		}
+		return encodeValue(v.Elem(), append(pointers, v.Pointer()))
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return encodeInterface(v, pointers)
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return "<" + v.Kind().String() + ">", nil
+	default:
+		return nil, fmt.Errorf("Can't encode values of kind %v", v.Kind())
+	}
+}
+
+func encodeFloat(f float64) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return f
+}
+
+func encodeElements(v reflect.Value, pointers []uintptr) (encoded []interface{}, err error) {
+	encoded = make([]interface{}, v.Len())
+	for i := range encoded {
+		if encoded[i], err = encodeValue(v.Index(i), pointers); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Maps are encoded as a list of [key, value] pairs, sorted by encoded key.
+func encodeMap(v reflect.Value, pointers []uintptr) (encoded []interface{}, err error) {
+	type pair struct {
+		sortKey string
+		entry   []interface{}
+	}
+	pairs := make([]pair, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		var key, value interface{}
+		if key, err = encodeValue(iter.Key(), pointers); err != nil {
+			return
+		}
+		if value, err = encodeValue(iter.Value(), pointers); err != nil {
+			return
+		}
+		var sortKey []byte
+		if sortKey, err = json.Marshal(key); err != nil {
+			return
+		}
+		pairs = append(pairs, pair{string(sortKey), []interface{}{key, value}})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].sortKey < pairs[j].sortKey
+	})
+	encoded = make([]interface{}, len(pairs))
+	for i, p := range pairs {
+		encoded[i] = p.entry
+	}
+	return
+}
+
+// Interfaces are encoded as {"type": ..., "value": ...}, plus the message if
+// the value is an error.
+func encodeInterface(v reflect.Value, pointers []uintptr) (encoded interface{}, err error) {
+	elem := v.Elem()
+	value, err := encodeValue(elem, pointers)
+	if err != nil {
+		return
+	}
+	fields := map[string]interface{}{
+		"type":  typeName(elem.Type()),
+		"value": value,
+	}
+	if elem.Type().Implements(errorType) {
+		fields["error"] = elem.Interface().(error).Error()
+	}
+	return fields, nil
+}
+
+// Decodes a tree produced by encodeValue() (after a JSON round-trip with
+// UseNumber) into v, which must be addressable.
+func decodeValue(data interface{}, v reflect.Value) (err error) {
+	if err = subvert.MakeWritable(&v); err != nil {
+		return
+	}
+	if data == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		b, ok := data.(bool)
+		if !ok {
+			return decodeError(data, v)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number, ok := data.(json.Number)
+		if !ok {
+			return decodeError(data, v)
+		}
+		i, err := strconv.ParseInt(number.String(), 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		number, ok := data.(json.Number)
+		if !ok {
+			return decodeError(data, v)
+		}
+		u, err := strconv.ParseUint(number.String(), 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := decodeFloat(data)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Complex64, reflect.Complex128:
+		parts, ok := data.([]interface{})
+		if !ok || len(parts) != 2 {
+			return decodeError(data, v)
+		}
+		re, err := decodeFloat(parts[0])
+		if err != nil {
+			return err
+		}
+		im, err := decodeFloat(parts[1])
+		if err != nil {
+			return err
+		}
+		v.SetComplex(complex(re, im))
+	case reflect.String:
+		s, ok := data.(string)
+		if !ok {
+			return decodeError(data, v)
+		}
+		v.SetString(s)
+	case reflect.Slice:
+		elements, ok := data.([]interface{})
+		if !ok {
+			return decodeError(data, v)
+		}
+		v.Set(reflect.MakeSlice(v.Type(), len(elements), len(elements)))
+		return decodeElements(elements, v)
+	case reflect.Array:
+		elements, ok := data.([]interface{})
+		if !ok || len(elements) != v.Len() {
+			return decodeError(data, v)
+		}
+		return decodeElements(elements, v)
+	case reflect.Map:
+		return decodeMap(data, v)
+	case reflect.Struct:
+		fields, ok := data.(map[string]interface{})
+		if !ok {
+			return decodeError(data, v)
+		}
+		for i := 0; i < v.NumField(); i++ {
+			name := v.Type().Field(i).Name
+			if err = decodeValue(fields[name], v.Field(i)); err != nil {
+				return fmt.Errorf("%v.%v: %w", v.Type(), name, err)
+			}
+		}
+	case reflect.Ptr:
+		pointer := reflect.New(v.Type().Elem())
+		if err = decodeValue(data, pointer.Elem()); err != nil {
+			return
+		}
+		v.Set(pointer)
+	case reflect.Interface:
+		return decodeInterface(data, v)
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		v.Set(reflect.Zero(v.Type()))
+	default:
+		return fmt.Errorf("Can't decode values of kind %v", v.Kind())
+	}
+	return
+}
+
+func decodeFloat(data interface{}) (f float64, err error) {
+	switch data := data.(type) {
+	case json.Number:
+		return data.Float64()
+	case string:
+		switch data {
+		case "NaN":
+			return math.NaN(), nil
+		case "+Inf":
+			return math.Inf(1), nil
+		case "-Inf":
+			return math.Inf(-1), nil
+		}
+	}
+	return 0, fmt.Errorf("Can't decode %v as a float", data)
+}
+
+func decodeElements(elements []interface{}, v reflect.Value) (err error) {
+	for i, element := range elements {
+		if err = decodeValue(element, v.Index(i)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func decodeMap(data interface{}, v reflect.Value) (err error) {
+	pairs, ok := data.([]interface{})
+	if !ok {
+		return decodeError(data, v)
+	}
+	m := reflect.MakeMapWithSize(v.Type(), len(pairs))
+	for _, p := range pairs {
+		entry, ok := p.([]interface{})
+		if !ok || len(entry) != 2 {
+			return decodeError(data, v)
+		}
+		key := reflect.New(v.Type().Key()).Elem()
+		if err = decodeValue(entry[0], key); err != nil {
+			return
+		}
+		value := reflect.New(v.Type().Elem()).Elem()
+		if err = decodeValue(entry[1], value); err != nil {
+			return
+		}
+		m.SetMapIndex(key, value)
+	}
+	v.Set(m)
+	return
+}
+
+func decodeInterface(data interface{}, v reflect.Value) (err error) {
+	fields, ok := data.(map[string]interface{})
+	if !ok {
+		return decodeError(data, v)
+	}
+	name, _ := fields["type"].(string)
+	if t := lookupType(name); t != nil {
+		if !t.AssignableTo(v.Type()) {
+			return fmt.Errorf("Recorded type %v can't be assigned to %v", name, v.Type())
+		}
+		value := reflect.New(t).Elem()
+		if err = decodeValue(fields["value"], value); err != nil {
+			return
+		}
+		v.Set(value)
+		return
+	}
+	if message, ok := fields["error"].(string); ok && errorType.AssignableTo(v.Type()) {
+		v.Set(reflect.ValueOf(errors.New(message)))
+		return
+	}
+	return fmt.Errorf("Can't replay a value of type %v: Use RegisterType() to register it", name)
+}
+
+func decodeError(data interface{}, v reflect.Value) error {
+	return fmt.Errorf("Can't decode %v as %v", data, v.Type())
+}
+
+// Returns a name that identifies t across builds.
+func typeName(t reflect.Type) string {
+	if t.Name() != "" && t.PkgPath() != "" {
+		return t.PkgPath() + "." + t.Name()
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return "*" + typeName(t.Elem())
+	case reflect.Slice:
+		return "[]" + typeName(t.Elem())
+	}
+	return t.String()
+}
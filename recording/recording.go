@@ -0,0 +1,260 @@
+// Package recording records the arguments and results of calls to a function
+// into a file, and replays them in later runs.
+//
+// Record() and Replay() redirect calls to the target (see
+// subvert.RedirectCalls()), so only direct calls are affected. While
+// recording, the original function is called and its results are saved. While
+// replaying, the original function is never called: each call is matched by
+// argument values against the recorded calls, and the recorded results are
+// returned.
+//
+// Values are encoded using reflection, including unexported struct fields, so
+// most plain data round-trips. The exceptions:
+//   - Functions, channels and unsafe pointers are only recorded as being nil or
+//     non-nil, and are replayed as nil.
+//   - Values stored in interfaces are replayed as their original concrete type
+//     only if that type has been registered with RegisterType(). An
+//     unregistered error is replayed as an error with the same message.
+//   - Pointer cycles can't be recorded.
+package recording
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/kstenerud/go-subvert"
+)
+
+type recordedCall struct {
+	Args    []interface{} `json:"args"`
+	Results []interface{} `json:"results"`
+}
+
+type recordingFile struct {
+	Function string          `json:"function"`
+	Calls    []*recordedCall `json:"calls"`
+}
+
+// Record redirects calls to target so that the arguments and results of each
+// call are recorded. When stop is called, the calls are restored, and the
+// recording is written to file as JSON.
+func Record(target interface{}, file string) (stop func() error, err error) {
+	original, err := subvert.AliasFunction(target)
+	if err != nil {
+		return
+	}
+	rOriginal := reflect.ValueOf(original)
+
+	var lock sync.Mutex
+	var encodeErr error
+	recording := &recordingFile{Function: subvert.FunctionName(target)}
+	hook := reflect.MakeFunc(rOriginal.Type(), func(args []reflect.Value) []reflect.Value {
+		results := subvert.CallOriginal(rOriginal, args)
+		call, err := encodeCall(args, results)
+
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			if encodeErr == nil {
+				encodeErr = fmt.Errorf("Could not record call %v to %v: %w", len(recording.Calls)+1, recording.Function, err)
+			}
+		} else {
+			recording.Calls = append(recording.Calls, call)
+		}
+		return results
+	})
+
+	patches := subvert.NewPatchSet().RedirectCalls(target, hook.Interface())
+	if err = patches.Apply(); err != nil {
+		return
+	}
+
+	stop = func() (err error) {
+		if err = patches.Revert(); err != nil {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if encodeErr != nil {
+			return encodeErr
+		}
+		data, err := json.MarshalIndent(recording, "", "  ")
+		if err != nil {
+			return
+		}
+		return os.WriteFile(file, append(data, '\n'), 0644)
+	}
+	return
+}
+
+// Replay redirects calls to target so that they return the results recorded
+// in file by Record(), without calling target. Each call returns the results of
+// the first not-yet-replayed recorded call with the same arguments, or if all
+// of those have been replayed, the last one.
+//
+// A call with arguments that were never recorded panics. stop restores the
+// calls.
+func Replay(target interface{}, file string) (stop func() error, err error) {
+	functionType := reflect.TypeOf(target)
+	if functionType == nil || functionType.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%v is not a function", functionType)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	var recording recordingFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err = decoder.Decode(&recording); err != nil {
+		return nil, fmt.Errorf("Could not parse recording %v: %w", file, err)
+	}
+	if name := subvert.FunctionName(target); recording.Function != name {
+		return nil, fmt.Errorf("Recording %v is of %v, not %v", file, recording.Function, name)
+	}
+
+	calls := make([]*replayableCall, len(recording.Calls))
+	for i, call := range recording.Calls {
+		if calls[i], err = newReplayableCall(functionType, call); err != nil {
+			return nil, fmt.Errorf("Recording %v call %v: %w", file, i+1, err)
+		}
+	}
+
+	var lock sync.Mutex
+	hook := reflect.MakeFunc(functionType, func(args []reflect.Value) []reflect.Value {
+		key, err := encodeKey(args)
+		if err != nil {
+			panic(fmt.Errorf("Could not encode arguments to %v: %w", recording.Function, err))
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		var match *replayableCall
+		for _, call := range calls {
+			if call.key == key {
+				match = call
+				if !call.replayed {
+					break
+				}
+			}
+		}
+		if match == nil {
+			panic(fmt.Errorf("No recorded call to %v matches arguments %v", recording.Function, key))
+		}
+		match.replayed = true
+		return match.results
+	})
+
+	patches := subvert.NewPatchSet().RedirectCalls(target, hook.Interface())
+	if err = patches.Apply(); err != nil {
+		return
+	}
+	stop = patches.Revert
+	return
+}
+
+type replayableCall struct {
+	key      string
+	results  []reflect.Value
+	replayed bool
+}
+
+func newReplayableCall(functionType reflect.Type, call *recordedCall) (replayable *replayableCall, err error) {
+	if len(call.Args) != functionType.NumIn() || len(call.Results) != functionType.NumOut() {
+		return nil, fmt.Errorf("Recorded %v args and %v results, but the function has %v and %v",
+			len(call.Args), len(call.Results), functionType.NumIn(), functionType.NumOut())
+	}
+	key, err := json.Marshal(call.Args)
+	if err != nil {
+		return
+	}
+	replayable = &replayableCall{key: string(key)}
+	for i, data := range call.Results {
+		result := reflect.New(functionType.Out(i)).Elem()
+		if err = decodeValue(data, result); err != nil {
+			return nil, fmt.Errorf("Result %v: %w", i, err)
+		}
+		replayable.results = append(replayable.results, result)
+	}
+	return
+}
+
+func encodeCall(args, results []reflect.Value) (call *recordedCall, err error) {
+	call = &recordedCall{}
+	if call.Args, err = encodeValues(args); err != nil {
+		return
+	}
+	call.Results, err = encodeValues(results)
+	return
+}
+
+// Encodes args into the canonical form used to match calls.
+func encodeKey(args []reflect.Value) (key string, err error) {
+	encoded, err := encodeValues(args)
+	if err != nil {
+		return
+	}
+	// Round-trip through the same decoder used on recordings, so that
+	// numbers compare equal.
+	data, err := json.Marshal(encoded)
+	if err != nil {
+		return
+	}
+	var canonical interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err = decoder.Decode(&canonical); err != nil {
+		return
+	}
+	data, err = json.Marshal(canonical)
+	return string(data), err
+}
+
+func encodeValues(values []reflect.Value) (encoded []interface{}, err error) {
+	encoded = make([]interface{}, len(values))
+	for i, value := range values {
+		if encoded[i], err = encodeValue(value, nil); err != nil {
+			return
+		}
+	}
+	return
+}
+
+var (
+	typeRegistryLock sync.Mutex
+	typeRegistry     = make(map[string]reflect.Type)
+)
+
+// RegisterType registers the concrete type of value, so that interface values
+// of that type can be replayed.
+func RegisterType(value interface{}) {
+	t := reflect.TypeOf(value)
+	typeRegistryLock.Lock()
+	defer typeRegistryLock.Unlock()
+	typeRegistry[typeName(t)] = t
+}
+
+func lookupType(name string) reflect.Type {
+	typeRegistryLock.Lock()
+	defer typeRegistryLock.Unlock()
+	return typeRegistry[name]
+}
+
+func init() {
+	for _, value := range []interface{}{
+		false, "", 0, int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0), uintptr(0),
+		float32(0), float64(0), complex64(0), complex128(0),
+		[]byte{}, []interface{}{}, map[string]interface{}{},
+		errors.New(""), syscall.Errno(0),
+	} {
+		RegisterType(value)
+	}
+}
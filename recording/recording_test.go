@@ -0,0 +1,134 @@
+package recording
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+type request struct {
+	Path    string
+	headers map[string]string
+	retries *int
+}
+
+type response struct {
+	Status int
+	body   []byte
+	ratio  float64
+}
+
+var fetchCalls int
+
+//go:noinline
+func fetch(req request) (*response, error) {
+	fetchCalls++
+	if req.Path == "/missing" {
+		return nil, syscall.ENOENT
+	}
+	if req.Path == "/fail" {
+		return nil, fmt.Errorf("Failed to fetch %v", req.Path)
+	}
+	return &response{Status: 200, body: []byte("body of " + req.Path + req.headers["x"]), ratio: 0.5}, nil
+}
+
+//go:noinline
+func fetchAll() (results []string) {
+	retries := 3
+	for _, path := range []string{"/a", "/b", "/missing", "/fail", "/a"} {
+		resp, err := fetch(request{Path: path, headers: map[string]string{"x": "y", "a": "b"}, retries: &retries})
+		if err != nil {
+			results = append(results, err.Error())
+		} else {
+			results = append(results, fmt.Sprintf("%v %s %v", resp.Status, resp.body, resp.ratio))
+		}
+	}
+	return
+}
+
+func TestRecordReplay(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestRecordReplay because it doesn't work in test binaries on this platform.\n")
+		return
+	}
+
+	file := filepath.Join(t.TempDir(), "fetch.json")
+	stop, err := Record(fetch, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fetchAll()
+	if err = stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"headers"`) {
+		t.Errorf("Expected unexported fields to be recorded:\n%s", data)
+	}
+
+	// Recording the same calls again must produce identical output
+	stop, err = Record(fetch, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchAll()
+	if err = stop(); err != nil {
+		t.Fatal(err)
+	}
+	data2, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(data2) {
+		t.Errorf("Expected deterministic output, but got:\n%s\nand:\n%s", data, data2)
+	}
+
+	fetchCalls = 0
+	stop, err = Replay(fetch, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := fetchAll()
+	if err = stop(); err != nil {
+		t.Fatal(err)
+	}
+	if fetchCalls != 0 {
+		t.Errorf("Expected the original function not to be called during replay, but it was called %v times", fetchCalls)
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
+func TestReplayUnknownCall(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestReplayUnknownCall because it doesn't work in test binaries on this platform.\n")
+		return
+	}
+
+	file := filepath.Join(t.TempDir(), "fetch.json")
+	if err := os.WriteFile(file, []byte(`{"function": "github.com/kstenerud/go-subvert/recording.fetch", "calls": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stop, err := Replay(fetch, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := stop(); err != nil {
+			t.Error(err)
+		}
+		if recover() == nil {
+			t.Errorf("Expected a panic for an unrecorded call")
+		}
+	}()
+	fetchAll()
+}
@@ -2,8 +2,8 @@ package subvert
 
 import (
 	"fmt"
-	"log"
 	"reflect"
+	"sync"
 	"unsafe"
 )
 
@@ -29,15 +29,19 @@ type rvFlagTester struct {
 	// Note: flagRO = flagStickyRO | flagEmbedRO as of go 1.5
 }
 
+var reflectValueInitOnce sync.Once
+
 func initReflectValue() {
-	initReflectValueFlags()
+	reflectValueInitOnce.Do(initReflectValueFlags)
 }
 
 func initReflectValueFlags() {
 	fail := func(reason string) {
 		rvFlagsFound = false
-		log.Println(fmt.Sprintf("reflect.Value flags could not be determined because %v."+
-			"Please open an issue at https://github.com/kstenerud/go-subvert/issues", reason))
+		rvFlagsError = fmt.Errorf("This function is disabled because reflect.Value flags could not be determined: "+
+			"%v. Please open an issue at https://github.com/kstenerud/go-subvert/issues", reason)
+		logf("go-subvert: reflect.Value flags could not be determined because %v. "+
+			"Please open an issue at https://github.com/kstenerud/go-subvert/issues", reason)
 	}
 	getFlag := func(v reflect.Value) uintptr {
 		return uintptr(reflect.ValueOf(v).FieldByName("flag").Uint())
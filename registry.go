@@ -0,0 +1,198 @@
+package subvert
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Patches that haven't been reverted, in the order they were applied.
+	// This also keeps alive anything that they refer to.
+	activePatches     []*Patch
+	patchRegistryLock sync.Mutex
+)
+
+// ActivePatches returns every patch that is currently applied, in the order
+// they were applied. This includes patches made via PatchMemory(),
+// ReplaceFunction(), RedirectCalls(), WriteVariable() and PatchSet.
+func ActivePatches() []*Patch {
+	patchRegistryLock.Lock()
+	defer patchRegistryLock.Unlock()
+	return append([]*Patch{}, activePatches...)
+}
+
+// RestoreAll reverts every active patch, most recent first. It carries on past
+// failures, returning the first error encountered.
+func RestoreAll() (err error) {
+	patches := ActivePatches()
+	for i := len(patches) - 1; i >= 0; i-- {
+		if revertErr := patches[i].Revert(); revertErr != nil && err == nil {
+			err = revertErr
+		}
+	}
+	return
+}
+
+// PatchOverlapError is returned when a patch would overwrite memory that an
+// active patch has already modified. Patches made by PatchMemory() are not
+// checked for overlaps.
+type PatchOverlapError struct {
+	Address  uintptr
+	Length   int
+	Existing *Patch
+}
+
+func (e *PatchOverlapError) Error() string {
+	return fmt.Sprintf("Patch at %#x (%v bytes) overlaps an active %v", e.Address, e.Length, e.Existing)
+}
+
+// Patches that are being applied, whose memory is reserved so that the
+// registry lock doesn't have to be held while writing.
+var pendingPatches []*Patch
+
+// Apply a patch and record it in the registry. Unless it's a raw memory
+// patch, it's refused if it overlaps an active or pending patch.
+func registerPatch(kind PatchKind, address uintptr, length int, apply func() (*Patch, error)) (p *Patch, err error) {
+	pending := &Patch{
+		Kind:    kind,
+		Address: address,
+		Patched: make([]byte, length),
+		Time:    time.Now(),
+		Stack:   captureCallerStack(),
+	}
+	if symbol, symErr := symbolize(address, false); symErr == nil {
+		pending.Symbol = symbol.String()
+	}
+	if err = reservePatch(pending); err != nil {
+		return
+	}
+
+	p, err = apply()
+
+	patchRegistryLock.Lock()
+	defer patchRegistryLock.Unlock()
+	removePatch(&pendingPatches, pending)
+	if err != nil {
+		return
+	}
+	p.Kind = kind
+	p.Time = pending.Time
+	p.Stack = pending.Stack
+	p.Symbol = pending.Symbol
+	activePatches = append(activePatches, p)
+	return
+}
+
+func reservePatch(pending *Patch) error {
+	if pending.Kind == PatchKindMemory {
+		return nil
+	}
+
+	patchRegistryLock.Lock()
+	defer patchRegistryLock.Unlock()
+	length := len(pending.Patched)
+	if existing := findOverlappingPatch(pending.Address, length); existing != nil {
+		return &PatchOverlapError{
+			Address:  pending.Address,
+			Length:   length,
+			Existing: existing,
+		}
+	}
+	pendingPatches = append(pendingPatches, pending)
+	return nil
+}
+
+// Must be called while holding the registry lock.
+func unregisterPatch(p *Patch) {
+	removePatch(&activePatches, p)
+}
+
+func removePatch(patches *[]*Patch, p *Patch) {
+	for i, existing := range *patches {
+		if existing == p {
+			*patches = append((*patches)[:i], (*patches)[i+1:]...)
+			return
+		}
+	}
+}
+
+// Must be called while holding the registry lock.
+func findOverlappingPatch(address uintptr, length int) *Patch {
+	end := address + uintptr(length)
+	for _, patches := range [][]*Patch{activePatches, pendingPatches} {
+		for _, p := range patches {
+			if p.Kind == PatchKindMemory {
+				continue
+			}
+			pEnd := p.Address + uintptr(len(p.Patched))
+			if address < pEnd && p.Address < end {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// PatchMemory writing a patch's original contents back over it counts as
+// reverting that patch, since that's how PatchMemory() has always been undone.
+func patchMemory(address uintptr, patch []byte) (oldMemory []byte, err error) {
+	if p := findRawPatchUndoneBy(address, patch); p != nil {
+		oldMemory = append([]byte{}, p.Patched...)
+		err = p.Revert()
+		return
+	}
+
+	p, err := applyPatch(PatchKindMemory, address, patch, nil)
+	if err != nil {
+		return
+	}
+	oldMemory = append([]byte{}, p.Original...)
+	return
+}
+
+func findRawPatchUndoneBy(address uintptr, patch []byte) *Patch {
+	patchRegistryLock.Lock()
+	defer patchRegistryLock.Unlock()
+
+	for _, p := range activePatches {
+		if p.Kind == PatchKindMemory && p.Address == address &&
+			string(p.Original) == string(patch) &&
+			verifyMemory(p.Address, p.Patched) == nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// Capture the stack of whoever called into this package.
+func captureCallerStack() []uintptr {
+	pcs := make([]uintptr, 32)
+	pcs = pcs[:runtime.Callers(2, pcs)]
+
+	frames := runtime.CallersFrames(pcs)
+	skip := 0
+	for {
+		frame, more := frames.Next()
+		if !isInternalFrame(frame) {
+			break
+		}
+		skip++
+		if !more {
+			break
+		}
+	}
+	if skip >= len(pcs) {
+		return pcs
+	}
+	return pcs[skip:]
+}
+
+func isInternalFrame(frame runtime.Frame) bool {
+	return strings.HasPrefix(frame.Function, packagePath+".") &&
+		!strings.HasSuffix(frame.File, "_test.go")
+}
+
+const packagePath = "github.com/kstenerud/go-subvert"
@@ -0,0 +1,244 @@
+package subvert
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// ReplaceFunction patches the beginning of a function with a jump to
+// replacement, so that every call to function (direct, indirect, or via an
+// interface) runs replacement instead. The original implementation can no
+// longer be called until the patch is reverted.
+//
+// replacement must have the same type as function, and may be a closure.
+// Calls that the compiler inlined are not affected. Build with
+// -gcflags=all=-l to disable inlining.
+func ReplaceFunction(function, replacement interface{}) (patch *Patch, err error) {
+	return replaceFunction(function, nil, replacement)
+}
+
+// ReplaceFunctionIfMatches is the same as ReplaceFunction(), but first checks
+// that the function begins with the expected bytes. If it doesn't, a
+// *PatchMismatchError is returned and nothing is patched.
+func ReplaceFunctionIfMatches(function interface{}, expected []byte, replacement interface{}) (patch *Patch, err error) {
+	if expected == nil {
+		expected = []byte{}
+	}
+	return replaceFunction(function, expected, replacement)
+}
+
+// RedirectCalls patches every direct call to function so that it calls
+// replacement instead. Unlike ReplaceFunction(), function itself remains
+// intact, and can still be called indirectly (for example via
+// AliasFunction()). This allows replacement to call the original function.
+//
+// replacement must have the same type as function, and may be a closure.
+// Indirect calls and calls that the compiler inlined are not affected.
+func RedirectCalls(function, replacement interface{}) (patches []*Patch, err error) {
+	return redirectCalls(function, nil, replacement)
+}
+
+// RedirectCallsIfMatches is the same as RedirectCalls(), but first checks that
+// the function begins with the expected bytes, and that every call site still
+// calls it. If not, a *PatchMismatchError is returned and nothing is patched.
+func RedirectCallsIfMatches(function interface{}, expected []byte, replacement interface{}) (patches []*Patch, err error) {
+	if expected == nil {
+		expected = []byte{}
+	}
+	return redirectCalls(function, expected, replacement)
+}
+
+func replaceFunction(function interface{}, expected []byte, replacement interface{}) (patch *Patch, err error) {
+	r, err := prepareReplaceFunction(function, expected, replacement)
+	if err != nil {
+		return
+	}
+	return r.apply()
+}
+
+func redirectCalls(function interface{}, expected []byte, replacement interface{}) (patches []*Patch, err error) {
+	r, err := prepareRedirectCalls(function, expected, replacement)
+	if err != nil {
+		return
+	}
+	return r.apply()
+}
+
+// A validated function replacement, ready to apply.
+type functionReplacement struct {
+	address     uintptr
+	expected    []byte
+	code        []byte
+	replacement interface{}
+}
+
+// If expected is nil, no checks are made.
+func prepareReplaceFunction(function interface{}, expected []byte, replacement interface{}) (r *functionReplacement, err error) {
+	address, funcval, err := getReplacementAddresses(function, replacement)
+	if err != nil {
+		return
+	}
+
+	code, err := osMakeJumpToFuncval(funcval)
+	if err != nil {
+		return
+	}
+
+	symbol, err := GetFunctionSymbol(function)
+	if err != nil {
+		return
+	}
+	if symbol.End-symbol.Entry < uint64(len(code)) {
+		err = fmt.Errorf("%v is too small (%v bytes) to be replaced", symbol.Name, symbol.End-symbol.Entry)
+		return
+	}
+
+	if expected != nil {
+		if err = verifyMemory(address, expected); err != nil {
+			return
+		}
+	}
+
+	r = &functionReplacement{
+		address:     address,
+		expected:    expected,
+		code:        code,
+		replacement: replacement,
+	}
+	return
+}
+
+func (r *functionReplacement) apply() (patch *Patch, err error) {
+	// Check again in case something else patched it since validation.
+	if r.expected != nil {
+		if err = verifyMemory(r.address, r.expected); err != nil {
+			return
+		}
+	}
+	return applyPatch(PatchKindFunctionReplacement, r.address, r.code, r.replacement)
+}
+
+// A validated call redirection, ready to apply.
+type callRedirection struct {
+	sites       []uintptr
+	funcval     uintptr
+	replacement interface{}
+}
+
+// If expected is nil, no checks are made.
+func prepareRedirectCalls(function interface{}, expected []byte, replacement interface{}) (r *callRedirection, err error) {
+	address, funcval, err := getReplacementAddresses(function, replacement)
+	if err != nil {
+		return
+	}
+
+	sites, err := osGetCallSites(address)
+	if err != nil {
+		return
+	}
+
+	if expected != nil {
+		if err = verifyMemory(address, expected); err != nil {
+			return
+		}
+		for _, site := range sites {
+			if err = verifyMemory(site, osMakeCallArg(site, address)); err != nil {
+				return
+			}
+		}
+	}
+
+	r = &callRedirection{
+		sites:       sites,
+		funcval:     funcval,
+		replacement: replacement,
+	}
+	return
+}
+
+func (r *callRedirection) apply() (patches []*Patch, err error) {
+	stub, err := newRedirectStub(r.funcval, len(r.sites))
+	if err != nil {
+		return
+	}
+
+	for _, site := range r.sites {
+		var patch *Patch
+		if patch, err = applyPatch(PatchKindCallRedirection, site, osMakeCallArg(site, stub.address), r.replacement); err != nil {
+			// Call sites that couldn't be restored still jump to the stub, so
+			// it has to be leaked.
+			if rollbackErr := revertPatches(patches); rollbackErr != nil {
+				return nil, fmt.Errorf("%v (rollback also failed: %w)", err, rollbackErr)
+			}
+			stub.release(len(r.sites) - len(patches))
+			return nil, err
+		}
+		patch.onRevert = func() { stub.release(1) }
+		patches = append(patches, patch)
+	}
+	return
+}
+
+// Get the address of function's code, and the address of replacement's
+// function value (which includes the closure context).
+func getReplacementAddresses(function, replacement interface{}) (address uintptr, funcval uintptr, err error) {
+	fType := reflect.TypeOf(function)
+	rType := reflect.TypeOf(replacement)
+	if fType == nil || fType.Kind() != reflect.Func {
+		err = fmt.Errorf("%v is not a function", fType)
+		return
+	}
+	if rType != fType {
+		err = fmt.Errorf("Replacement type %v doesn't match function type %v", rType, fType)
+		return
+	}
+	if reflect.ValueOf(replacement).IsNil() {
+		err = fmt.Errorf("Replacement function is nil")
+		return
+	}
+
+	if address, err = getFunctionAddress(function); err != nil {
+		return
+	}
+	funcval = getFuncvalAddress(replacement)
+	return
+}
+
+// A stub that jumps to a replacement function, shared by the call sites that
+// are redirected to it.
+type redirectStub struct {
+	address    uintptr
+	references int
+	lock       sync.Mutex
+}
+
+func newRedirectStub(funcval uintptr, references int) (stub *redirectStub, err error) {
+	code, err := osMakeJumpToFuncval(funcval)
+	if err != nil {
+		return
+	}
+	return newStub(code, references)
+}
+
+func newStub(code []byte, references int) (stub *redirectStub, err error) {
+	address, err := osAllocateStub(code)
+	if err != nil {
+		return
+	}
+	stub = &redirectStub{
+		address:    address,
+		references: references,
+	}
+	return
+}
+
+func (s *redirectStub) release(count int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.references -= count
+	if s.references <= 0 {
+		osFreeStub(s.address)
+	}
+}
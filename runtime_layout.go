@@ -0,0 +1,129 @@
+package subvert
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Offsets of the runtime's internal struct fields, keyed by go release. These
+// are only valid on 64-bit platforms.
+var runtimeLayouts = map[string]map[string]uintptr{
+	"go1.27": {
+		"g.stack.lo":      0,
+		"g.stack.hi":      8,
+		"g.atomicstatus":  144,
+		"g.goid":          152,
+		"g.waitsince":     168,
+		"g.waitreason":    176,
+		"g.parentGoid":    280,
+		"g.gopc":          288,
+		"g.startpc":       304,
+		"g.labels":        352,
+		"mspan.startAddr": 24,
+		"mspan.npages":    32,
+		"mspan.spanclass": 98,
+		"mspan.elemsize":  104,
+	},
+}
+
+// Values of runtime.g.atomicstatus
+const (
+	gStatusDead      = 6
+	gStatusDeadExtra = 11
+	gStatusScan      = 0x1000
+)
+
+func isGStatusDead(status uint32) bool {
+	return status == gStatusDead || status == gStatusDeadExtra
+}
+
+// StructField describes a field of a struct, as found by GetStructField().
+type StructField struct {
+	Name string
+	// Offset from the start of the outermost struct
+	Offset uintptr
+	// Size and Type come from DWARF debug info. Fields from the built-in
+	// layout tables have size 0 and no type.
+	Size uintptr
+	Type string
+}
+
+// GetStructField gets the offset and type of a field of a named struct, for
+// example GetStructField("runtime.g", "goid"). Fields of embedded or nested
+// structs are separated by dots (such as "stack.lo").
+//
+// Layouts are read from the executable's DWARF debug info. If the executable
+// has no debug info (for example when built with -ldflags=-w, or by go test),
+// runtime structs fall back to a table of known layouts for the running go
+// version.
+func GetStructField(structName, fieldPath string) (field StructField, err error) {
+	layouts, dwarfErr := getDWARFLayouts()
+	if dwarfErr == nil {
+		return layouts.getField(structName, fieldPath)
+	}
+
+	runtimeStruct := strings.TrimPrefix(structName, "runtime.")
+	if runtimeStruct == structName {
+		err = fmt.Errorf("Could not read layout of %v: %w", structName, dwarfErr)
+		return
+	}
+	offset, err := getTableFieldOffset(runtimeStruct + "." + fieldPath)
+	if err != nil {
+		err = fmt.Errorf("%w (and DWARF is unavailable: %v)", err, dwarfErr)
+		return
+	}
+	field = StructField{Name: fieldPath, Offset: offset}
+	return
+}
+
+// Get the offset of a runtime struct field, such as "g.goid".
+func getRuntimeFieldOffset(field string) (offset uintptr, err error) {
+	parts := strings.SplitN(field, ".", 2)
+	if len(parts) != 2 {
+		err = fmt.Errorf("%v is not a struct field", field)
+		return
+	}
+	structField, err := GetStructField("runtime."+parts[0], parts[1])
+	offset = structField.Offset
+	return
+}
+
+func getRuntimeLayout() (layout map[string]uintptr, err error) {
+	version := runtime.Version()
+	if !is64BitUintptr {
+		err = fmt.Errorf("Runtime struct layouts are not known for 32-bit platforms")
+		return
+	}
+	for release, candidate := range runtimeLayouts {
+		if version == release || strings.HasPrefix(version, release+".") {
+			layout = candidate
+			return
+		}
+	}
+	err = fmt.Errorf("Runtime struct layouts are not known for go version %v", version)
+	return
+}
+
+func getTableFieldOffset(field string) (offset uintptr, err error) {
+	layout, err := getRuntimeLayout()
+	if err != nil {
+		return
+	}
+	offset, ok := layout[field]
+	if !ok {
+		err = fmt.Errorf("Offset of runtime field %v is not known for go version %v", field, runtime.Version())
+	}
+	return
+}
+
+// Get the offsets of multiple runtime struct fields, failing if any are missing.
+func getRuntimeFieldOffsets(fields ...string) (offsets []uintptr, err error) {
+	offsets = make([]uintptr, len(fields))
+	for i, field := range fields {
+		if offsets[i], err = getRuntimeFieldOffset(field); err != nil {
+			return
+		}
+	}
+	return
+}
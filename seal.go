@@ -0,0 +1,208 @@
+package subvert
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+type sealedObject struct {
+	name     string
+	address  uintptr
+	size     uintptr
+	original unsafe.Pointer // Keeps the original (and what it points to) alive
+	copied   bool           // The object was copied to pages allocated by SealNamed()
+	isSealed bool
+	// The pages' protections before sealing, restored when an object that
+	// wasn't copied is unsealed.
+	oldProtections []Protection
+}
+
+var (
+	sealedObjects     = make(map[uintptr]*sealedObject)
+	sealedObjectsLock sync.Mutex
+)
+
+// Seal makes an object read-only, so that any attempt to write to it will
+// fault. This is useful for catching stray writes to configuration objects or
+// tables that must not change after initialization.
+//
+// Memory protection works on whole pages, so if the object doesn't occupy
+// whole pages of its own, it's first copied to newly allocated pages and the
+// copy is sealed instead. sealed points to whichever memory was sealed, and
+// must be used in place of the original from then on. The copy isn't scanned
+// by the garbage collector, so the original is kept alive to keep anything it
+// points to alive until Release() is called. Don't modify the original.
+//
+// The object is named after the symbol it was found in, if any. Use
+// SealNamed() to give it a name yourself.
+func Seal(pointer unsafe.Pointer, size uintptr) (sealed unsafe.Pointer, err error) {
+	name := fmt.Sprintf("object at %#x", uintptr(pointer))
+	if symbol, symErr := symbolize(uintptr(pointer), false); symErr == nil {
+		name = symbol.String()
+	}
+	return SealNamed(name, pointer, size)
+}
+
+// SealNamed is the same as Seal(), but names the object for use in fault
+// reports.
+func SealNamed(name string, pointer unsafe.Pointer, size uintptr) (sealed unsafe.Pointer, err error) {
+	if size == 0 {
+		err = fmt.Errorf("Cannot seal %v: size is 0", name)
+		return
+	}
+
+	sealedObjectsLock.Lock()
+	defer sealedObjectsLock.Unlock()
+
+	if err = initProcess(); err != nil {
+		return
+	}
+	address := uintptr(pointer)
+	pageSizeMask := uintptr(pageSize - 1)
+	copied := false
+	if address&pageSizeMask != 0 || size&pageSizeMask != 0 {
+		allocSize := (size + pageSizeMask) & ^pageSizeMask
+		if address, err = osAllocatePages(allocSize); err != nil {
+			return
+		}
+		copy(SliceAtAddress(address, int(size)), SliceAtAddress(uintptr(pointer), int(size)))
+		size = allocSize
+		copied = true
+	}
+
+	oldProtections, err := Protect(address, size, ProtectionR)
+	if err != nil {
+		if copied {
+			osFreePages(address, size)
+		}
+		return
+	}
+
+	sealedObjects[address] = &sealedObject{
+		name:           name,
+		address:        address,
+		size:           size,
+		original:       pointer,
+		copied:         copied,
+		isSealed:       true,
+		oldProtections: oldProtections,
+	}
+	sealed = unsafe.Pointer(address)
+	return
+}
+
+// Unseal makes a sealed object writable again. If it was sealed in place, its
+// pages get back the protection they had before it was sealed. sealed must be
+// the pointer returned by Seal().
+//
+// If the object was copied, the copy remains in use (and the original is kept
+// alive) until Release() is called.
+func Unseal(sealed unsafe.Pointer) (err error) {
+	sealedObjectsLock.Lock()
+	defer sealedObjectsLock.Unlock()
+
+	object, ok := sealedObjects[uintptr(sealed)]
+	if !ok || !object.isSealed {
+		err = fmt.Errorf("%#x is not a sealed object", uintptr(sealed))
+		return
+	}
+
+	if err = object.unprotect(); err != nil {
+		return
+	}
+	object.isSealed = false
+	if !object.copied {
+		delete(sealedObjects, object.address)
+	}
+	return
+}
+
+// Release unseals an object if it's still sealed, and frees the pages it was
+// copied to, if any. sealed must be the pointer returned by Seal(), and must
+// not be used afterwards if the object was copied.
+func Release(sealed unsafe.Pointer) (err error) {
+	sealedObjectsLock.Lock()
+	defer sealedObjectsLock.Unlock()
+
+	object, ok := sealedObjects[uintptr(sealed)]
+	if !ok {
+		err = fmt.Errorf("%#x is not a sealed object", uintptr(sealed))
+		return
+	}
+
+	if object.copied {
+		err = osFreePages(object.address, object.size)
+	} else {
+		err = object.unprotect()
+	}
+	if err != nil {
+		return
+	}
+	delete(sealedObjects, object.address)
+	return
+}
+
+// Copies are made writable, and objects sealed in place get their pages' old
+// protections back.
+func (o *sealedObject) unprotect() (err error) {
+	if o.copied {
+		_, err = Protect(o.address, o.size, ProtectionRW)
+		return
+	}
+	return restorePageProtections(o.address, o.oldProtections)
+}
+
+// SealViolationError describes an attempted write to a sealed object.
+type SealViolationError struct {
+	Name    string
+	Address uintptr
+	Offset  uintptr
+	Fault   interface{}
+}
+
+func (e *SealViolationError) Error() string {
+	return fmt.Sprintf("Illegal write to sealed object %v (offset %#x, address %#x): %v",
+		e.Name, e.Offset, e.Address, e.Fault)
+}
+
+// ExplainSealViolation must be called via defer. If the goroutine is panicking
+// because of a write to a sealed object, it panics again with a
+// *SealViolationError naming the object. All other panics are passed through.
+//
+// Faults only cause panics if debug.SetPanicOnFault(true) has been called on
+// the goroutine. Otherwise they crash the program.
+//
+// Example:
+//   defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+//   defer subvert.ExplainSealViolation()
+func ExplainSealViolation() {
+	e := recover()
+	if e == nil {
+		return
+	}
+
+	if address, ok := getFaultAddress(e); ok {
+		if object := findSealedObjectContaining(address); object != nil {
+			panic(&SealViolationError{
+				Name:    object.name,
+				Address: address,
+				Offset:  address - object.address,
+				Fault:   e,
+			})
+		}
+	}
+	panic(e)
+}
+
+func findSealedObjectContaining(address uintptr) *sealedObject {
+	sealedObjectsLock.Lock()
+	defer sealedObjectsLock.Unlock()
+
+	for _, object := range sealedObjects {
+		if object.isSealed && address >= object.address && address < object.address+object.size {
+			return object
+		}
+	}
+	return nil
+}
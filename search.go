@@ -0,0 +1,191 @@
+package subvert
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Search scans every readable region of this process's memory for pattern,
+// returning the address of each match.
+//
+// mask marks which bits of each pattern byte are significant: a mask byte of
+// 0xff must match exactly, and a mask byte of 0x00 matches anything. If mask
+// is nil, every byte must match exactly.
+//
+// If filter is not nil, only regions for which it returns true are searched.
+//
+// Regions that become unreadable during the search (for example because they
+// were unmapped) are skipped rather than crashing the process. The pattern's
+// own backing memory is excluded from the results, but other copies of it
+// (such as the string it was built from) are not.
+func Search(pattern []byte, mask []byte, filter func(region MemoryRegion) bool) (matches []uintptr, err error) {
+	if len(pattern) == 0 {
+		err = fmt.Errorf("Search pattern is empty")
+		return
+	}
+	if mask != nil && len(mask) != len(pattern) {
+		err = fmt.Errorf("Search mask length %v doesn't match pattern length %v", len(mask), len(pattern))
+		return
+	}
+
+	regions, err := GetMemoryMap()
+	if err != nil {
+		return
+	}
+
+	patternAddress := GetSliceAddr(pattern)
+	for _, region := range regions {
+		if !region.Readable || region.Length() < uintptr(len(pattern)) {
+			continue
+		}
+		if filter != nil && !filter(region) {
+			continue
+		}
+		searchRegion(region.Start, region.End, pattern, mask, func(address uintptr) {
+			if address != patternAddress {
+				matches = append(matches, address)
+			}
+		})
+	}
+	return
+}
+
+// ParseSearchPattern converts a signature string such as "48 8b ?? ?? 0? c3"
+// into a pattern and mask suitable for Search(). Bytes are written in hex and
+// separated by whitespace. A "?" in place of a hex digit matches any value.
+func ParseSearchPattern(signature string) (pattern []byte, mask []byte, err error) {
+	for _, field := range strings.Fields(signature) {
+		if len(field) != 2 {
+			err = fmt.Errorf("Invalid search pattern byte [%v]: must be 2 hex digits", field)
+			return
+		}
+
+		var value, valueMask byte
+		for _, digit := range field {
+			value <<= 4
+			valueMask <<= 4
+			if digit == '?' {
+				continue
+			}
+			var nybble uint64
+			if nybble, err = strconv.ParseUint(string(digit), 16, 8); err != nil {
+				err = fmt.Errorf("Invalid search pattern byte [%v]: %v", field, err)
+				return
+			}
+			value |= byte(nybble)
+			valueMask |= 0xf
+		}
+		pattern = append(pattern, value)
+		mask = append(mask, valueMask)
+	}
+
+	if len(pattern) == 0 {
+		err = fmt.Errorf("Search pattern is empty")
+	}
+	return
+}
+
+// Search [start, end) one chunk at a time, skipping past any pages that fault.
+func searchRegion(start, end uintptr, pattern, mask []byte, onMatch func(address uintptr)) {
+	const chunkSize = 0x100000
+	initProcess()
+	overlap := uintptr(len(pattern) - 1)
+
+	for start+overlap < end {
+		chunkEnd := start + chunkSize + overlap
+		if chunkEnd > end || chunkEnd < start {
+			chunkEnd = end
+		}
+
+		faultAddress, faulted := searchChunk(start, chunkEnd, pattern, mask, onMatch)
+		if faulted {
+			start = (faultAddress & pageBeginMask) + uintptr(pageSize)
+			if start <= faultAddress {
+				return
+			}
+			continue
+		}
+		if chunkEnd == end {
+			return
+		}
+		start = chunkEnd - overlap
+	}
+}
+
+func searchChunk(start, end uintptr, pattern, mask []byte, onMatch func(address uintptr)) (faultAddress uintptr, faulted bool) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if e := recover(); e != nil {
+			faultAddress, faulted = getFaultAddress(e)
+			if !faulted {
+				panic(e)
+			}
+		}
+	}()
+
+	chunk := SliceAtAddress(start, int(end-start))
+	for offset := 0; offset <= len(chunk)-len(pattern); {
+		index := indexMasked(chunk[offset:], pattern, mask)
+		if index < 0 {
+			break
+		}
+		onMatch(start + uintptr(offset+index))
+		offset += index + 1
+	}
+	return
+}
+
+// Get the faulting address from a panic caused by SetPanicOnFault.
+func getFaultAddress(e interface{}) (address uintptr, ok bool) {
+	if _, isRuntimeError := e.(runtime.Error); !isRuntimeError {
+		return
+	}
+	if addressable, hasAddr := e.(interface{ Addr() uintptr }); hasAddr {
+		return addressable.Addr(), true
+	}
+	return
+}
+
+// Find the index of the first occurrence of pattern in data, comparing only
+// the bits set in mask.
+func indexMasked(data, pattern, mask []byte) int {
+	if mask == nil {
+		return bytes.Index(data, pattern)
+	}
+
+	anchor := -1
+	for i, m := range mask {
+		if m == 0xff {
+			anchor = i
+			break
+		}
+	}
+
+	last := len(data) - len(pattern)
+	for start := 0; start <= last; start++ {
+		if anchor >= 0 {
+			next := bytes.IndexByte(data[start+anchor:last+anchor+1], pattern[anchor])
+			if next < 0 {
+				return -1
+			}
+			start += next
+		}
+		if matchesMasked(data[start:start+len(pattern)], pattern, mask) {
+			return start
+		}
+	}
+	return -1
+}
+
+func matchesMasked(data, pattern, mask []byte) bool {
+	for i, b := range pattern {
+		if (data[i]^b)&mask[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -29,8 +29,10 @@ func main() {
 		TestAddressable,
 		TestAliasFunction,
 		TestExposeFunction,
+		TestGetStructField,
 		TestPatchMemory,
 		TestSliceAddr,
+		TestSymbolize,
 		TestWritable,
 	}) {
 		fmt.Printf("Tests failed\n")
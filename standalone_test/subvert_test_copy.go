@@ -159,3 +159,58 @@ func TestAliasFunction() (err error) {
 	}
 	return
 }
+
+var symbolizeTestVar = [4]uintptr{1, 2, 3, 4}
+
+func TestSymbolize() (err error) {
+	fAddr := reflect.ValueOf(zFunc).Pointer()
+	symbol, err := subvert.Symbolize(fAddr + 1)
+	if err != nil {
+		return
+	}
+	expectedName := "main.zFunc"
+	if symbol.Kind != subvert.SymbolKindFunction || symbol.Name != expectedName || symbol.Offset != 1 {
+		return fmt.Errorf("Expected function %v+0x1 but got %v %v", expectedName, symbol.Kind, symbol)
+	}
+
+	vAddr := uintptr(unsafe.Pointer(&symbolizeTestVar[2]))
+	if symbol, err = subvert.Symbolize(vAddr); err != nil {
+		return
+	}
+	expectedName = "main.symbolizeTestVar"
+	if symbol.Kind != subvert.SymbolKindData || symbol.Name != expectedName {
+		return fmt.Errorf("Expected data %v but got %v %v", expectedName, symbol.Kind, symbol)
+	}
+	return
+}
+
+type structFieldTestStruct struct {
+	a     uint8
+	inner struct {
+		b uint16
+		c int64
+	}
+}
+
+// Only types of values that exist at runtime have DWARF info.
+var structFieldTestValue = &structFieldTestStruct{a: 1}
+
+func TestGetStructField() (err error) {
+	s := structFieldTestValue
+	field, err := subvert.GetStructField("main.structFieldTestStruct", "inner.c")
+	if err != nil {
+		return
+	}
+	expectedOffset := uintptr(unsafe.Pointer(&s.inner.c)) - uintptr(unsafe.Pointer(s))
+	if field.Offset != expectedOffset || field.Size != 8 || field.Type != "int64" {
+		return fmt.Errorf("Expected int64 of size 8 at offset %v but got %v", expectedOffset, field)
+	}
+
+	if field, err = subvert.GetStructField("runtime.g", "goid"); err != nil {
+		return
+	}
+	if field.Type != "uint64" {
+		return fmt.Errorf("Expected runtime.g.goid to be uint64 but got %v", field.Type)
+	}
+	return
+}
@@ -0,0 +1,77 @@
+// +build 386 amd64
+
+package subvert
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	stubPoolSize = 0x4000
+	stubSize     = 16
+)
+
+// Implemented in assembly
+func stubPoolAddress() uintptr
+
+var (
+	stubsUsed     [stubPoolSize / stubSize]bool
+	stubSlots     = make(map[int]int)
+	stubsLock     sync.Mutex
+	stubsPoolBase uintptr
+)
+
+// Copy code into free stub slots (using as many consecutive slots as needed),
+// returning its address.
+func allocateStub(code []byte) (address uintptr, err error) {
+	slots := (len(code) + stubSize - 1) / stubSize
+	if slots == 0 {
+		slots = 1
+	}
+
+	stubsLock.Lock()
+	defer stubsLock.Unlock()
+
+	if stubsPoolBase == 0 {
+		stubsPoolBase = stubPoolAddress()
+	}
+
+	free := 0
+	for i, used := range stubsUsed {
+		if used {
+			free = 0
+			continue
+		}
+		if free++; free < slots {
+			continue
+		}
+		first := i - slots + 1
+		address = stubsPoolBase + uintptr(first*stubSize)
+		if _, err = writeMemory(address, code); err != nil {
+			return
+		}
+		for j := first; j <= i; j++ {
+			stubsUsed[j] = true
+		}
+		stubSlots[first] = slots
+		return
+	}
+	err = fmt.Errorf("No room for a %v byte stub (pool size %v)", len(code), stubPoolSize)
+	return
+}
+
+// Return a stub to the pool. It must no longer be reachable.
+func freeStub(address uintptr) {
+	stubsLock.Lock()
+	defer stubsLock.Unlock()
+
+	index := int((address - stubsPoolBase) / stubSize)
+	if address < stubsPoolBase || index >= len(stubsUsed) {
+		return
+	}
+	for i := 0; i < stubSlots[index]; i++ {
+		stubsUsed[index+i] = false
+	}
+	delete(stubSlots, index)
+}
@@ -0,0 +1,20 @@
+#include "textflag.h"
+
+// A pool of executable memory within rel32 reach of every call site in the
+// binary, which is carved up into call redirection stubs at runtime.
+
+#define INT3x16 BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc
+#define INT3x256 INT3x16; INT3x16; INT3x16; INT3x16; INT3x16; INT3x16; INT3x16; INT3x16; INT3x16; INT3x16; INT3x16; INT3x16; INT3x16; INT3x16; INT3x16; INT3x16
+#define INT3x4096 INT3x256; INT3x256; INT3x256; INT3x256; INT3x256; INT3x256; INT3x256; INT3x256; INT3x256; INT3x256; INT3x256; INT3x256; INT3x256; INT3x256; INT3x256; INT3x256
+
+TEXT stubPool<>(SB),NOSPLIT|NOFRAME,$0-0
+	INT3x4096
+	INT3x4096
+	INT3x4096
+	INT3x4096
+
+// func stubPoolAddress() uintptr
+TEXT ·stubPoolAddress(SB),NOSPLIT,$0-4
+	MOVL $stubPool<>(SB), AX
+	MOVL AX, ret+0(FP)
+	RET
@@ -14,12 +14,14 @@ import (
 	"debug/gosym"
 	"math"
 	"reflect"
+	"runtime"
 	"unsafe"
 )
 
 // MakeWritable clears a value's RO flags. The RO flags are generally used to
 // determine whether a value is exported (and thus accessible) or not.
 func MakeWritable(v *reflect.Value) error {
+	initReflectValue()
 	if !rvFlagsFound {
 		return rvFlagsError
 	}
@@ -36,6 +38,7 @@ func MakeWritable(v *reflect.Value) error {
 //
 // Do not write to an object in read-only memory. It would be bad.
 func MakeAddressable(v *reflect.Value) error {
+	initReflectValue()
 	if !rvFlagsFound {
 		return rvFlagsError
 	}
@@ -60,14 +63,13 @@ func GetSliceAddr(slice []byte) uintptr {
 
 // PatchMemory applies a patch to the specified memory location. If the memory
 // is read-only, it will be made temporarily writable while the patch is applied.
+//
+// The patch is recorded in the registry of active patches (see
+// ActivePatches()). Unlike the other kinds of patches, it's never checked for
+// overlaps, so it can be used to write over any memory, including other
+// patches. Writing oldMemory back to the same location undoes the patch.
 func PatchMemory(address uintptr, patch []byte) (oldMemory []byte, err error) {
-	memory := SliceAtAddress(address, len(patch))
-	oldMemory = make([]byte, len(memory))
-	copy(oldMemory, memory)
-	err = applyToProtectedMemory(address, uintptr(len(patch)), func() {
-		copy(memory, patch)
-	})
-	return
+	return patchMemory(address, patch)
 }
 
 // ExposeFunction exposes a function or method, allowing you to bypass export
@@ -108,6 +110,28 @@ func AliasFunction(function interface{}) (aliasedFunction interface{}, err error
 	return newFunctionWithImplementation(function, uintptr(fAddr))
 }
 
+// CallOriginal calls function (typically one returned by AliasFunction()) with
+// the arguments that a reflect.MakeFunc() implementation received. If function
+// is variadic, the last argument is passed as the variadic slice.
+func CallOriginal(function reflect.Value, args []reflect.Value) []reflect.Value {
+	if function.Type().IsVariadic() {
+		return function.CallSlice(args)
+	}
+	return function.Call(args)
+}
+
+// FunctionName returns the name of a function, such as "encoding/json.Marshal".
+func FunctionName(function interface{}) string {
+	rFunc := reflect.ValueOf(function)
+	if rFunc.Kind() != reflect.Func || rFunc.IsNil() {
+		return "(not a function)"
+	}
+	if f := runtime.FuncForPC(rFunc.Pointer()); f != nil {
+		return f.Name()
+	}
+	return "(unknown function)"
+}
+
 // GetSymbolTable loads (if necessary) and returns the symbol table for this process
 func GetSymbolTable() (*gosym.Table, error) {
 	if symTable == nil && symTableLoadError == nil {
@@ -133,9 +157,42 @@ func AllFunctions() (functions map[string]bool, err error) {
 	return
 }
 
-func init() {
+// Logger receives diagnostic messages, such as why a feature is unavailable.
+// *log.Logger satisfies this interface.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Options configures the package (see Init()).
+type Options struct {
+	// Where to send diagnostic messages. If nil, nothing is logged.
+	Logger Logger
+}
+
+var logger Logger
+
+// Init configures the package, and initializes everything that would otherwise
+// be initialized on first use. It returns the first problem found. Use
+// Capabilities() for a more detailed report.
+//
+// Calling Init is optional. Without it, nothing is initialized until it's
+// needed, and nothing is logged. If called, it should be called before the
+// package is otherwise used.
+func Init(options Options) (err error) {
+	logger = options.Logger
 	initReflectValue()
-	initProcess()
+	err = initProcess()
+	initGoroutineIDs()
+	if err == nil && !rvFlagsFound {
+		err = rvFlagsError
+	}
+	return
+}
+
+func logf(format string, v ...interface{}) {
+	if logger != nil {
+		logger.Printf(format, v...)
+	}
 }
 
 const is64BitUintptr = uint64(^uintptr(0)) == ^uint64(0)
@@ -1,10 +1,26 @@
 package subvert
 
 import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"debug/macho"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 	"unsafe"
 )
 
@@ -225,3 +241,1665 @@ func TestAliasFunction(t *testing.T) {
 		t.Errorf("Expected %v, but got %v", expected, actual)
 	}
 }
+
+func TestMemoryRegionAccess(t *testing.T) {
+	region := newMemoryRegion(0x1000, 0x2000, ProtectionRX, "")
+	if !region.Readable || region.Writable || !region.Executable {
+		t.Errorf("Expected r-x access but got %+v", region)
+	}
+
+	// Guard pages keep their protection, but can't be accessed
+	region = newMemoryRegion(0x1000, 0x2000, ProtectionRW|protectionGuard, "")
+	if region.Readable || region.Writable || region.Executable {
+		t.Errorf("Expected a guard page to be inaccessible but got %+v", region)
+	}
+	if region.Protection != ProtectionRW|protectionGuard {
+		t.Errorf("Expected the guard page's protection to be kept but got %#x", int(region.Protection))
+	}
+}
+
+func TestParseSearchPattern(t *testing.T) {
+	pattern, mask, err := ParseSearchPattern("48 8b ?? 0? c3")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expectedPattern := []byte{0x48, 0x8b, 0x00, 0x00, 0xc3}
+	expectedMask := []byte{0xff, 0xff, 0x00, 0xf0, 0xff}
+	if !bytes.Equal(pattern, expectedPattern) {
+		t.Errorf("Expected pattern %x but got %x", expectedPattern, pattern)
+	}
+	if !bytes.Equal(mask, expectedMask) {
+		t.Errorf("Expected mask %x but got %x", expectedMask, mask)
+	}
+
+	if _, _, err = ParseSearchPattern("48 8g"); err == nil {
+		t.Errorf("Expected an error for an invalid hex digit")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "windows" {
+		fmt.Printf("Skipping TestSearch because memory maps aren't supported on this platform.\n")
+		return
+	}
+
+	haystack := []byte{0x00, 0xf3, 0x1c, 0x55, 0x9a, 0x2e, 0x71, 0xd0, 0x00}
+	haystackAddr := GetSliceAddr(haystack)
+	pattern, mask, err := ParseSearchPattern("f3 1c ?? 9a 2? 71 d0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	matches, err := Search(pattern, mask, func(region MemoryRegion) bool {
+		return region.Writable && region.Contains(haystackAddr)
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := haystackAddr + 1
+	for _, match := range matches {
+		if match == expected {
+			return
+		}
+	}
+	t.Errorf("Expected a match at %x but got %x", expected, matches)
+}
+
+var symbolizeTestVar = [4]uintptr{1, 2, 3, 4}
+
+func TestSymbolize(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestSymbolize because it doesn't work in test binaries on this platform. Please run standalone_test.\n")
+		return
+	}
+
+	fAddr, err := getFunctionAddress(zFunc)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	symbol, err := Symbolize(fAddr + 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expectedName := "github.com/kstenerud/go-subvert.zFunc"
+	if symbol.Kind != SymbolKindFunction || symbol.Name != expectedName || symbol.Offset != 1 {
+		t.Errorf("Expected function %v+0x1 but got %v %v", expectedName, symbol.Kind, symbol)
+	}
+	if symbol.Line == 0 {
+		t.Errorf("Expected a line number for %v", symbol)
+	}
+
+	if err = loadNativeSymbols(); err != nil {
+		fmt.Printf("Skipping data symbol test because this test binary has no symbol table (%v). Please run standalone_test.\n", err)
+		return
+	}
+
+	vAddr := uintptr(unsafe.Pointer(&symbolizeTestVar[2]))
+	symbol, err = Symbolize(vAddr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expectedName = "github.com/kstenerud/go-subvert.symbolizeTestVar"
+	if symbol.Kind != SymbolKindData || symbol.Name != expectedName || symbol.Offset != vAddr-uintptr(unsafe.Pointer(&symbolizeTestVar)) {
+		t.Errorf("Expected data %v but got %v %v", expectedName, symbol.Kind, symbol)
+	}
+}
+
+func TestHexDump(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestHexDump because it doesn't work in test binaries on this platform. Please run standalone_test.\n")
+		return
+	}
+
+	fAddr, err := getFunctionAddress(zFunc)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	words := []uintptr{fAddr, 0}
+	dump := HexDump(uintptr(unsafe.Pointer(&words[0])), int(unsafe.Sizeof(words[0]))*len(words))
+	if !strings.Contains(dump, "-> github.com/kstenerud/go-subvert.zFunc") {
+		t.Errorf("Expected hex dump to annotate zFunc pointer:\n%v", dump)
+	}
+}
+
+var classifyTestVar = [4]uintptr{1, 2, 3, 4}
+var classifyTestBSS [4]uintptr
+var classifyTestHeap []byte
+
+func assertPointerClass(t *testing.T, pointer uintptr, expected PointerClass) (info PointerInfo) {
+	info, err := Classify(pointer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if info.Class != expected {
+		t.Errorf("Expected %x to be %v but got %v", pointer, expected, info.Class)
+	}
+	return
+}
+
+func TestClassify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestClassify because it doesn't work in test binaries on this platform. Please run standalone_test.\n")
+		return
+	}
+	if _, err := getRuntimeLayout(); err != nil {
+		fmt.Printf("Skipping stack and heap checks in TestClassify: %v\n", err)
+	} else {
+		assertStackAndHeapPointerClasses(t)
+	}
+	assertImagePointerClasses(t)
+
+	// Image pointers don't need the runtime's layouts.
+	savedLayouts := runtimeLayouts
+	runtimeLayouts = nil
+	defer func() { runtimeLayouts = savedLayouts }()
+	assertImagePointerClasses(t)
+	heap := make([]byte, 100)
+	info, err := Classify(GetSliceAddr(heap))
+	if err != nil {
+		t.Error(err)
+	} else if info.RuntimeError != nil && info.Class != PointerClassUnknown {
+		t.Errorf("Expected a heap pointer to be unknown without runtime layouts but got %v", info.Class)
+	}
+}
+
+func assertStackAndHeapPointerClasses(t *testing.T) {
+	// Make sure the stack has already grown enough to run Classify, or else it
+	// will move and invalidate the pointer.
+	assertPointerClass(t, 0, PointerClassUnknown)
+
+	stackVar := 1
+	info := assertPointerClass(t, uintptr(unsafe.Pointer(&stackVar)), PointerClassStack)
+	if info.GoroutineID == 0 {
+		t.Errorf("Expected a goroutine ID for a stack pointer")
+	}
+
+	classifyTestHeap = make([]byte, 100)
+	heapAddr := GetSliceAddr(classifyTestHeap)
+	info = assertPointerClass(t, heapAddr+10, PointerClassHeap)
+	if info.ObjectBase != heapAddr || info.ObjectSize < 100 || info.SizeClass == 0 {
+		t.Errorf("Expected object at %x of size >= 100 but got %+v", heapAddr, info)
+	}
+}
+
+func assertImagePointerClasses(t *testing.T) {
+	fAddr, err := getFunctionAddress(zFunc)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	info := assertPointerClass(t, fAddr, PointerClassText)
+	if info.Symbol.Name != "github.com/kstenerud/go-subvert.zFunc" {
+		t.Errorf("Expected zFunc symbol but got %v", info.Symbol)
+	}
+
+	assertPointerClass(t, uintptr(unsafe.Pointer(&classifyTestVar)), PointerClassData)
+	assertPointerClass(t, uintptr(unsafe.Pointer(&classifyTestBSS)), PointerClassBSS)
+
+	rv := reflect.ValueOf(constString)
+	if err := MakeAddressable(&rv); err != nil {
+		t.Error(err)
+		return
+	}
+	strBytes := *((*uintptr)(unsafe.Pointer(rv.Addr().Pointer())))
+	assertPointerClass(t, strBytes, PointerClassRodata)
+}
+
+type sealTestConfig struct {
+	Name  string
+	Limit int
+}
+
+func writeToSealed(config *sealTestConfig) (result interface{}) {
+	defer func() {
+		result = recover()
+	}()
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer ExplainSealViolation()
+
+	config.Limit = 200
+	return
+}
+
+func TestSeal(t *testing.T) {
+	original := &sealTestConfig{Name: "test", Limit: 100}
+	sealed, err := SealNamed("testConfig", unsafe.Pointer(original), unsafe.Sizeof(*original))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	config := (*sealTestConfig)(sealed)
+	if config.Name != "test" || config.Limit != 100 {
+		t.Errorf("Expected sealed copy to match the original but got %+v", *config)
+	}
+
+	result := writeToSealed(config)
+	violation, ok := result.(*SealViolationError)
+	if !ok {
+		t.Errorf("Expected a SealViolationError but got %v", result)
+		return
+	}
+	if violation.Name != "testConfig" || violation.Offset != unsafe.Offsetof(config.Limit) {
+		t.Errorf("Expected violation in testConfig at offset %v but got %v", unsafe.Offsetof(config.Limit), violation)
+	}
+
+	if err = Unseal(sealed); err != nil {
+		t.Error(err)
+		return
+	}
+	if result = writeToSealed(config); result != nil {
+		t.Errorf("Expected no panic after unsealing but got %v", result)
+	}
+	if config.Limit != 200 {
+		t.Errorf("Expected limit to be 200 but got %v", config.Limit)
+	}
+	if err = Unseal(sealed); err == nil {
+		t.Errorf("Expected unsealing twice to fail")
+	}
+
+	if err = Release(sealed); err != nil {
+		t.Error(err)
+	}
+	if err = Release(sealed); err == nil {
+		t.Errorf("Expected releasing twice to fail")
+	}
+}
+
+func TestSealInPlace(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "windows" && runtime.GOOS != "darwin" {
+		fmt.Printf("Skipping TestSealInPlace because old protections can't be read on this platform.\n")
+		return
+	}
+
+	if err := initProcess(); err != nil {
+		t.Error(err)
+		return
+	}
+	address, err := osAllocatePages(uintptr(pageSize))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer osFreePages(address, uintptr(pageSize))
+	if _, err = Protect(address, uintptr(pageSize), ProtectionR); err != nil {
+		t.Error(err)
+		return
+	}
+
+	sealed, err := Seal(unsafe.Pointer(address), uintptr(pageSize))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if uintptr(sealed) != address {
+		t.Errorf("Expected a page aligned object to be sealed in place at %#x but got %#x", address, uintptr(sealed))
+		return
+	}
+	if err = Unseal(sealed); err != nil {
+		t.Error(err)
+		return
+	}
+	if protection := osGetMemoryProtection(address); protection != ProtectionR {
+		t.Errorf("Expected unsealing to restore r-- but got %v", protection)
+	}
+}
+
+func TestProtect(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "windows" && runtime.GOOS != "darwin" {
+		fmt.Printf("Skipping TestProtect because old protections can't be read on this platform.\n")
+		return
+	}
+
+	if err := initProcess(); err != nil {
+		t.Error(err)
+		return
+	}
+	address, err := osAllocatePages(uintptr(pageSize * 2))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	secondPage := address + uintptr(pageSize)
+
+	if _, err = Protect(secondPage, 1, ProtectionR); err != nil {
+		t.Error(err)
+		return
+	}
+
+	old, err := Protect(address, uintptr(pageSize*2), ProtectionRW)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(old) != 2 || old[0] != ProtectionRW || old[1] != ProtectionR {
+		t.Errorf("Expected old protections [rw- r--] but got %v", old)
+	}
+
+	if _, err = Protect(secondPage, 1, ProtectionR); err != nil {
+		t.Error(err)
+		return
+	}
+	err = WithProtection(address, uintptr(pageSize*2), ProtectionRW, func() {
+		SliceAtAddress(secondPage, 1)[0] = 1
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if protection := osGetMemoryProtection(secondPage); protection != ProtectionR {
+		t.Errorf("Expected protection to be restored to r-- but got %v", protection)
+	}
+}
+
+var heapSink []byte
+
+func TestPatchMemoryIfMatches(t *testing.T) {
+	// Must be on the heap, since the stack could move during the test.
+	heapSink = make([]byte, 8)
+	memory := heapSink
+	copy(memory, "abcdefgh")
+	address := GetSliceAddr(memory)
+
+	_, err := PatchMemoryIfMatches(address+2, []byte("xx"), []byte("XX"))
+	if _, ok := err.(*PatchMismatchError); !ok {
+		t.Errorf("Expected a PatchMismatchError but got %v", err)
+	}
+	if string(memory) != "abcdefgh" {
+		t.Errorf("Expected memory to be untouched but got %v", string(memory))
+	}
+
+	oldMem, err := PatchMemoryIfMatches(address+2, []byte("cd"), []byte("XX"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(oldMem) != "cd" || string(memory) != "abXXefgh" {
+		t.Errorf("Expected oldMem cd and memory abXXefgh but got %v and %v", string(oldMem), string(memory))
+	}
+	if _, err = PatchMemory(address+2, oldMem); err != nil {
+		t.Error(err)
+	}
+}
+
+//go:noinline
+func replaceMe(value int) int {
+	return value + 1
+}
+
+//go:noinline
+func callReplaceMe(value int) int {
+	return replaceMe(value) * 10
+}
+
+func TestReplaceFunction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestReplaceFunction because it doesn't work in test binaries on this platform. Please run standalone_test.\n")
+		return
+	}
+
+	offset := 100
+	patch, err := ReplaceFunction(replaceMe, func(value int) int {
+		return value + offset
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if actual := callReplaceMe(1); actual != 1010 {
+		t.Errorf("Expected 1010 but got %v", actual)
+	}
+	if err = patch.Revert(); err != nil {
+		t.Error(err)
+		return
+	}
+	if actual := callReplaceMe(1); actual != 20 {
+		t.Errorf("Expected 20 but got %v", actual)
+	}
+
+	_, err = ReplaceFunctionIfMatches(replaceMe, []byte{0x00, 0x01, 0x02}, func(value int) int {
+		return 0
+	})
+	if _, ok := err.(*PatchMismatchError); !ok {
+		t.Errorf("Expected a PatchMismatchError but got %v", err)
+	}
+	if actual := callReplaceMe(1); actual != 20 {
+		t.Errorf("Expected 20 but got %v", actual)
+	}
+}
+
+func TestRedirectCalls(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestRedirectCalls because it doesn't work in test binaries on this platform. Please run standalone_test.\n")
+		return
+	}
+
+	originalIntf, err := AliasFunction(replaceMe)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	original := originalIntf.(func(int) int)
+	prologue := append([]byte{}, SliceAtAddress(reflect.ValueOf(replaceMe).Pointer(), 4)...)
+
+	calls := 0
+	patches, err := RedirectCallsIfMatches(replaceMe, prologue, func(value int) int {
+		calls++
+		return original(value) + 1000
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if actual := callReplaceMe(1); actual != 10020 {
+		t.Errorf("Expected 10020 but got %v", actual)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 call but got %v", calls)
+	}
+	if err = revertPatches(patches); err != nil {
+		t.Error(err)
+		return
+	}
+	if actual := callReplaceMe(1); actual != 20 {
+		t.Errorf("Expected 20 but got %v", actual)
+	}
+}
+
+var patchSetTestVar = "original"
+
+func TestPatchSet(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestPatchSet because it doesn't work in test binaries on this platform. Please run standalone_test.\n")
+		return
+	}
+
+	prologue := append([]byte{}, SliceAtAddress(reflect.ValueOf(replaceMe).Pointer(), 4)...)
+	replacement := func(value int) int { return 0 }
+
+	// Fails validation: Nothing should be applied
+	set := NewPatchSet().
+		WriteVariable(&patchSetTestVar, "patched").
+		ReplaceFunctionIfMatches(replaceMe, []byte{0x00, 0x01}, replacement)
+	if err := set.Apply(); err == nil {
+		t.Errorf("Expected validation to fail")
+	}
+	if patchSetTestVar != "original" || callReplaceMe(1) != 20 {
+		t.Errorf("Expected nothing to be patched")
+	}
+
+	// Second replacement fails after the first is applied: Should roll back
+	set = NewPatchSet().
+		WriteVariable(&patchSetTestVar, "patched").
+		ReplaceFunction(replaceMe, replacement).
+		ReplaceFunctionIfMatches(replaceMe, prologue, replacement)
+	if err := set.Apply(); err == nil {
+		t.Errorf("Expected apply to fail")
+	}
+	if patchSetTestVar != "original" || callReplaceMe(1) != 20 {
+		t.Errorf("Expected all patches to be rolled back")
+	}
+
+	set = NewPatchSet().
+		WriteVariable(&patchSetTestVar, "patched").
+		ReplaceFunctionIfMatches(replaceMe, prologue, replacement)
+	if err := set.Apply(); err != nil {
+		t.Error(err)
+		return
+	}
+	if patchSetTestVar != "patched" || callReplaceMe(1) != 0 {
+		t.Errorf("Expected all patches to be applied")
+	}
+	if err := set.Revert(); err != nil {
+		t.Error(err)
+		return
+	}
+	if patchSetTestVar != "original" || callReplaceMe(1) != 20 {
+		t.Errorf("Expected all patches to be reverted")
+	}
+}
+
+var patchSetRollbackVar uint64 = 1
+
+func TestPatchSetFailedRollback(t *testing.T) {
+	address := uintptr(unsafe.Pointer(&patchSetRollbackVar))
+	var clobbered []byte
+	set := NewPatchSet().WriteVariable(&patchSetRollbackVar, uint64(2))
+	set.add(func() (apply func() ([]*Patch, error), err error) {
+		apply = func() (patches []*Patch, err error) {
+			// Change what the first patch wrote, so that it can't be reverted
+			if clobbered, err = PatchMemory(address, []byte{3}); err != nil {
+				return
+			}
+			return nil, fmt.Errorf("Failing on purpose")
+		}
+		return
+	})
+
+	err := set.Apply()
+	if err == nil || !strings.Contains(err.Error(), "rollback also failed") {
+		t.Errorf("Expected the rollback to fail but got %v", err)
+	}
+	if len(set.Patches()) != 1 {
+		t.Errorf("Expected the unreverted patch to be kept but got %v", set.Patches())
+	}
+
+	// Once the memory is put back, the set can be reverted
+	if _, err = PatchMemory(address, clobbered); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = set.Revert(); err != nil {
+		t.Error(err)
+		return
+	}
+	if patchSetRollbackVar != 1 {
+		t.Errorf("Expected 1 but got %v", patchSetRollbackVar)
+	}
+}
+
+func findActivePatch(address uintptr) *Patch {
+	for _, p := range ActivePatches() {
+		if p.Address == address {
+			return p
+		}
+	}
+	return nil
+}
+
+func TestPatchRegistry(t *testing.T) {
+	heapSink = make([]byte, 16)
+	memory := heapSink
+	copy(memory, "0123456789abcdef")
+	address := GetSliceAddr(memory)
+
+	oldMem, err := PatchMemory(address, []byte("XXXX"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	p := findActivePatch(address)
+	if p == nil {
+		t.Errorf("Expected patch at %x to be active", address)
+		return
+	}
+	if p.Kind != PatchKindMemory || string(p.Original) != "0123" || string(p.Patched) != "XXXX" {
+		t.Errorf("Unexpected patch contents: %v", p)
+	}
+	if !strings.Contains(p.StackTrace(), "TestPatchRegistry") {
+		t.Errorf("Expected stack trace to include TestPatchRegistry but got:\n%v", p.StackTrace())
+	}
+
+	// Raw patches may overlap, but other kinds of patches may not
+	overlapOld, err := PatchMemory(address+2, []byte("YY"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = PatchMemory(address+2, overlapOld); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = WriteVariable(&patchSetTestVar, "patched"); err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = WriteVariable(&patchSetTestVar, "patched again")
+	if _, ok := err.(*PatchOverlapError); !ok {
+		t.Errorf("Expected a PatchOverlapError but got %v", err)
+	}
+	if err = findActivePatch(uintptr(unsafe.Pointer(&patchSetTestVar))).Revert(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Writing the old memory back undoes the patch
+	if _, err = PatchMemory(address, oldMem); err != nil {
+		t.Error(err)
+		return
+	}
+	if findActivePatch(address) != nil || !p.IsReverted() {
+		t.Errorf("Expected patch to be reverted")
+	}
+
+	if _, err = PatchMemory(address+4, []byte("YY")); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = WriteVariable(&patchSetTestVar, "patched"); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = RestoreAll(); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(ActivePatches()) != 0 {
+		t.Errorf("Expected no active patches but got %v", ActivePatches())
+	}
+	if string(memory) != "0123456789abcdef" || patchSetTestVar != "original" {
+		t.Errorf("Expected everything to be restored but got %v, %v", string(memory), patchSetTestVar)
+	}
+}
+
+func TestCatchExit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestCatchExit because it doesn't work in test binaries on this platform. Please run standalone_test.\n")
+		return
+	}
+
+	code, exited := CatchExit(func() {
+		os.Exit(3)
+		t.Errorf("os.Exit returned")
+	})
+	if !exited || code != 3 {
+		t.Errorf("Expected exit code 3 but got %v, %v", code, exited)
+	}
+
+	code, exited = CatchExit(func() {
+		log.SetOutput(new(bytes.Buffer))
+		defer log.SetOutput(os.Stderr)
+		log.Fatal("fatal")
+	})
+	if !exited || code != 1 {
+		t.Errorf("Expected exit code 1 but got %v, %v", code, exited)
+	}
+
+	code, exited = CatchExit(func() {})
+	if exited || code != 0 {
+		t.Errorf("Expected no exit but got %v, %v", code, exited)
+	}
+
+	for _, patch := range ActivePatches() {
+		if patch.Kind == PatchKindFunctionReplacement {
+			t.Errorf("Expected os.Exit to be restored, but found %v", patch)
+		}
+	}
+}
+
+//go:noinline
+func traceMe(a, b, c, d, e, f, g, h, i, j, k int) int {
+	return a + b + c + d + e + f + g + h + i + j + k
+}
+
+//go:noinline
+func callTraceMe(times int) (sum int) {
+	for i := 0; i < times; i++ {
+		sum += traceMe(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, i)
+	}
+	return
+}
+
+//go:noinline
+func traceMeTimed(d time.Duration) time.Duration {
+	time.Sleep(d)
+	return d
+}
+
+func findTraceStat(name string) *TraceStat {
+	for _, stat := range TraceStats() {
+		if stat.Name == name {
+			return &stat
+		}
+	}
+	return nil
+}
+
+func TestTrace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestTrace because it doesn't work in test binaries on this platform. Please run standalone_test.\n")
+		return
+	}
+
+	// Statistics persist across runs, so only look at the difference
+	name := packagePath + ".traceMe"
+	timedName := packagePath + ".traceMeTimed"
+	before := map[string]TraceStat{}
+	for _, stat := range TraceStats() {
+		before[stat.Name] = stat
+	}
+
+	if err := Trace(name); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := Trace("no.such.function"); err == nil {
+		t.Errorf("Expected error tracing a missing function")
+	}
+
+	// Arguments (including those passed on the stack) must arrive intact
+	if sum := callTraceMe(3); sum != 3*55+3 {
+		t.Errorf("Expected %v but got %v", 3*55+3, sum)
+	}
+	if err := TraceFunction(traceMeTimed, true); err == nil {
+		t.Errorf("Expected logging arguments without a logger to fail")
+	}
+	if err := TraceFunction(traceMeTimed, false); err != nil {
+		t.Error(err)
+		return
+	}
+	if d := traceMeTimed(time.Millisecond); d != time.Millisecond {
+		t.Errorf("Expected 1ms but got %v", d)
+	}
+	if err := StopTrace(); err != nil {
+		t.Error(err)
+		return
+	}
+	callTraceMe(1)
+
+	stat := findTraceStat(name)
+	if stat == nil {
+		t.Fatalf("No trace stats for %v in %v", name, TraceStats())
+	}
+	if stat.Count-before[name].Count != 3 {
+		t.Errorf("Expected 3 calls but got %v", stat.Count-before[name].Count)
+	}
+	if stat.LastCaller.Name != packagePath+".callTraceMe" {
+		t.Errorf("Expected last caller callTraceMe but got %v", stat.LastCaller)
+	}
+
+	stat = findTraceStat(timedName)
+	if stat == nil {
+		t.Fatalf("No trace stats for traceMeTimed in %v", TraceStats())
+	}
+	count := stat.Count - before[timedName].Count
+	elapsed := stat.TotalTime - before[timedName].TotalTime
+	if count != 1 || elapsed < time.Millisecond {
+		t.Errorf("Expected 1 call taking at least 1ms, but got %v calls taking %v", count, elapsed)
+	}
+	if stat.LastCaller.Name != packagePath+".TestTrace" {
+		t.Errorf("Expected last caller TestTrace but got %v", stat.LastCaller)
+	}
+}
+
+func TestDWARFFunctionTypes(t *testing.T) {
+	if testing.Short() {
+		fmt.Printf("Skipping TestDWARFFunctionTypes because it builds fixtures.\n")
+		return
+	}
+	fixtures := buildBinaryFixtures(t)
+	if fixtures == nil {
+		fmt.Printf("Skipping TestDWARFFunctionTypes because the go tool isn't available.\n")
+		return
+	}
+	exe, err := elf.Open(fixtures[BinaryFormatELF])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exe.Close()
+	data, err := exe.DWARF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layouts, err := newDWARFLayouts(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]interface{}{
+		"runtime.findnull":      (func(unsafe.Pointer) int)(nil),
+		"runtime.concatstrings": (func(unsafe.Pointer, []string) string)(nil),
+		"runtime.gopanic":       (func(interface{}))(nil),
+	} {
+		typ, err := layouts.getFunctionType(name)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if typ != reflect.TypeOf(expected) {
+			t.Errorf("Expected %v to be %v but got %v", name, reflect.TypeOf(expected), typ)
+		}
+	}
+	if _, err := layouts.getFunctionType("no.such.function"); err == nil {
+		t.Errorf("Expected error getting the type of a missing function")
+	}
+
+	// Stand-ins must have the same layout as the original
+	for _, name := range []string{"runtime.g", "runtime.funcInfo", "runtime.iface"} {
+		structType, err := data.Type(layouts.structs[name])
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		typ, err := dwarfTypeToReflect(structType)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if int64(typ.Size()) != structType.Size() {
+			t.Errorf("Expected %v to be %v bytes but got %v", name, structType.Size(), typ.Size())
+		}
+	}
+}
+
+//go:noinline
+func startLabelledGoroutine(block chan struct{}, started chan struct{}) {
+	pprof.Do(context.Background(), pprof.Labels("request", "42"), func(context.Context) {
+		go func() {
+			close(started)
+			<-block
+		}()
+	})
+}
+
+func TestGoroutines(t *testing.T) {
+	if _, err := getRuntimeLayout(); err != nil {
+		fmt.Printf("Skipping TestGoroutines: %v\n", err)
+		return
+	}
+	block := make(chan struct{})
+	started := make(chan struct{})
+	startLabelledGoroutine(block, started)
+	<-started
+	defer close(block)
+
+	var labelled, current *GoroutineInfo
+	for i := 0; i < 100 && (labelled == nil || labelled.Status != GoroutineWaiting); i++ {
+		time.Sleep(time.Millisecond)
+		goroutines, err := Goroutines()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		labelled, current = nil, nil
+		for i, g := range goroutines {
+			if g.Labels["request"] == "42" {
+				labelled = &goroutines[i]
+			}
+			if g.ID == GoID() {
+				current = &goroutines[i]
+			}
+		}
+	}
+	if labelled == nil || current == nil {
+		t.Fatalf("Expected to find the labelled and current goroutines")
+	}
+
+	if current.Status != GoroutineRunning {
+		t.Errorf("Expected current goroutine to be running but got %v", current.Status)
+	}
+	if labelled.Status != GoroutineWaiting || labelled.WaitReason != "chan receive" {
+		t.Errorf("Expected goroutine to be waiting on chan receive but got %v (%v)", labelled.Status, labelled.WaitReason)
+	}
+	if labelled.ParentID != current.ID {
+		t.Errorf("Expected parent %v but got %v", current.ID, labelled.ParentID)
+	}
+	if !strings.HasPrefix(labelled.Start.Name, packagePath+".startLabelledGoroutine.") {
+		t.Errorf("Expected start function in startLabelledGoroutine but got %v", labelled.Start)
+	}
+	if !strings.HasPrefix(labelled.Creator.Name, packagePath+".startLabelledGoroutine.") {
+		t.Errorf("Expected creator in startLabelledGoroutine but got %v", labelled.Creator)
+	}
+	if labelled.System || current.System {
+		t.Errorf("Expected user goroutines not to be system goroutines")
+	}
+}
+
+func TestGoID(t *testing.T) {
+	if id := GoID(); id != stackGoroutineID() {
+		t.Errorf("Expected goroutine ID %v but got %v", stackGoroutineID(), id)
+	}
+
+	result := make(chan []interface{})
+	go func() {
+		result <- []interface{}{GoID(), stackGoroutineID(), CurrentG()}
+	}()
+	other := <-result
+	if other[0] != other[1] || other[0] == GoID() {
+		t.Errorf("Expected other goroutine ID %v (not %v) but got %v", other[1], GoID(), other[0])
+	}
+	if runtime.GOARCH == "amd64" && (CurrentG() == nil || CurrentG() == other[2]) {
+		t.Errorf("Expected distinct non-nil g pointers but got %v and %v", CurrentG(), other[2])
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		fmt.Printf("Skipping TestLocalStorage because it isn't supported on this architecture.\n")
+		return
+	}
+
+	if err := SetLocal("request", 1); err != nil {
+		t.Error(err)
+		return
+	}
+	defer DeleteLocal("request")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, ok := GetLocal("request"); ok {
+				t.Errorf("Expected new goroutine to have empty storage")
+			}
+			if err := SetLocal("request", i); err != nil {
+				t.Error(err)
+			}
+			if value, _ := GetLocal("request"); value != i {
+				t.Errorf("Expected %v but got %v", i, value)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if value, ok := GetLocal("request"); !ok || value != 1 {
+		t.Errorf("Expected 1 but got %v", value)
+	}
+
+	// Storage of exited goroutines is swept out as new storage is added
+	done := make(chan bool)
+	go func() {
+		SetLocal("request", -1)
+		done <- true
+	}()
+	<-done
+	localsLock.Lock()
+	sweepLocals()
+	remaining := len(locals)
+	localsLock.Unlock()
+	if remaining > 2 {
+		t.Errorf("Expected exited goroutines' storage to be swept, but %v entries remain", remaining)
+	}
+}
+
+// Storage set while another goroutine is still looking up the goroutine ID
+// offsets must be kept under the real ID.
+func TestLocalStorageDuringInit(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		fmt.Printf("Skipping TestLocalStorageDuringInit because it isn't supported on this architecture.\n")
+		return
+	}
+	if !initGoroutineIDs() {
+		t.Fatalf("Expected goroutine IDs to be initialized")
+	}
+
+	atomic.StoreInt32(&goroutineIDsState, goroutineIDsInitializing)
+	initialized := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+		if err := SetLocal("during init", true); err != nil {
+			t.Error(err)
+		}
+		<-initialized
+		if _, ok := GetLocal("during init"); !ok {
+			t.Errorf("Expected storage set during initialization to be kept")
+		}
+		DeleteLocal("during init")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	atomic.StoreInt32(&goroutineIDsState, goroutineIDsInitialized)
+	close(initialized)
+	<-done
+}
+
+func TestGetStructField(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		fmt.Printf("Skipping TestGetStructField because runtime layouts aren't known for this architecture.\n")
+		return
+	}
+
+	goid, err := GetStructField("runtime.g", "goid")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if id := readUint64At(uintptr(CurrentG()) + goid.Offset); id != stackGoroutineID() {
+		t.Errorf("Expected goroutine ID %v at offset %v but got %v", stackGoroutineID(), goid.Offset, id)
+	}
+
+	stackHi, err := GetStructField("runtime.g", "stack.hi")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if stackHi.Offset != 8 {
+		t.Errorf("Expected g.stack.hi at offset 8 but got %v", stackHi.Offset)
+	}
+
+	if _, err = GetStructField("runtime.g", "noSuchField"); err == nil {
+		t.Errorf("Expected an error for a nonexistent field")
+	}
+
+	if _, err := getDWARFLayouts(); err != nil {
+		fmt.Printf("Skipping DWARF checks in TestGetStructField because this executable has no debug info.\n")
+		return
+	}
+	if goid.Type != "uint64" || goid.Size != 8 {
+		t.Errorf("Expected g.goid to be an 8 byte uint64 but got %v bytes of %v", goid.Size, goid.Type)
+	}
+	// The fallback table must agree with the debug info.
+	if layout, err := getRuntimeLayout(); err == nil {
+		for name, expected := range layout {
+			if offset, err := getRuntimeFieldOffset(name); err != nil {
+				t.Error(err)
+			} else if offset != expected {
+				t.Errorf("Expected %v at offset %v but DWARF says %v", name, expected, offset)
+			}
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	capabilities := SelfTest()
+	found := make(map[Feature]Capability)
+	for _, capability := range capabilities {
+		found[capability.Feature] = capability
+	}
+	for _, feature := range []Feature{FeatureReflectFlags, FeatureSymbolTable, FeatureInMemorySymbols,
+		FeatureCallRedirection, FeatureMemoryProtection, FeatureRuntimeLayouts} {
+		if _, ok := found[feature]; !ok {
+			t.Errorf("Feature %v was not reported", feature)
+		}
+	}
+
+	expected := []Feature{FeatureReflectFlags, FeatureSymbolTable, FeatureMemoryProtection}
+	if runtime.GOARCH == "amd64" {
+		expected = append(expected, FeatureCallRedirection, FeatureRuntimeLayouts)
+	}
+	for _, feature := range expected {
+		if !found[feature].Works {
+			t.Errorf("Expected %v", found[feature])
+		}
+	}
+}
+
+type testLogger struct {
+	messages []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func TestInit(t *testing.T) {
+	l := &testLogger{}
+	if err := Init(Options{Logger: l}); err != nil {
+		t.Error(err)
+	}
+	defer Init(Options{})
+
+	if pageSize <= 0 || !rvFlagsFound {
+		t.Errorf("Expected the package to be initialized, but page size is %v and flags found is %v", pageSize, rvFlagsFound)
+	}
+	logf("test %v", 1)
+	if len(l.messages) != 1 || l.messages[0] != "test 1" {
+		t.Errorf("Expected the logger to receive [test 1] but got %v", l.messages)
+	}
+}
+
+func TestSizeBinarySymbols(t *testing.T) {
+	unsizedSymbol := func(name string, address, sectionEnd uint64) unsizedBinarySymbol {
+		return unsizedBinarySymbol{BinarySymbol{Name: name, Address: address}, sectionEnd}
+	}
+	// Two sections: 0x1000-0x1100 and 0x2000-0x2100
+	symbols := sizeBinarySymbols([]unsizedBinarySymbol{
+		unsizedSymbol("b", 0x1080, 0x1100),
+		unsizedSymbol("a", 0x1000, 0x1100),
+		unsizedSymbol("alias", 0x1000, 0x1100),
+		unsizedSymbol("c", 0x2000, 0x2100),
+		unsizedSymbol("end", 0x2100, 0x2100),
+	})
+
+	expected := map[string][2]uint64{
+		"a":     {0x1000, 0x80},
+		"alias": {0x1000, 0x80},
+		"b":     {0x1080, 0x80},
+		"c":     {0x2000, 0x100},
+		"end":   {0x2100, 0},
+	}
+	for i, symbol := range symbols {
+		if i > 0 && symbol.Address < symbols[i-1].Address {
+			t.Errorf("Expected symbols sorted by address but got %v", symbols)
+		}
+		if want := expected[symbol.Name]; symbol.Address != want[0] || symbol.Size != want[1] {
+			t.Errorf("Expected %v at %#x with size %#x but got %#x with size %#x",
+				symbol.Name, want[0], want[1], symbol.Address, symbol.Size)
+		}
+	}
+}
+
+func TestSymbolSource(t *testing.T) {
+	exePath, err := os.Executable()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	table, err := LoadSymbolTable(FileSymbolSource(exePath))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expectedName := "github.com/kstenerud/go-subvert.TestSymbolSource"
+	if table.LookupFunc(expectedName) == nil {
+		t.Errorf("Expected to find %v in symbols from %v", expectedName, exePath)
+	}
+
+	file, err := os.Open(exePath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer file.Close()
+	if _, err = LoadSymbolTable(ReaderSymbolSource(file)); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = LoadSymbolTable(FileSymbolSource(exePath + ".nonexistent")); err == nil {
+		t.Errorf("Expected an error loading symbols from a nonexistent file")
+	}
+
+	SetSymbolSource(TableSymbolSource(table))
+	defer SetSymbolSource(nil)
+	symbol, err := GetFunctionSymbol(TestSymbolSource)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if symbol.Name != expectedName {
+		t.Errorf("Expected symbol %v but got %v", expectedName, symbol.Name)
+	}
+
+	// Everything else that's read from the executable comes from the source too.
+	if runtime.GOOS == "windows" {
+		return
+	}
+	reader := &countingReader{reader: file}
+	SetSymbolSource(ReaderSymbolSource(reader))
+	if _, ok := getImageSectionContaining(uintptr(unsafe.Pointer(&classifyTestVar))); !ok {
+		t.Errorf("Expected classifyTestVar to be in a section read from the symbol source")
+	}
+	if reader.reads == 0 {
+		t.Errorf("Expected sections to be read from the symbol source")
+	}
+}
+
+type countingReader struct {
+	reader io.ReaderAt
+	reads  int
+}
+
+func (r *countingReader) ReadAt(p []byte, offset int64) (int, error) {
+	r.reads++
+	return r.reader.ReadAt(p, offset)
+}
+
+// Cross-compile a small program for each object format, using the go toolchain
+// that's running the tests.
+func buildBinaryFixtures(t *testing.T, buildFlags ...string) (paths map[BinaryFormat]string) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		return nil
+	}
+	dir := t.TempDir()
+	source := "package main\n\nvar fixtureVariable = []int{1, 2, 3}\n\nfunc main() { println(fixtureVariable[0]) }\n"
+	if err = os.WriteFile(filepath.Join(dir, "main.go"), []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module fixture\n\ngo 1.18\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	paths = make(map[BinaryFormat]string)
+	for format, target := range map[BinaryFormat][2]string{
+		BinaryFormatELF:   {"linux", "amd64"},
+		BinaryFormatMachO: {"darwin", "arm64"},
+		BinaryFormatPE:    {"windows", "amd64"},
+	} {
+		path := filepath.Join(dir, "fixture-"+target[0])
+		args := append([]string{"build", "-o", path}, buildFlags...)
+		cmd := exec.Command(goTool, append(args, ".")...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GOOS="+target[0], "GOARCH="+target[1], "CGO_ENABLED=0", "GOFLAGS=")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Could not build %v fixture: %v\n%s", format, err, output)
+		}
+		paths[format] = path
+	}
+	return
+}
+
+func TestOpenBinary(t *testing.T) {
+	if testing.Short() {
+		fmt.Printf("Skipping TestOpenBinary because it builds fixtures.\n")
+		return
+	}
+	fixtures := buildBinaryFixtures(t)
+	if fixtures == nil {
+		fmt.Printf("Skipping TestOpenBinary because the go tool isn't available.\n")
+		return
+	}
+
+	for format, path := range fixtures {
+		binary, err := OpenBinary(path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if binary.Format != format {
+			t.Errorf("Expected %v to be %v but got %v", path, format, binary.Format)
+		}
+		if binary.GoVersion != runtime.Version() || binary.BuildInfo.Path != "fixture" {
+			t.Errorf("%v: Expected fixture built by %v but got %v built by %v",
+				format, runtime.Version(), binary.BuildInfo.Path, binary.GoVersion)
+		}
+		if binary.Symbols.LookupFunc("main.main") == nil {
+			t.Errorf("%v: Function main.main not found", format)
+		}
+		found := false
+		for _, symbol := range binary.DataSymbols {
+			if symbol.Name == "main.fixtureVariable" {
+				found = symbol.Size >= 24
+			}
+		}
+		if !found {
+			t.Errorf("%v: Data symbol main.fixtureVariable not found", format)
+		}
+	}
+
+	// Stripped binaries have no symbol tables, but still have their go symbols.
+	for format, path := range buildBinaryFixtures(t, "-ldflags=-s -w") {
+		binary, err := OpenBinary(path)
+		if err != nil {
+			t.Errorf("Stripped %v: %v", format, err)
+			continue
+		}
+		if binary.Symbols.LookupFunc("main.main") == nil {
+			t.Errorf("Stripped %v: Function main.main not found", format)
+		}
+	}
+
+	if _, err := OpenBinary("subvert.go"); err == nil {
+		t.Errorf("Expected an error opening a source file as a binary")
+	}
+}
+
+func TestForeignSymbolSource(t *testing.T) {
+	if testing.Short() {
+		fmt.Printf("Skipping TestForeignSymbolSource because it builds fixtures.\n")
+		return
+	}
+	format, ok := map[string]BinaryFormat{
+		"linux":   BinaryFormatELF,
+		"darwin":  BinaryFormatMachO,
+		"windows": BinaryFormatPE,
+	}[runtime.GOOS]
+	if !ok {
+		fmt.Printf("Skipping TestForeignSymbolSource because there is no fixture in this platform's format.\n")
+		return
+	}
+	fixtures := buildBinaryFixtures(t)
+	if fixtures == nil {
+		fmt.Printf("Skipping TestForeignSymbolSource because the go tool isn't available.\n")
+		return
+	}
+
+	path := fixtures[format]
+	table, err := LoadSymbolTable(FileSymbolSource(path))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	binary, err := OpenBinary(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	function := table.LookupFunc("main.main")
+	linked := binary.Symbols.LookupFunc("main.main")
+	if function == nil || linked == nil || function.Entry != linked.Entry {
+		t.Errorf("Expected main.main at its linked address %v but got %v", linked, function)
+	}
+}
+
+var memoryImageTestVar = [4]uintptr{1, 2, 3, 4}
+
+func TestMemoryImage(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		fmt.Printf("Skipping TestMemoryImage because the image is only checked against the memory map on linux.\n")
+		return
+	}
+	if err := initProcess(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	image, err := readELFImage(processBaseAddress)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, address := range []uintptr{
+		reflect.ValueOf(TestMemoryImage).Pointer(),
+		uintptr(unsafe.Pointer(&memoryImageTestVar[1])),
+	} {
+		found := false
+		for _, s := range image.segments {
+			found = found || (address >= s.address && address < s.end())
+		}
+		if !found {
+			t.Errorf("Expected address %#x to be in one of the image's segments %+v", address, image.segments)
+		}
+	}
+	for i := 1; i < len(image.segments); i++ {
+		if image.segments[i].address < image.segments[i-1].end() {
+			t.Errorf("Segment at %#x overlaps the previous segment", image.segments[i].address)
+		}
+	}
+
+	table, err := image.readSymbols()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	function := table.LookupFunc("github.com/kstenerud/go-subvert.TestMemoryImage")
+	if function == nil || uintptr(function.Entry) != reflect.ValueOf(TestMemoryImage).Pointer() {
+		t.Errorf("Expected TestMemoryImage at %#x but got %v", reflect.ValueOf(TestMemoryImage).Pointer(), function)
+	}
+}
+
+// Something that only looks like a pclntab header must be skipped rather than
+// crash the search.
+func TestFalsePclntabCandidate(t *testing.T) {
+	ptrSize := unsafe.Sizeof(uintptr(0))
+	data := bytes.Repeat([]byte{0xff}, 256)
+	binary.LittleEndian.PutUint32(data, pclntabMagics[1])
+	data[4], data[5], data[6], data[7] = 0, 0, 1, byte(ptrSize)
+	if isPclntabHeader(data, ptrSize) {
+		t.Errorf("Expected a header with out of range offsets to be rejected")
+	}
+
+	setField := func(index uintptr, value uintptr) {
+		*(*uintptr)(unsafe.Pointer(&data[8+index*ptrSize])) = value
+	}
+	setField(0, 4)
+	for index := uintptr(1); index < 8; index++ {
+		setField(index, 8+8*ptrSize)
+	}
+	if !isPclntabHeader(data, ptrSize) {
+		t.Errorf("Expected the fake data to look like a pclntab header")
+		return
+	}
+	image := &memoryImage{}
+	if _, err := image.loadPclntab(data); err == nil {
+		t.Errorf("Expected an error loading a fake pclntab")
+	}
+}
+
+// Lays out a Mach-O file's segments in a buffer the way the loader would, and
+// checks that the pclntab is found in __TEXT.
+func TestMachOMemoryImage(t *testing.T) {
+	if testing.Short() {
+		fmt.Printf("Skipping TestMachOMemoryImage because it builds fixtures.\n")
+		return
+	}
+	fixtures := buildBinaryFixtures(t)
+	if fixtures == nil {
+		fmt.Printf("Skipping TestMachOMemoryImage because the go tool isn't available.\n")
+		return
+	}
+
+	exe, err := macho.Open(fixtures[BinaryFormatMachO])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exe.Close()
+	text := exe.Segment("__TEXT")
+	pclntab := exe.Section("__gopclntab")
+	if text == nil || pclntab == nil {
+		t.Fatalf("Fixture has no __TEXT segment or __gopclntab section")
+	}
+	var end uint64
+	for _, load := range exe.Loads {
+		if segment, ok := load.(*macho.Segment); ok && segment.Filesz != 0 && segment.Addr+segment.Memsz > end {
+			end = segment.Addr + segment.Memsz
+		}
+	}
+	memory := make([]uintptr, (end-text.Addr)/uint64(unsafe.Sizeof(uintptr(0)))+1)
+	buffer := SliceAtAddress(uintptr(unsafe.Pointer(&memory[0])), len(memory)*int(unsafe.Sizeof(uintptr(0))))
+	for _, load := range exe.Loads {
+		if segment, ok := load.(*macho.Segment); ok && segment.Filesz != 0 {
+			size := segment.Filesz
+			if segment.Memsz < size {
+				size = segment.Memsz
+			}
+			if _, err = segment.ReadAt(buffer[segment.Addr-text.Addr:][:size], 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	image, err := readMachOImage(uintptr(unsafe.Pointer(&memory[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := pclntab.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates := image.findPclntabCandidates()
+	for _, candidate := range candidates {
+		if bytes.HasPrefix(candidate, expected) {
+			return
+		}
+	}
+	t.Errorf("Expected to find __gopclntab in the Mach-O image, but found %v candidates", len(candidates))
+}
+
+const pieFixtureSource = `package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/kstenerud/go-subvert"
+)
+
+var pieVariable = []int{1, 2, 3}
+
+//go:noinline
+func pieFunction() int { return pieVariable[0] }
+
+//go:noinline
+func pieTraced(d time.Duration, label string) string {
+	time.Sleep(d)
+	return label
+}
+
+func check() error {
+	entry := uint64(reflect.ValueOf(pieFunction).Pointer())
+	symbol, err := subvert.GetFunctionSymbol(pieFunction)
+	if err != nil {
+		return err
+	}
+	if symbol.Entry != entry {
+		return fmt.Errorf("Expected pieFunction at %#x but the symbol table says %#x", entry, symbol.Entry)
+	}
+
+	exePath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	table, err := subvert.LoadSymbolTable(subvert.FileSymbolSource(exePath))
+	if err != nil {
+		return err
+	}
+	if function := table.LookupFunc("main.pieFunction"); function == nil || function.Entry != entry {
+		return fmt.Errorf("Expected pieFunction at %#x in the file symbol table but got %v", entry, function)
+	}
+
+	address := uintptr(unsafe.Pointer(&pieVariable))
+	data, err := subvert.Symbolize(address)
+	if err != nil {
+		return err
+	}
+	if data.Kind != subvert.SymbolKindData || data.Name != "main.pieVariable" {
+		return fmt.Errorf("Expected data main.pieVariable but got %v %v", data.Kind, data)
+	}
+	info, err := subvert.Classify(address)
+	if err != nil {
+		return err
+	}
+	if info.Class != subvert.PointerClassData {
+		return fmt.Errorf("Expected pieVariable to be in data but got %v", info.Class)
+	}
+
+	exposed, err := subvert.ExposeFunction("main.pieFunction", (func() int)(nil))
+	if err != nil {
+		return err
+	}
+	if result := exposed.(func() int)(); result != 1 {
+		return fmt.Errorf("Expected exposed pieFunction to return 1 but got %v", result)
+	}
+	if err = checkTrace(); err != nil {
+		return err
+	}
+	return checkDeletedExecutable(exePath, address)
+}
+
+// Unlike test binaries, this has debug info, so functions traced by name are
+// timed and their arguments can be logged.
+func checkTrace() error {
+	if runtime.GOARCH != "amd64" {
+		return nil
+	}
+	options := subvert.TraceOptions{LogArguments: true}
+	if err := subvert.TraceWithOptions(options, "main.pieTraced"); err == nil {
+		return fmt.Errorf("Expected logging arguments without a logger to fail")
+	}
+	var logged bytes.Buffer
+	if err := subvert.Init(subvert.Options{Logger: log.New(&logged, "", 0)}); err != nil {
+		return err
+	}
+	defer subvert.Init(subvert.Options{})
+
+	if err := subvert.TraceWithOptions(options, "main.pieTraced"); err != nil {
+		return err
+	}
+	result := pieTraced(time.Millisecond, "traced")
+	if err := subvert.StopTrace(); err != nil {
+		return err
+	}
+	if result != "traced" {
+		return fmt.Errorf("Expected traced pieTraced to return \"traced\" but got %q", result)
+	}
+	if !strings.Contains(logged.String(), "main.pieTraced(1000000, \"traced\")") {
+		return fmt.Errorf("Expected pieTraced's arguments to be logged but got %q", logged.String())
+	}
+	for _, stat := range subvert.TraceStats() {
+		if stat.Name == "main.pieTraced" {
+			if stat.Count != 1 || stat.TotalTime < time.Millisecond {
+				return fmt.Errorf("Expected 1 call taking at least 1ms, but got %v calls taking %v", stat.Count, stat.TotalTime)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("No trace stats for main.pieTraced")
+}
+
+// Everything that's read from the executable must come from the symbol
+// source once the original is gone.
+func checkDeletedExecutable(exePath string, address uintptr) error {
+	contents, err := os.ReadFile(exePath)
+	if err != nil {
+		return err
+	}
+	copyPath := exePath + ".copy"
+	if err = os.WriteFile(copyPath, contents, 0755); err != nil {
+		return err
+	}
+	if err = os.Remove(exePath); err != nil {
+		return err
+	}
+	subvert.SetSymbolSource(subvert.FileSymbolSource(copyPath))
+
+	data, err := subvert.Symbolize(address)
+	if err != nil {
+		return err
+	}
+	if data.Name != "main.pieVariable" {
+		return fmt.Errorf("Expected main.pieVariable from the copied executable but got %v", data)
+	}
+	info, err := subvert.Classify(address)
+	if err != nil {
+		return err
+	}
+	if info.Class != subvert.PointerClassData {
+		return fmt.Errorf("Expected pieVariable to be in data in the copied executable but got %v", info.Class)
+	}
+	return nil
+}
+
+func main() {
+	if err := check(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
+`
+
+func TestPIE(t *testing.T) {
+	if testing.Short() {
+		fmt.Printf("Skipping TestPIE because it builds a fixture.\n")
+		return
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		fmt.Printf("Skipping TestPIE because the go tool isn't available.\n")
+		return
+	}
+	repoDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	goSum, err := os.ReadFile(filepath.Join(repoDir, "go.sum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	goMod := "module fixture\n\ngo 1.18\n\nrequire github.com/kstenerud/go-subvert v0.0.0\n\n" +
+		"replace github.com/kstenerud/go-subvert => " + repoDir + "\n"
+	for name, contents := range map[string][]byte{
+		"main.go": []byte(pieFixtureSource),
+		"go.mod":  []byte(goMod),
+		"go.sum":  goSum,
+	} {
+		if err = os.WriteFile(filepath.Join(dir, name), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(dir, "fixture")
+	cmd := exec.Command(goTool, "build", "-buildmode=pie", "-o", path, ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Could not build PIE fixture: %v\n%s", err, output)
+	}
+
+	output, err := exec.Command(path).CombinedOutput()
+	if err != nil || strings.TrimSpace(string(output)) != "ok" {
+		t.Errorf("PIE fixture failed: %v\n%s", err, output)
+	}
+}
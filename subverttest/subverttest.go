@@ -0,0 +1,145 @@
+// Package subverttest wraps the subvert patching APIs for use in tests.
+//
+// Every patch made through this package is reverted automatically via
+// t.Cleanup(), and any failure (missing symbol, unsupported platform, type
+// mismatch) fails the test immediately with a message saying what couldn't be
+// patched.
+//
+// Patches are process-wide, so they would leak into any test running at the
+// same time. Patch(), PatchVar() and RedirectCalls() therefore refuse to run in
+// a test that has called t.Parallel(). Use RedirectCallsInGoroutine() instead,
+// which only affects calls made from the test's own goroutine.
+package subverttest
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kstenerud/go-subvert"
+)
+
+// Patch replaces target with replacement for the rest of the test. See
+// subvert.ReplaceFunction().
+func Patch(t testing.TB, target, replacement interface{}) {
+	t.Helper()
+	requireNotParallel(t, "Patch")
+	patch, err := subvert.ReplaceFunction(target, replacement)
+	if err != nil {
+		t.Fatalf("subverttest: Could not patch %v: %v", subvert.FunctionName(target), err)
+	}
+	t.Cleanup(func() { revert(t, patch) })
+}
+
+// PatchVar sets the variable named symbol (for example "main.verbose") to
+// value for the rest of the test. See subvert.WriteVariableByName().
+func PatchVar(t testing.TB, symbol string, value interface{}) {
+	t.Helper()
+	requireNotParallel(t, "PatchVar")
+	patch, err := subvert.WriteVariableByName(symbol, value)
+	if err != nil {
+		t.Fatalf("subverttest: Could not patch variable %v: %v", symbol, err)
+	}
+	t.Cleanup(func() { revert(t, patch) })
+}
+
+// RedirectCalls redirects every direct call to target so that it calls
+// replacement for the rest of the test. See subvert.RedirectCalls().
+func RedirectCalls(t testing.TB, target, replacement interface{}) {
+	t.Helper()
+	requireNotParallel(t, "RedirectCalls")
+	redirectCalls(t, target, replacement)
+}
+
+// RedirectCallsInGoroutine is the same as RedirectCalls(), except that only
+// calls made from the calling goroutine are sent to replacement. Calls from any
+// other goroutine (including goroutines started by the test) still reach the
+// original target, so this is safe to use in parallel tests.
+func RedirectCallsInGoroutine(t testing.TB, target, replacement interface{}) {
+	t.Helper()
+	original, err := subvert.AliasFunction(target)
+	if err != nil {
+		t.Fatalf("subverttest: Could not alias %v: %v", subvert.FunctionName(target), err)
+	}
+	rOriginal := reflect.ValueOf(original)
+	rReplacement := reflect.ValueOf(replacement)
+	if rReplacement.Type() != rOriginal.Type() {
+		t.Fatalf("subverttest: Replacement for %v has type %v, but should be %v",
+			subvert.FunctionName(target), rReplacement.Type(), rOriginal.Type())
+	}
+
+	owner := subvert.GoID()
+	scoped := reflect.MakeFunc(rOriginal.Type(), func(args []reflect.Value) []reflect.Value {
+		if subvert.GoID() == owner {
+			return subvert.CallOriginal(rReplacement, args)
+		}
+		return subvert.CallOriginal(rOriginal, args)
+	})
+	redirectCalls(t, target, scoped.Interface())
+}
+
+// Expose returns the function named symbol (for example
+// "runtime.spanOfHeap") as a function of type T. See subvert.ExposeFunction().
+//
+// T MUST be the function's actual type, or else undefined behavior will
+// result!
+func Expose[T any](t testing.TB, symbol string) T {
+	t.Helper()
+	var template T
+	if reflect.TypeOf(template) == nil || reflect.TypeOf(template).Kind() != reflect.Func {
+		t.Fatalf("subverttest: Cannot expose %v as %T: Not a function type", symbol, template)
+	}
+	function, err := subvert.ExposeFunction(symbol, template)
+	if err != nil {
+		t.Fatalf("subverttest: Could not expose %v: %v", symbol, err)
+	}
+	return function.(T)
+}
+
+func redirectCalls(t testing.TB, target, replacement interface{}) {
+	t.Helper()
+	patches, err := subvert.RedirectCalls(target, replacement)
+	if err != nil {
+		t.Fatalf("subverttest: Could not redirect calls to %v: %v", subvert.FunctionName(target), err)
+	}
+	t.Cleanup(func() {
+		for i := len(patches) - 1; i >= 0; i-- {
+			revert(t, patches[i])
+		}
+	})
+}
+
+func revert(t testing.TB, patch *subvert.Patch) {
+	t.Helper()
+	if err := patch.Revert(); err != nil {
+		t.Errorf("subverttest: Could not revert %v: %v", patch, err)
+	}
+}
+
+func requireNotParallel(t testing.TB, operation string) {
+	t.Helper()
+	if isParallel(t) {
+		t.Fatalf("subverttest: %v patches the whole process, and cannot be used in a parallel test. "+
+			"Use RedirectCallsInGoroutine() instead, or remove the call to t.Parallel()", operation)
+	}
+}
+
+// The testing package doesn't export whether a test is parallel, so we read
+// the unexported flag. Subtests of a parallel test run alongside other tests
+// too, so its parents are checked as well. If the flag can't be found, assume
+// the test isn't parallel.
+func isParallel(t testing.TB) bool {
+	test := reflect.ValueOf(t)
+	for test.Kind() == reflect.Ptr && !test.IsNil() && test.Elem().Kind() == reflect.Struct {
+		field := test.Elem().FieldByName("isParallel")
+		if !field.IsValid() || field.Kind() != reflect.Bool {
+			return false
+		}
+		if field.Bool() {
+			return true
+		}
+		if test = test.Elem().FieldByName("parent"); !test.IsValid() {
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package subverttest
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+//go:noinline
+func replaceMe(value int) int {
+	return value + 1
+}
+
+//go:noinline
+func callReplaceMe(value int) int {
+	return replaceMe(value) * 10
+}
+
+func TestPatch(t *testing.T) {
+	t.Run("patched", func(t *testing.T) {
+		Patch(t, replaceMe, func(value int) int {
+			return value + 100
+		})
+		if actual := callReplaceMe(1); actual != 1010 {
+			t.Errorf("Expected 1010 but got %v", actual)
+		}
+	})
+	if actual := callReplaceMe(1); actual != 20 {
+		t.Errorf("Expected 20 after cleanup but got %v", actual)
+	}
+}
+
+func TestRedirectCalls(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestRedirectCalls because it doesn't work in test binaries on this platform.\n")
+		return
+	}
+
+	t.Run("redirected", func(t *testing.T) {
+		RedirectCalls(t, replaceMe, func(value int) int {
+			return value + 200
+		})
+		if actual := callReplaceMe(1); actual != 2010 {
+			t.Errorf("Expected 2010 but got %v", actual)
+		}
+	})
+	if actual := callReplaceMe(1); actual != 20 {
+		t.Errorf("Expected 20 after cleanup but got %v", actual)
+	}
+}
+
+func TestRedirectCallsInGoroutine(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		fmt.Printf("Skipping TestRedirectCallsInGoroutine because it doesn't work in test binaries on this platform.\n")
+		return
+	}
+
+	t.Run("scoped", func(t *testing.T) {
+		t.Parallel()
+		RedirectCallsInGoroutine(t, replaceMe, func(value int) int {
+			return value + 300
+		})
+		if actual := callReplaceMe(1); actual != 3010 {
+			t.Errorf("Expected 3010 but got %v", actual)
+		}
+
+		result := make(chan int)
+		go func() { result <- callReplaceMe(1) }()
+		if actual := <-result; actual != 20 {
+			t.Errorf("Expected 20 from another goroutine but got %v", actual)
+		}
+	})
+}
+
+func TestIsParallel(t *testing.T) {
+	if isParallel(t) {
+		t.Errorf("Expected test to not be parallel")
+	}
+	t.Run("parallel", func(t *testing.T) {
+		t.Parallel()
+		if !isParallel(t) {
+			t.Errorf("Expected test to be parallel")
+		}
+		t.Run("subtest", func(t *testing.T) {
+			if !isParallel(t) {
+				t.Errorf("Expected a subtest of a parallel test to be parallel")
+			}
+		})
+	})
+}
+
+func TestExpose(t *testing.T) {
+	exposed := Expose[func(int) int](t, "github.com/kstenerud/go-subvert/subverttest.callReplaceMe")
+	if actual := exposed(2); actual != 30 {
+		t.Errorf("Expected 30 but got %v", actual)
+	}
+}
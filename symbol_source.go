@@ -0,0 +1,172 @@
+package subvert
+
+import (
+	"debug/gosym"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SymbolSource reads a go symbol table. See SetSymbolSource() and
+// LoadSymbolTable().
+type SymbolSource interface {
+	ReadSymbolTable() (*gosym.Table, error)
+	// Describes where the symbols come from
+	String() string
+}
+
+// MemorySymbolSource reads symbols from the executable image loaded in memory.
+func MemorySymbolSource() SymbolSource {
+	return memorySymbolSource{}
+}
+
+// FileSymbolSource reads symbols from the executable file at path. This is
+// useful when os.Executable() no longer refers to the running program, such as
+// when the file has been replaced or deleted.
+//
+// If the file is this process's executable, its symbols are relocated to where
+// it's loaded. Symbols from any other executable keep the addresses it was
+// linked at.
+func FileSymbolSource(path string) SymbolSource {
+	return fileSymbolSource{path}
+}
+
+// ReaderSymbolSource reads symbols from an executable file's contents, in the
+// same way as FileSymbolSource().
+func ReaderSymbolSource(reader io.ReaderAt) SymbolSource {
+	return readerSymbolSource{reader}
+}
+
+// TableSymbolSource provides an already loaded symbol table, for example one
+// returned by LoadSymbolTable().
+func TableSymbolSource(table *gosym.Table) SymbolSource {
+	return tableSymbolSource{table}
+}
+
+// SetSymbolSource sets where this process's symbol table is loaded from,
+// discarding any table that was already loaded. By default, symbols are read
+// from the in-memory image, falling back to the executable file.
+//
+// If source is a FileSymbolSource() or ReaderSymbolSource(), everything else
+// that's read from the executable file (native symbols, sections and DWARF
+// debug info) is read from it too. Otherwise that comes from os.Executable().
+//
+// Do this before patching anything.
+func SetSymbolSource(source SymbolSource) {
+	symbolSource = source
+	symTable = nil
+	symTableLoadError = nil
+	symTableSource = ""
+	symTableMemoryError = nil
+	resetCallCache()
+
+	nativeSymbols = nil
+	nativeSymbolsByName = nil
+	nativeSymbolsLoadError = nil
+	imageSections = nil
+	imageSectionsLoadError = nil
+	loadBias = 0
+	loadBiasFound = false
+	loadBiasLoadError = nil
+	resetDWARFLayouts()
+}
+
+// LoadSymbolTable loads a symbol table from source. The table is independent
+// of the table used by this package (see SetSymbolSource()).
+func LoadSymbolTable(source SymbolSource) (table *gosym.Table, err error) {
+	if table, err = source.ReadSymbolTable(); err != nil {
+		err = fmt.Errorf("Could not read symbols from %v: %w", source, err)
+		return
+	}
+	if table == nil {
+		err = fmt.Errorf("Could not read symbols from %v: symbol table was nil", source)
+	}
+	return
+}
+
+// Set by SetSymbolSource(), or nil to use the default sources.
+var symbolSource SymbolSource
+
+// Implemented by symbol sources that read an executable file.
+type executableSymbolSource interface {
+	openExecutable() (reader io.ReaderAt, close func(), err error)
+}
+
+// Open this process's executable file: the one that symbols are read from if
+// SetSymbolSource() was given a file or reader, or else os.Executable().
+func openExecutable() (reader io.ReaderAt, close func(), err error) {
+	if source, ok := symbolSource.(executableSymbolSource); ok {
+		return source.openExecutable()
+	}
+	exePath, err := os.Executable()
+	if err != nil {
+		return
+	}
+	return fileSymbolSource{exePath}.openExecutable()
+}
+
+type memorySymbolSource struct{}
+
+func (s memorySymbolSource) ReadSymbolTable() (*gosym.Table, error) {
+	return osReadSymbolsFromMemory()
+}
+
+func (s memorySymbolSource) String() string {
+	return "in-memory image"
+}
+
+type fileSymbolSource struct {
+	path string
+}
+
+func (s fileSymbolSource) ReadSymbolTable() (table *gosym.Table, err error) {
+	file, close, err := s.openExecutable()
+	if err != nil {
+		return
+	}
+	defer close()
+	return readExecutableSymbols(file)
+}
+
+func (s fileSymbolSource) openExecutable() (reader io.ReaderAt, close func(), err error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return
+	}
+	return file, func() { file.Close() }, nil
+}
+
+func (s fileSymbolSource) String() string {
+	return "executable file " + s.path
+}
+
+type readerSymbolSource struct {
+	reader io.ReaderAt
+}
+
+func (s readerSymbolSource) ReadSymbolTable() (*gosym.Table, error) {
+	return readExecutableSymbols(s.reader)
+}
+
+func (s readerSymbolSource) openExecutable() (reader io.ReaderAt, close func(), err error) {
+	return s.reader, func() {}, nil
+}
+
+func (s readerSymbolSource) String() string {
+	return "reader"
+}
+
+type tableSymbolSource struct {
+	table *gosym.Table
+}
+
+func (s tableSymbolSource) ReadSymbolTable() (*gosym.Table, error) {
+	if s.table == nil {
+		return nil, fmt.Errorf("No symbol table given")
+	}
+	return s.table, nil
+}
+
+func (s tableSymbolSource) String() string {
+	return "precomputed table"
+}
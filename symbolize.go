@@ -0,0 +1,181 @@
+package subvert
+
+import (
+	"bytes"
+	"fmt"
+	"unsafe"
+)
+
+// SymbolKind describes what sort of thing an address was resolved to.
+type SymbolKind int
+
+const (
+	SymbolKindUnknown SymbolKind = iota
+	SymbolKindFunction
+	SymbolKindData
+	SymbolKindMapping
+)
+
+var symbolKindNames = []string{
+	SymbolKindUnknown:  "unknown",
+	SymbolKindFunction: "function",
+	SymbolKindData:     "data",
+	SymbolKindMapping:  "mapping",
+}
+
+func (k SymbolKind) String() string {
+	if k < 0 || int(k) >= len(symbolKindNames) {
+		return fmt.Sprintf("SymbolKind(%d)", int(k))
+	}
+	return symbolKindNames[k]
+}
+
+// AddressSymbol describes the symbol (or failing that, the mapped file)
+// containing an address.
+type AddressSymbol struct {
+	Address uintptr
+	Kind    SymbolKind
+
+	// Name is the function or variable name, or the path of the mapped file.
+	Name string
+
+	// Offset is the distance from the start of the symbol or mapping.
+	Offset uintptr
+
+	// File and Line are only available for functions.
+	File string
+	Line int
+}
+
+func (s AddressSymbol) String() string {
+	if s.Kind == SymbolKindUnknown {
+		return fmt.Sprintf("%#x", s.Address)
+	}
+	result := s.Name
+	if result == "" {
+		result = "?"
+	}
+	if s.Offset != 0 {
+		result = fmt.Sprintf("%v+%#x", result, s.Offset)
+	}
+	if s.File != "" {
+		result = fmt.Sprintf("%v (%v:%v)", result, s.File, s.Line)
+	}
+	return result
+}
+
+// Symbolize looks up what an address points to. Functions are resolved using
+// the go symbol table, data using the executable's native symbol table, and
+// anything else using the memory map.
+func Symbolize(address uintptr) (symbol AddressSymbol, err error) {
+	return symbolize(address, true)
+}
+
+func symbolize(address uintptr, useMemoryMap bool) (symbol AddressSymbol, err error) {
+	symbol.Address = address
+
+	if table, tableErr := GetSymbolTable(); tableErr == nil {
+		if fn := table.PCToFunc(uint64(address)); fn != nil {
+			symbol.Kind = SymbolKindFunction
+			symbol.Name = fn.Name
+			symbol.Offset = address - uintptr(fn.Entry)
+			symbol.File, symbol.Line, _ = table.PCToLine(uint64(address))
+			return
+		}
+	}
+
+	if data, ok := getNativeSymbolContaining(address); ok {
+		symbol.Kind = SymbolKindData
+		symbol.Name = data.name
+		symbol.Offset = address - data.address
+		return
+	}
+
+	if !useMemoryMap {
+		err = fmt.Errorf("No symbol found for address %#x", address)
+		return
+	}
+
+	if regions, mapErr := GetMemoryMap(); mapErr == nil {
+		for _, region := range regions {
+			if region.Contains(address) {
+				symbol.Kind = SymbolKindMapping
+				symbol.Name = region.Path
+				symbol.Offset = address - region.Start
+				return
+			}
+		}
+	}
+
+	err = fmt.Errorf("No symbol found for address %#x", address)
+	return
+}
+
+// HexDump returns a hex dump of a memory range, annotating each line with the
+// symbol it falls in, and every pointer-aligned word that points to a known
+// function or data symbol.
+//
+// No checks are made as to whether the memory is readable.
+func HexDump(address uintptr, length int) string {
+	const bytesPerLine = 16
+	wordSize := 4
+	if is64BitUintptr {
+		wordSize = 8
+	}
+
+	var buff bytes.Buffer
+	memory := SliceAtAddress(address, length)
+	for lineStart := 0; lineStart < len(memory); lineStart += bytesPerLine {
+		lineEnd := lineStart + bytesPerLine
+		if lineEnd > len(memory) {
+			lineEnd = len(memory)
+		}
+		line := memory[lineStart:lineEnd]
+		lineAddress := address + uintptr(lineStart)
+
+		fmt.Fprintf(&buff, "%0*x ", wordSize*2, lineAddress)
+		for i := 0; i < bytesPerLine; i++ {
+			if i%8 == 0 {
+				buff.WriteByte(' ')
+			}
+			if i < len(line) {
+				fmt.Fprintf(&buff, "%02x ", line[i])
+			} else {
+				buff.WriteString("   ")
+			}
+		}
+		buff.WriteString(" |")
+		for _, b := range line {
+			if b < 0x20 || b > 0x7e {
+				b = '.'
+			}
+			buff.WriteByte(b)
+		}
+		buff.WriteString("|")
+
+		if symbol, err := symbolize(lineAddress, false); err == nil {
+			fmt.Fprintf(&buff, "  %v", symbol)
+		}
+
+		for i := 0; i+wordSize <= len(line); i += wordSize {
+			wordAddress := lineAddress + uintptr(i)
+			if wordAddress%uintptr(wordSize) != 0 {
+				continue
+			}
+			word := readWord(line[i : i+wordSize])
+			if word == 0 {
+				continue
+			}
+			if symbol, err := symbolize(word, false); err == nil {
+				fmt.Fprintf(&buff, "  [+%x -> %v]", i, symbol)
+			}
+		}
+		buff.WriteByte('\n')
+	}
+	return buff.String()
+}
+
+// Read a native-endian pointer-sized word.
+func readWord(data []byte) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&data[0]))
+}
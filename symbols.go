@@ -3,11 +3,18 @@ package subvert
 import (
 	"debug/gosym"
 	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"sort"
 )
 
 var (
 	symTable          *gosym.Table
 	symTableLoadError error
+	// Where symTable was loaded from, and why it couldn't be read from memory
+	symTableSource      string
+	symTableMemoryError error
 )
 
 func loadSymbolTable() (table *gosym.Table, err error) {
@@ -19,13 +26,22 @@ func loadSymbolTable() (table *gosym.Table, err error) {
 		return
 	}
 
+	if symbolSource != nil {
+		symTableSource = symbolSource.String()
+		table, err = LoadSymbolTable(symbolSource)
+		return
+	}
+
 	table, err = osReadSymbolsFromMemory()
 	if err == nil && table != nil {
 		symTable = table
+		symTableSource = MemorySymbolSource().String()
 		return
 	}
+	symTableMemoryError = err
 
 	table, err = osReadSymbolsFromExeFile()
+	symTableSource = "executable file"
 	symTableLoadError = err
 	if err != nil {
 		symTable = nil
@@ -39,6 +55,107 @@ func loadSymbolTable() (table *gosym.Table, err error) {
 	return
 }
 
+// Read this process's go symbol table from its executable file's contents,
+// relocated to where the executable is loaded.
+func readProcessSymbols(reader io.ReaderAt) (table *gosym.Table, err error) {
+	lineTableData, textStart, err := osReadLineTable(reader)
+	if err != nil {
+		return
+	}
+	bias, err := getLineTableLoadBias(lineTableData, textStart)
+	if err != nil {
+		return
+	}
+	return gosym.NewTable([]byte{}, gosym.NewLineTable(lineTableData, textStart+uint64(bias)))
+}
+
+// Read the go symbol table from an executable file's contents. If it's this
+// process's executable, the table is relocated to where the executable is
+// loaded. Otherwise it's left at the addresses it was linked at.
+func readExecutableSymbols(reader io.ReaderAt) (table *gosym.Table, err error) {
+	lineTableData, textStart, err := osReadLineTable(reader)
+	if err != nil {
+		return
+	}
+	bias, err := getLineTableLoadBias(lineTableData, textStart)
+	if err == errNotThisProcess {
+		bias, err = 0, nil
+	}
+	if err != nil {
+		return
+	}
+	return gosym.NewTable([]byte{}, gosym.NewLineTable(lineTableData, textStart+uint64(bias)))
+}
+
+var errNotThisProcess = fmt.Errorf("Symbol table doesn't contain this process's functions")
+
+// Returns how far the functions in a line table whose text starts at
+// textStart are from where they are in this process. This is 0 unless the
+// executable was loaded somewhere other than the address it was linked at
+// (for example a position independent executable with ASLR). It's worked out
+// from functions whose addresses are known, in different packages so that
+// another executable built with this package can't match by chance.
+func getLineTableLoadBias(lineTableData []byte, textStart uint64) (bias uintptr, err error) {
+	// Something that only looks like a line table can make gosym panic (see
+	// isGoLineTable()).
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("Invalid go line table: %v", e)
+		}
+	}()
+
+	table, err := gosym.NewTable([]byte{}, gosym.NewLineTable(lineTableData, textStart))
+	if err != nil {
+		return
+	}
+	for i, anchor := range []uintptr{
+		reflect.ValueOf(getLineTableLoadBias).Pointer(),
+		reflect.ValueOf(runtime.GC).Pointer(),
+	} {
+		anchorFunc := runtime.FuncForPC(anchor)
+		if anchorFunc == nil {
+			err = fmt.Errorf("Could not find the function at %#x", anchor)
+			return
+		}
+		function := table.LookupFunc(anchorFunc.Name())
+		if function == nil || (i > 0 && anchor-uintptr(function.Entry) != bias) {
+			err = errNotThisProcess
+			return
+		}
+		bias = anchor - uintptr(function.Entry)
+	}
+	return
+}
+
+var (
+	loadBias          uintptr
+	loadBiasFound     bool
+	loadBiasLoadError error
+)
+
+// Returns how far this process's executable is loaded from the addresses in
+// its file. Anything read from the file (native symbols, sections) must be
+// adjusted by this.
+func getLoadBias() (bias uintptr, err error) {
+	if loadBiasFound || loadBiasLoadError != nil {
+		return loadBias, loadBiasLoadError
+	}
+
+	defer func() {
+		loadBias, loadBiasFound, loadBiasLoadError = bias, err == nil, err
+	}()
+	exe, close, err := openExecutable()
+	if err != nil {
+		return
+	}
+	defer close()
+	lineTableData, textStart, err := osReadLineTable(exe)
+	if err != nil {
+		return
+	}
+	return getLineTableLoadBias(lineTableData, textStart)
+}
+
 // GetFunctionSymbol returns the symbols for a given function.
 func GetFunctionSymbol(function interface{}) (symbol *gosym.Func, err error) {
 	var table *gosym.Table
@@ -69,3 +186,105 @@ func getFunctionSymbolByName(name string) (symbol *gosym.Func, err error) {
 	}
 	return
 }
+
+// A symbol from the executable's native symbol table (ELF .symtab, Mach-O
+// symtab, or PE COFF symbols). Unlike the go symbol table, these include data
+// symbols.
+type nativeSymbol struct {
+	name    string
+	address uintptr
+	size    uintptr
+}
+
+var (
+	nativeSymbols          []nativeSymbol // Sorted by address
+	nativeSymbolsByName    map[string]nativeSymbol
+	nativeSymbolsLoadError error
+)
+
+func loadNativeSymbols() (err error) {
+	if nativeSymbols != nil || nativeSymbolsLoadError != nil {
+		return nativeSymbolsLoadError
+	}
+
+	exe, close, err := openExecutable()
+	if err != nil {
+		nativeSymbolsLoadError = err
+		return
+	}
+	defer close()
+	symbols, err := osReadNativeSymbols(exe)
+	if err != nil {
+		nativeSymbolsLoadError = err
+		return
+	}
+	bias, err := getLoadBias()
+	if err != nil {
+		nativeSymbolsLoadError = err
+		return
+	}
+	for i := range symbols {
+		symbols[i].address += bias
+	}
+
+	sortNativeSymbols(symbols)
+	nativeSymbolsByName = make(map[string]nativeSymbol, len(symbols))
+	for _, symbol := range symbols {
+		nativeSymbolsByName[symbol.name] = symbol
+	}
+	nativeSymbols = symbols
+	return
+}
+
+func getNativeSymbolByName(name string) (symbol nativeSymbol, err error) {
+	if err = loadNativeSymbols(); err != nil {
+		return
+	}
+
+	symbol, ok := nativeSymbolsByName[name]
+	if !ok {
+		err = fmt.Errorf("%v: symbol not found", name)
+	}
+	return
+}
+
+// Get the sized native symbol that contains address.
+func getNativeSymbolContaining(address uintptr) (symbol nativeSymbol, ok bool) {
+	if loadNativeSymbols() != nil {
+		return
+	}
+
+	index := sort.Search(len(nativeSymbols), func(i int) bool {
+		return nativeSymbols[i].address > address
+	})
+	for index--; index >= 0; index-- {
+		candidate := nativeSymbols[index]
+		if candidate.size == 0 {
+			continue
+		}
+		if address < candidate.address+candidate.size {
+			return candidate, true
+		}
+		return
+	}
+	return
+}
+
+func sortNativeSymbols(symbols []nativeSymbol) {
+	sort.Slice(symbols, func(i, j int) bool {
+		return symbols[i].address < symbols[j].address
+	})
+}
+
+// Convert symbols read from this process's executable by sizeBinarySymbols().
+func binaryToNativeSymbols(symbols []BinarySymbol) (native []nativeSymbol) {
+	native = make([]nativeSymbol, len(symbols))
+	for i, s := range symbols {
+		native[i] = nativeSymbol{
+			name:    s.Name,
+			address: uintptr(s.Address),
+			size:    uintptr(s.Size),
+		}
+	}
+	return
+}
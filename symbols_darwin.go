@@ -3,7 +3,7 @@
 package subvert
 
 import (
-	"bytes"
+	"debug/dwarf"
 	"debug/gosym"
 	"debug/macho"
 	"fmt"
@@ -12,11 +12,17 @@ import (
 )
 
 func osReadSymbolsFromMemory() (symTable *gosym.Table, err error) {
+	if err = initProcess(); err != nil {
+		return
+	}
 	if processBaseAddress == 0 {
 		return nil, fmt.Errorf("Base address not found")
 	}
-	reader := bytes.NewReader(SliceAtAddress(processBaseAddress, 0x10000000))
-	return osReadSymbols(reader)
+	image, err := readMachOImage(processBaseAddress)
+	if err != nil {
+		return
+	}
+	return image.readSymbols()
 }
 
 func osReadSymbolsFromExeFile() (symTable *gosym.Table, err error) {
@@ -32,32 +38,88 @@ func osReadSymbolsFromExeFile() (symTable *gosym.Table, err error) {
 		return
 	}
 
-	return osReadSymbols(reader)
+	return readProcessSymbols(reader)
 }
 
-func osReadSymbols(reader io.ReaderAt) (symTable *gosym.Table, err error) {
+func osReadLineTable(reader io.ReaderAt) (lineTableData []byte, textStart uint64, err error) {
+	return readMachOLineTable(reader)
+}
+
+func osReadNativeSymbols(reader io.ReaderAt) (symbols []nativeSymbol, err error) {
 	exe, err := macho.NewFile(reader)
 	if err != nil {
 		return
 	}
 	defer exe.Close()
 
-	var sect *macho.Section
-	if sect = exe.Section("__text"); sect == nil {
-		err = fmt.Errorf("Unable to find Mach-O __text section")
+	if exe.Symtab == nil {
+		err = fmt.Errorf("Mach-O file has no symbol table")
 		return
 	}
-	textStart := sect.Addr
 
-	if sect = exe.Section("__gopclntab"); sect == nil {
-		err = fmt.Errorf("Unable to find Mach-O __gopclntab section")
+	var unsized []unsizedBinarySymbol
+	for _, s := range exe.Symtab.Syms {
+		// Only non-debug symbols defined in a section (N_SECT)
+		if s.Sect == 0 || int(s.Sect) > len(exe.Sections) ||
+			s.Type&0xe0 != 0 || s.Type&0x0e != 0x0e || s.Name == "" {
+			continue
+		}
+		sect := exe.Sections[s.Sect-1]
+		unsized = append(unsized, unsizedBinarySymbol{
+			BinarySymbol: BinarySymbol{Name: s.Name, Address: s.Value},
+			sectionEnd:   sect.Addr + sect.Size,
+		})
+	}
+
+	symbols = binaryToNativeSymbols(sizeBinarySymbols(unsized))
+	return
+}
+
+func osReadImageSections(reader io.ReaderAt) (sections []imageSection, err error) {
+	exe, err := macho.NewFile(reader)
+	if err != nil {
 		return
 	}
-	lineTableData, err := sect.Data()
+	defer exe.Close()
+
+	const (
+		sectionTypeMask         = 0xff
+		sectionZeroFill         = 0x01
+		sectionGBZeroFill       = 0x0c
+		sectionInstructions     = 0x80000000
+		sectionSomeInstructions = 0x00000400
+	)
+
+	for _, sect := range exe.Sections {
+		if sect.Size == 0 {
+			continue
+		}
+		class := PointerClassRodata
+		sectionType := sect.Flags & sectionTypeMask
+		switch {
+		case sect.Flags&(sectionInstructions|sectionSomeInstructions) != 0:
+			class = PointerClassText
+		case sectionType == sectionZeroFill || sectionType == sectionGBZeroFill:
+			class = PointerClassBSS
+		case sect.Seg == "__DATA":
+			class = PointerClassData
+		}
+		sections = append(sections, imageSection{
+			name:  sect.Name,
+			start: uintptr(sect.Addr),
+			end:   uintptr(sect.Addr + sect.Size),
+			class: class,
+		})
+	}
+	return
+}
+
+func osReadDWARF(reader io.ReaderAt) (data *dwarf.Data, err error) {
+	exe, err := macho.NewFile(reader)
 	if err != nil {
 		return
 	}
+	defer exe.Close()
 
-	lineTable := gosym.NewLineTable(lineTableData, textStart)
-	return gosym.NewTable([]byte{}, lineTable)
+	return exe.DWARF()
 }
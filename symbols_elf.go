@@ -3,7 +3,7 @@
 package subvert
 
 import (
-	"bytes"
+	"debug/dwarf"
 	"debug/elf"
 	"debug/gosym"
 	"fmt"
@@ -12,11 +12,17 @@ import (
 )
 
 func osReadSymbolsFromMemory() (symTable *gosym.Table, err error) {
+	if err = initProcess(); err != nil {
+		return
+	}
 	if processBaseAddress == 0 {
 		return nil, fmt.Errorf("Base address not found")
 	}
-	reader := bytes.NewReader(SliceAtAddress(processBaseAddress, 0x10000000))
-	return osReadSymbols(reader)
+	image, err := readELFImage(processBaseAddress)
+	if err != nil {
+		return
+	}
+	return image.readSymbols()
 }
 
 func osReadSymbolsFromExeFile() (symTable *gosym.Table, err error) {
@@ -32,33 +38,78 @@ func osReadSymbolsFromExeFile() (symTable *gosym.Table, err error) {
 		return
 	}
 
-	return osReadSymbols(reader)
+	return readProcessSymbols(reader)
 }
 
-func osReadSymbols(reader io.ReaderAt) (symTable *gosym.Table, err error) {
+func osReadLineTable(reader io.ReaderAt) (lineTableData []byte, textStart uint64, err error) {
+	return readELFLineTable(reader)
+}
+
+func osReadNativeSymbols(reader io.ReaderAt) (symbols []nativeSymbol, err error) {
 	exe, err := elf.NewFile(reader)
 	if err != nil {
 		return
 	}
 	defer exe.Close()
 
-	sect := exe.Section(".text")
-	if sect == nil {
-		err = fmt.Errorf("Unable to find ELF .text section")
+	elfSymbols, err := exe.Symbols()
+	if err != nil {
 		return
 	}
-	textStart := sect.Addr
 
-	sect = exe.Section(".gopclntab")
-	if sect == nil {
-		err = fmt.Errorf("Unable to find ELF .gopclntab section")
+	for _, s := range elfSymbols {
+		if s.Section == elf.SHN_UNDEF || s.Name == "" {
+			continue
+		}
+		switch elf.ST_TYPE(s.Info) {
+		case elf.STT_FILE, elf.STT_SECTION:
+			continue
+		}
+		symbols = append(symbols, nativeSymbol{
+			name:    s.Name,
+			address: uintptr(s.Value),
+			size:    uintptr(s.Size),
+		})
+	}
+	return
+}
+
+func osReadImageSections(reader io.ReaderAt) (sections []imageSection, err error) {
+	exe, err := elf.NewFile(reader)
+	if err != nil {
 		return
 	}
-	lineTableData, err := sect.Data()
+	defer exe.Close()
+
+	for _, sect := range exe.Sections {
+		if sect.Flags&elf.SHF_ALLOC == 0 || sect.Size == 0 {
+			continue
+		}
+		class := PointerClassRodata
+		switch {
+		case sect.Flags&elf.SHF_EXECINSTR != 0:
+			class = PointerClassText
+		case sect.Type == elf.SHT_NOBITS:
+			class = PointerClassBSS
+		case sect.Flags&elf.SHF_WRITE != 0:
+			class = PointerClassData
+		}
+		sections = append(sections, imageSection{
+			name:  sect.Name,
+			start: uintptr(sect.Addr),
+			end:   uintptr(sect.Addr + sect.Size),
+			class: class,
+		})
+	}
+	return
+}
+
+func osReadDWARF(reader io.ReaderAt) (data *dwarf.Data, err error) {
+	exe, err := elf.NewFile(reader)
 	if err != nil {
 		return
 	}
+	defer exe.Close()
 
-	lineTable := gosym.NewLineTable(lineTableData, textStart)
-	return gosym.NewTable([]byte{}, lineTable)
+	return exe.DWARF()
 }
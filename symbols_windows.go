@@ -4,6 +4,7 @@ package subvert
 
 import (
 	// "bytes"
+	"debug/dwarf"
 	"debug/gosym"
 	"debug/pe"
 	"fmt"
@@ -12,6 +13,9 @@ import (
 )
 
 func osReadSymbolsFromMemory() (symTable *gosym.Table, err error) {
+	if err = initProcess(); err != nil {
+		return
+	}
 	if processBaseAddress == 0 {
 		return nil, fmt.Errorf("Base address not found")
 	}
@@ -19,7 +23,7 @@ func osReadSymbolsFromMemory() (symTable *gosym.Table, err error) {
 	return nil, fmt.Errorf("TODO: Fails with: fail to read string table: unexpected EOF")
 
 	// reader := bytes.NewReader(SliceAtAddress(processBaseAddress, 0x2c4000))
-	// return osReadSymbols(reader)
+	// return readProcessSymbols(reader)
 }
 
 func osReadSymbolsFromExeFile() (symTable *gosym.Table, err error) {
@@ -35,66 +39,107 @@ func osReadSymbolsFromExeFile() (symTable *gosym.Table, err error) {
 		return
 	}
 
-	return osReadSymbols(reader)
+	return readProcessSymbols(reader)
+}
+
+func osReadLineTable(reader io.ReaderAt) (lineTableData []byte, textStart uint64, err error) {
+	return readPELineTable(reader)
 }
 
-func osReadSymbols(reader io.ReaderAt) (symTable *gosym.Table, err error) {
+func osReadNativeSymbols(reader io.ReaderAt) (symbols []nativeSymbol, err error) {
 	exe, err := pe.NewFile(reader)
 	if err != nil {
 		return
 	}
 	defer exe.Close()
 
-	var imageBase uint64
-	switch oh := exe.OptionalHeader.(type) {
-	case *pe.OptionalHeader32:
-		imageBase = uint64(oh.ImageBase)
-	case *pe.OptionalHeader64:
-		imageBase = oh.ImageBase
-	default:
-		err = fmt.Errorf("Unrecognized PE format")
-		return
-	}
-
-	sect := exe.Section(".text")
-	if sect == nil {
-		err = fmt.Errorf("Unable to find PE .text section")
+	imageBase, err := getPEImageBase(exe)
+	if err != nil {
 		return
 	}
-	textStart := imageBase + uint64(sect.VirtualAddress)
 
-	findSymbol := func(symbols []*pe.Symbol, name string) *pe.Symbol {
-		for _, s := range symbols {
-			if s.Name == name {
-				return s
-			}
+	var unsized []unsizedBinarySymbol
+	for _, s := range exe.Symbols {
+		sectionIndex := int(s.SectionNumber) - 1
+		if sectionIndex < 0 || sectionIndex >= len(exe.Sections) || s.Name == "" {
+			continue
 		}
-		return nil
+		sect := exe.Sections[sectionIndex]
+		sectStart := imageBase + uint64(sect.VirtualAddress)
+		unsized = append(unsized, unsizedBinarySymbol{
+			BinarySymbol: BinarySymbol{Name: s.Name, Address: sectStart + uint64(s.Value)},
+			sectionEnd:   sectStart + uint64(sect.VirtualSize),
+		})
 	}
 
-	lineTableStart := findSymbol(exe.Symbols, "runtime.pclntab")
-	lineTableEnd := findSymbol(exe.Symbols, "runtime.epclntab")
-	if lineTableStart == nil || lineTableEnd == nil {
-		err = fmt.Errorf("Could not find PE runtime.pclntab or runtime.epclntab")
-		return
-	}
-	sectionIndex := lineTableStart.SectionNumber - 1
-	if sectionIndex < 0 || int(sectionIndex) >= len(exe.Sections) {
-		err = fmt.Errorf("Invalid PE format: invalid section number %v", lineTableStart.SectionNumber)
+	symbols = binaryToNativeSymbols(sizeBinarySymbols(unsized))
+	return
+}
+
+func osReadImageSections(reader io.ReaderAt) (sections []imageSection, err error) {
+	exe, err := pe.NewFile(reader)
+	if err != nil {
 		return
 	}
-	lineTableData, err := exe.Sections[sectionIndex].Data()
+	defer exe.Close()
+
+	imageBase, err := getPEImageBase(exe)
 	if err != nil {
 		return
 	}
-	if int(lineTableStart.Value) > len(lineTableData) ||
-		int(lineTableEnd.Value) > len(lineTableData) ||
-		lineTableStart.Value > lineTableEnd.Value {
-		err = fmt.Errorf("Invalid PE pcln start/end indices: %v, %v", lineTableStart.Value, lineTableEnd.Value)
+
+	const (
+		scnCode              = 0x00000020
+		scnUninitializedData = 0x00000080
+		scnMemWrite          = 0x80000000
+	)
+
+	for _, sect := range exe.Sections {
+		if sect.VirtualSize == 0 {
+			continue
+		}
+		start := uintptr(imageBase + uint64(sect.VirtualAddress))
+		class := PointerClassRodata
+		switch {
+		case sect.Characteristics&scnCode != 0:
+			class = PointerClassText
+		case sect.Characteristics&scnUninitializedData != 0:
+			class = PointerClassBSS
+		case sect.Characteristics&scnMemWrite != 0:
+			class = PointerClassData
+			// Go places .bss at the end of .data, beyond the initialized part.
+			if sect.VirtualSize > sect.Size {
+				sections = append(sections, imageSection{
+					name:  sect.Name,
+					start: start + uintptr(sect.Size),
+					end:   start + uintptr(sect.VirtualSize),
+					class: PointerClassBSS,
+				})
+				sections = append(sections, imageSection{
+					name:  sect.Name,
+					start: start,
+					end:   start + uintptr(sect.Size),
+					class: class,
+				})
+				continue
+			}
+		}
+		sections = append(sections, imageSection{
+			name:  sect.Name,
+			start: start,
+			end:   start + uintptr(sect.VirtualSize),
+			class: class,
+		})
+	}
+	return
+}
+
+func osReadDWARF(reader io.ReaderAt) (data *dwarf.Data, err error) {
+	exe, err := pe.NewFile(reader)
+	if err != nil {
 		return
 	}
-	lineTableData = lineTableData[lineTableStart.Value:lineTableEnd.Value]
+	defer exe.Close()
 
-	lineTable := gosym.NewLineTable(lineTableData, textStart)
-	return gosym.NewTable([]byte{}, lineTable)
+	return exe.DWARF()
 }
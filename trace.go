@@ -0,0 +1,301 @@
+package subvert
+
+import (
+	"debug/gosym"
+	"fmt"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// TraceStat holds the statistics gathered for a traced function.
+type TraceStat struct {
+	Name  string
+	Count uint64
+	// Total time spent in the function. Not measured for functions that Trace()
+	// can only count.
+	TotalTime time.Duration
+	// Where the function was last called from.
+	LastCaller AddressSymbol
+}
+
+// TraceOptions controls what TraceWithOptions() records.
+type TraceOptions struct {
+	// Log every call and its arguments to Options.Logger (see Init()), like
+	// TraceFunction() does.
+	LogArguments bool
+}
+
+// Trace counts calls to each of the named functions (for example
+// "encoding/json.(*decodeState).object"), measures the time spent in them, and
+// records where they were last called from. See TraceStats().
+//
+// Functions are found by name, so their types are read from the executable's
+// DWARF debug info, and each function is then wrapped the same way that
+// TraceFunction() does. Without debug info (for example in executables built
+// with -ldflags=-w), and for closures and assembly functions, calls are only
+// counted, through a small stub.
+//
+// Like RedirectCalls(), only direct calls are traced, so calls through
+// function values or interfaces, and inlined calls, are not counted.
+//
+// Either all of the functions are traced, or none are.
+func Trace(symbols ...string) error {
+	return TraceWithOptions(TraceOptions{}, symbols...)
+}
+
+// TraceWithOptions is Trace() with options. Functions whose arguments can't be
+// logged (see Trace()) are an error when options.LogArguments is set, as is
+// not having given Init() a Logger.
+func TraceWithOptions(options TraceOptions, symbols ...string) (err error) {
+	traceLock.Lock()
+	defer traceLock.Unlock()
+
+	if err = checkTraceLogger(options.LogArguments); err != nil {
+		return
+	}
+
+	var patches []*Patch
+	for _, symbol := range symbols {
+		var added []*Patch
+		if added, err = traceSymbol(symbol, options); err != nil {
+			// Reverting already reverted patches does nothing, so StopTrace()
+			// can retry the whole lot.
+			if rollbackErr := revertPatches(patches); rollbackErr != nil {
+				err = fmt.Errorf("%v (rollback also failed: %w)", err, rollbackErr)
+				tracePatches = append(tracePatches, patches...)
+			}
+			return
+		}
+		patches = append(patches, added...)
+	}
+	tracePatches = append(tracePatches, patches...)
+	return
+}
+
+// TraceFunction counts calls to function, measures the time spent in it, and
+// records where it was last called from. If logArguments is true, every call
+// and its arguments are logged to Options.Logger, which must have been given to
+// Init(). See TraceStats().
+//
+// Like RedirectCalls(), only direct calls are traced.
+func TraceFunction(function interface{}, logArguments bool) (err error) {
+	traceLock.Lock()
+	defer traceLock.Unlock()
+
+	if err = checkTraceLogger(logArguments); err != nil {
+		return
+	}
+	symbol, err := GetFunctionSymbol(function)
+	if err != nil {
+		return
+	}
+	patches, err := traceFunction(symbol.Name, function, logArguments)
+	if err != nil {
+		return
+	}
+	tracePatches = append(tracePatches, patches...)
+	return
+}
+
+// TraceStats returns the statistics of every function traced so far, sorted
+// by name. Statistics are kept after StopTrace(), and tracing a function again
+// continues from where it left off.
+func TraceStats() (stats []TraceStat) {
+	traceLock.Lock()
+	defer traceLock.Unlock()
+
+	for name, counter := range traceCounters {
+		stat := TraceStat{
+			Name:      name,
+			Count:     uint64(atomic.LoadUintptr(&counter.count)),
+			TotalTime: time.Duration(atomic.LoadInt64(&counter.totalTime)),
+		}
+		if caller := atomic.LoadUintptr(&counter.lastCaller); caller != 0 {
+			// The return address is just past the call instruction.
+			stat.LastCaller, _ = Symbolize(caller - 1)
+		}
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return
+}
+
+// StopTrace removes all tracing hooks.
+func StopTrace() (err error) {
+	traceLock.Lock()
+	defer traceLock.Unlock()
+
+	err = revertPatches(tracePatches)
+	tracePatches = nil
+	return
+}
+
+// Updated by the counting stubs, so the first two fields must stay where they
+// are.
+type traceCounter struct {
+	count      uintptr
+	lastCaller uintptr
+	totalTime  int64
+}
+
+var (
+	traceLock     sync.Mutex
+	traceCounters = make(map[string]*traceCounter)
+	tracePatches  []*Patch
+)
+
+func getTraceCounter(name string) *traceCounter {
+	counter, ok := traceCounters[name]
+	if !ok {
+		counter = &traceCounter{}
+		traceCounters[name] = counter
+	}
+	return counter
+}
+
+func traceFunction(name string, function interface{}, logArguments bool) (patches []*Patch, err error) {
+	original, err := AliasFunction(function)
+	if err != nil {
+		return
+	}
+	rOriginal := reflect.ValueOf(original)
+	stats := getTraceCounter(name)
+
+	hook := reflect.MakeFunc(rOriginal.Type(), func(args []reflect.Value) []reflect.Value {
+		atomic.AddUintptr(&stats.count, 1)
+		atomic.StoreUintptr(&stats.lastCaller, findTracedCaller())
+		if logArguments {
+			logf("%v(%v)", name, formatArguments(args))
+		}
+		start := time.Now()
+		defer func() {
+			atomic.AddInt64(&stats.totalTime, int64(time.Since(start)))
+		}()
+		return CallOriginal(rOriginal, args)
+	})
+
+	return redirectCalls(function, nil, hook.Interface())
+}
+
+func traceSymbol(name string, options TraceOptions) (patches []*Patch, err error) {
+	symbol, err := getFunctionSymbolByName(name)
+	if err != nil {
+		return
+	}
+	function, err := exposeTracedFunction(symbol)
+	if err == nil {
+		return traceFunction(name, function, options.LogArguments)
+	}
+	if options.LogArguments {
+		return nil, fmt.Errorf("Cannot log the arguments of %v: %w", name, err)
+	}
+	return countSymbolCalls(symbol)
+}
+
+// Get a function value for symbol with a type that can be wrapped like
+// TraceFunction() does.
+func exposeTracedFunction(symbol *gosym.Func) (function interface{}, err error) {
+	// A closure would be called without its context, and the DWARF info of an
+	// assembly function doesn't list its parameters.
+	if closurePattern.MatchString(symbol.Name) {
+		return nil, fmt.Errorf("%v is a closure", symbol.Name)
+	}
+	if table, tableErr := GetSymbolTable(); tableErr == nil {
+		if file, _, _ := table.PCToLine(symbol.Entry); strings.HasSuffix(file, ".s") {
+			return nil, fmt.Errorf("%v is an assembly function", symbol.Name)
+		}
+	}
+	layouts, err := getDWARFLayouts()
+	if err != nil {
+		return
+	}
+	typ, err := layouts.getFunctionType(symbol.Name)
+	if err != nil {
+		return
+	}
+	return newFunctionWithImplementation(reflect.Zero(typ).Interface(), uintptr(symbol.Entry))
+}
+
+var closurePattern = regexp.MustCompile(`\.func\d+(\.\d+)*$|-fm$|-range\d+`)
+
+func countSymbolCalls(symbol *gosym.Func) (patches []*Patch, err error) {
+	name := symbol.Name
+	sites, err := osGetCallSites(uintptr(symbol.Entry))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+
+	// Counters live on the heap, which doesn't move.
+	counter := getTraceCounter(name)
+	code, err := osMakeCountingStub(uintptr(unsafe.Pointer(counter)), uintptr(symbol.Entry))
+	if err != nil {
+		return
+	}
+	stub, err := newStub(code, len(sites))
+	if err != nil {
+		return
+	}
+
+	for _, site := range sites {
+		var patch *Patch
+		if patch, err = applyPatch(PatchKindCallRedirection, site, osMakeCallArg(site, stub.address), counter); err != nil {
+			// Call sites that couldn't be restored still jump to the stub, so
+			// it has to be leaked.
+			if rollbackErr := revertPatches(patches); rollbackErr != nil {
+				return nil, fmt.Errorf("%v (rollback also failed: %w)", err, rollbackErr)
+			}
+			stub.release(len(sites) - len(patches))
+			return nil, err
+		}
+		patch.onRevert = func() { stub.release(1) }
+		patches = append(patches, patch)
+	}
+	return
+}
+
+// Find the return address into the first caller outside of the hook
+// machinery (this package and reflect).
+func findTracedCaller() uintptr {
+	pcs := make([]uintptr, 16)
+	for _, pc := range pcs[:runtime.Callers(2, pcs)] {
+		function := runtime.FuncForPC(pc - 1)
+		if function == nil {
+			return pc
+		}
+		name := function.Name()
+		file, _ := function.FileLine(pc - 1)
+		if !strings.HasPrefix(name, "reflect.") &&
+			!(strings.HasPrefix(name, packagePath+".") && !strings.HasSuffix(file, "_test.go")) {
+			return pc
+		}
+	}
+	return 0
+}
+
+func formatArguments(args []reflect.Value) string {
+	formatted := make([]string, len(args))
+	for i, arg := range args {
+		if arg.CanInterface() {
+			formatted[i] = fmt.Sprintf("%#v", arg.Interface())
+		} else {
+			formatted[i] = arg.Type().String()
+		}
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func checkTraceLogger(logArguments bool) error {
+	if logArguments && logger == nil {
+		return fmt.Errorf("Cannot log arguments: Init() was not given a Logger")
+	}
+	return nil
+}
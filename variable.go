@@ -0,0 +1,119 @@
+package subvert
+
+import (
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// WriteVariable writes value to the variable that pointer points to, returning
+// a patch that restores the old value when reverted. value must be assignable
+// to the variable's type.
+//
+// Unlike PatchMemory(), this goes through the normal assignment machinery, so
+// it's safe to use on variables containing pointers.
+func WriteVariable(pointer interface{}, value interface{}) (patch *Patch, err error) {
+	w, err := prepareWriteVariable(pointer, value)
+	if err != nil {
+		return
+	}
+	return w.apply()
+}
+
+// WriteVariableByName is the same as WriteVariable(), but finds the variable
+// via its symbol name. The variable's type is assumed to be the type of value.
+//
+// Variable symbols are only available if the executable's symbol table hasn't
+// been stripped.
+func WriteVariableByName(symbolName string, value interface{}) (patch *Patch, err error) {
+	w, err := prepareWriteVariableByName(symbolName, value)
+	if err != nil {
+		return
+	}
+	return w.apply()
+}
+
+// A validated variable write, ready to apply.
+type variableWrite struct {
+	target reflect.Value
+	value  reflect.Value
+}
+
+func prepareWriteVariable(pointer interface{}, value interface{}) (w *variableWrite, err error) {
+	rPointer := reflect.ValueOf(pointer)
+	if rPointer.Kind() != reflect.Ptr || rPointer.IsNil() {
+		err = fmt.Errorf("%v is not a non-nil pointer", rPointer.Type())
+		return
+	}
+	return newVariableWrite(rPointer.Elem(), value)
+}
+
+func prepareWriteVariableByName(symbolName string, value interface{}) (w *variableWrite, err error) {
+	symbol, err := getNativeSymbolByName(symbolName)
+	if err != nil {
+		return
+	}
+
+	rType := reflect.TypeOf(value)
+	if rType == nil {
+		err = fmt.Errorf("Cannot determine the type of %v from a nil value", symbolName)
+		return
+	}
+	if symbol.size != 0 && symbol.size != rType.Size() {
+		err = fmt.Errorf("%v is %v bytes long, but %v is %v bytes long", symbolName, symbol.size, rType, rType.Size())
+		return
+	}
+
+	target := reflect.NewAt(rType, unsafe.Pointer(symbol.address)).Elem()
+	return newVariableWrite(target, value)
+}
+
+func newVariableWrite(target reflect.Value, value interface{}) (w *variableWrite, err error) {
+	rValue := reflect.ValueOf(value)
+	if !rValue.IsValid() {
+		rValue = reflect.Zero(target.Type())
+	}
+	if !rValue.Type().AssignableTo(target.Type()) {
+		err = fmt.Errorf("Value of type %v is not assignable to variable of type %v", rValue.Type(), target.Type())
+		return
+	}
+	if err = MakeWritable(&target); err != nil {
+		return
+	}
+
+	w = &variableWrite{
+		target: target,
+		value:  rValue,
+	}
+	return
+}
+
+func (w *variableWrite) apply() (patch *Patch, err error) {
+	address := w.target.UnsafeAddr()
+	size := int(w.target.Type().Size())
+
+	return registerPatch(PatchKindVariable, address, size, func() (patch *Patch, err error) {
+		memory := SliceAtAddress(address, size)
+
+		original := reflect.New(w.target.Type()).Elem()
+		original.Set(w.target)
+		originalBytes := append([]byte{}, memory...)
+
+		w.target.Set(w.value)
+
+		patch = &Patch{
+			Address:    address,
+			Original:   originalBytes,
+			Patched:    append([]byte{}, memory...),
+			referenced: original,
+		}
+		patch.restore = func() error {
+			if err := verifyMemory(address, patch.Patched); err != nil {
+				return err
+			}
+			w.target.Set(original)
+			return nil
+		}
+		return
+	})
+}